@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+)
+
+// ファイルのSHA-256ハッシュ値
+// データ出力に埋め込んでファイルの存在時刻を証明するのに使う
+func HashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// データを埋め込んだ署名済みのトランザクションの生成
+// 手数料feeはwalletのアドレスの未使用出力（メモリプールにある未承認のおつりを含む）から支払い、おつりはchangeに送る
+func NewDataTransaction(wallet *Wallet, data []byte, fee int,
+	change string, pool *Mempool) (*Transaction, error) {
+	script, err := NewNullDataScript(data)
+	if err != nil {
+		return nil, err
+	}
+	from := string(wallet.GetAddress())
+	tx, err := newSpendTransaction(from, []TXOutput{{0, script}}, fee, change, 0, pool)
+	if err != nil {
+		return nil, err
+	}
+	// 送金元の秘密鍵で署名
+	if err := pool.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		return nil, err
+	}
+	tx.SetID()
+	return tx, nil
+}
+
+// データ出力にdataを埋め込んだ最も古いトランザクションと、それを含むブロックを探す
+func (bc *Blockchain) FindDataOutput(data []byte) (*Block, *Transaction, error) {
+	var foundBlock *Block
+	var foundTx *Transaction
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				embedded, ok := ExtractNullData(out.ScriptPubKey)
+				if ok && bytes.Equal(embedded, data) {
+					// 新しいブロックから遡るので、後に見つかったものほど古い
+					foundBlock, foundTx = block, tx
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	if foundTx == nil {
+		return nil, nil, errors.New("データを埋め込んだトランザクションが見つかりません")
+	}
+	return foundBlock, foundTx, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// Base58で使用する文字（0, O, I, lのような紛らわしい文字を除く）
+var b58Alphabet = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
+
+// バイト配列をBase58でエンコード
+func Base58Encode(input []byte) []byte {
+	var result []byte
+
+	x := big.NewInt(0).SetBytes(input) // 入力を大きな整数とみなす
+	base := big.NewInt(int64(len(b58Alphabet)))
+	zero := big.NewInt(0)
+	mod := &big.Int{}
+
+	// 58で割った余りを下の桁から順に文字へ変換
+	for x.Cmp(zero) != 0 {
+		x.DivMod(x, base, mod)
+		result = append(result, b58Alphabet[mod.Int64()])
+	}
+
+	// 下の桁から追加したので順番を反転
+	ReverseBytes(result)
+	// 先頭の0x00はそれぞれ先頭文字1つとして表現
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
+		result = append([]byte{b58Alphabet[0]}, result...)
+	}
+	return result
+}
+
+// Base58でエンコードされたデータをデコード
+func Base58Decode(input []byte) []byte {
+	result := big.NewInt(0)
+	zeroBytes := 0
+
+	// 先頭の'1'の数だけ0x00を復元する
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
+		}
+		zeroBytes++
+	}
+
+	payload := input[zeroBytes:]
+	for _, b := range payload {
+		charIndex := bytes.IndexByte(b58Alphabet, b)
+		if charIndex < 0 {
+			return nil // Base58の文字以外が含まれる場合
+		}
+		result.Mul(result, big.NewInt(int64(len(b58Alphabet))))
+		result.Add(result, big.NewInt(int64(charIndex)))
+	}
+
+	decoded := result.Bytes()
+	decoded = append(bytes.Repeat([]byte{0x00}, zeroBytes), decoded...)
+	return decoded
+}
@@ -2,20 +2,31 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/gob"
+	"fmt"
 	"log"
 	"time"
 )
 
-// データ本体
+// ブロックヘッダー
+// PoWの対象となる部分で、トランザクションはマークルルートとしてのみ含む
+// ヘッダーだけでブロックのつながりとPoWを検証できる
+type BlockHeader struct {
+	Timestamp     int64  // 作成日時
+	PrevBlockHash []byte // 一つ前のブロックのハッシュ値
+	MerkleRoot    []byte // トランザクションIDのマークルルート
+	Hash          []byte // 上記を結合した結果のハッシュ値
+	Nonce         int    // 採掘用のデータ
+	Bits          uint32 // 採掘難易度（ターゲットのcompact表現）
+	Height        int    // 初期ブロックを0とした高さ
+}
+
+// データ本体（ヘッダーとトランザクション）
 type Block struct {
-	Timestamp int64 // 作成日時
+	BlockHeader
 	// Data          []byte // 保存データ
-	Transactions  []*Transaction // 保存トランザクション
-	PrevBlockHash []byte         // 一つ前のブロックのハッシュ値
-	Hash          []byte         // 上記を結合した結果のハッシュ値
-	Nonce         int            // 採掘用のデータ
+	Transactions []*Transaction // 保存トランザクション
 }
 
 // ポインタレシーバを用いたハッシュ値の代入メソッド
@@ -36,30 +47,53 @@ type Block struct {
 // 新規ブロックを生成し、構造体Blockのポインタを返す
 // タイムスタンプを割り当て、ハッシュを算出
 //func NewBlock(data string, prevBlockHash []byte) *Block {
-func NewBlock(transactions []*Transaction, prevBlockHash []byte) *Block {
+// ctxが終了した場合は採掘を中断し、ブロックの代わりにエラーを返す
+// 一つ前のブロックprevがnilの場合は初期ブロックとなる
+func NewBlock(ctx context.Context, transactions []*Transaction,
+	prev *Block, bits uint32) (*Block, error) {
+	prevBlockHash := []byte{}
+	height := 0
+	if prev != nil {
+		prevBlockHash = prev.Hash
+		height = prev.Height + 1
+	}
 	// Block構造体を初期化し、そのポインタを代入
-	// 第1メンバー: 現在の時刻をTime型で取得し、Unixタイム型に変換
-	//// 第2メンバー: 文字列をバイト配列に変換
-	// 第2メンバー: transactionsをそのまま代入
-	// 第3メンバー: 引数によって渡された一つ前のブロックのハッシュを代入
-	// 第4メンバー: 最初は空の状態で生成
-	// 第5メンバー: 最初は0を代入
+	// ヘッダー: 現在の時刻をUnixタイム型に変換、一つ前のブロックのハッシュ、
+	// マークルルート（トランザクションの代入後に求める）、ハッシュ値とnonce（採掘後に代入）、
+	// 採掘難易度、一つ前のブロックの次の高さ
 	// block := &Block{time.Now().Unix(), []byte(data), prevBlockHash, []byte{}, 0}
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0}
+	block := &Block{BlockHeader{time.Now().Unix(), prevBlockHash, nil, []byte{}, 0, bits, height}, transactions}
+	block.MerkleRoot = block.HashTransactions()
 	// ハッシュ値の代入処理
 	//block.SetHash()
-	pow := NewProofOfWork(block) // PoWを用いて採掘した上でハッシュとnonceを格納
-	nonce, hash := pow.Run()
+	pow := NewProofOfWork(&block.BlockHeader) // PoWを用いて採掘した上でハッシュとnonceを格納
+	// 採掘状況は一定間隔で同じ行に上書き出力
+	fmt.Printf("ブロックの採掘 トランザクション数＝%d\n", len(transactions))
+	pow.OnProgress = func(p MiningProgress) {
+		fmt.Printf("\r%d hashes (%.0f hashes/s)", p.Hashes, p.HashRate())
+	}
+	nonce, hash, err := pow.RunContext(ctx)
+	if err != nil {
+		fmt.Print("\n\n")
+		return nil, err
+	}
+	fmt.Printf("\rnonce=%d:hash=%x\n\n", nonce, hash)
 	block.Hash = hash[:]
 	block.Nonce = nonce
-	return block
+	return block, nil
 }
 
 // 前のハッシュを持たない初期ブロックの生成
 // func NewGenesisBlock(coinbase *Transaction) *Block {
 func NewGenesisBlock(coinbase *Transaction) *Block {
 	// return NewBlock("初期ブロック", []byte{})
-	return NewBlock([]*Transaction{coinbase}, []byte{})
+	// 初期ブロックは易しいので中断できないようにする
+	block, err := NewBlock(context.Background(),
+		[]*Transaction{coinbase}, nil, initialBits)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
 }
 
 // ブロックのシリアライゼーション
@@ -88,17 +122,43 @@ func DeserializeBlock(d []byte) *Block {
 	return &block
 }
 
-// ブロックハッシュを算出するために
-// トランザクションデータ全てをハッシュ化
+// ヘッダーのシリアライゼーション
+func (h *BlockHeader) Serialize() []byte {
+	var result bytes.Buffer
+	err := gob.NewEncoder(&result).Encode(h)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+// ヘッダーのデシリアライゼーション
+func DeserializeHeader(d []byte) *BlockHeader {
+	var header BlockHeader
+	err := gob.NewDecoder(bytes.NewReader(d)).Decode(&header)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &header
+}
+
+// ヘッダーに含めるために
+// トランザクションIDを葉とするマークルツリーのルートを求める
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte //  トランザクションごとのハッシュを格納
-	var txHash [32]byte   //  結果
+	return b.merkleTree().RootNode.Data
+}
+
+// トランザクションIDを葉とするマークルツリー
+func (b *Block) merkleTree() *MerkleTree {
+	var txIDs [][]byte //  トランザクションごとのID
 	// Transactionsの要素全てについて繰り返す
 	for _, tx := range b.Transactions {
-		// ID＝ハッシュ値を追記
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
 	}
-	// 全結合したデータをハッシュ化
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
-	return txHash[:] // 固定長のバイト配列から可変バイト配列に変換
+	return NewMerkleTree(txIDs)
+}
+
+// トランザクションがこのブロックに含まれることのマークルプルーフ
+func (b *Block) MerkleProof(txid []byte) (MerkleProof, error) {
+	return b.merkleTree().Proof(txid)
 }
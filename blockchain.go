@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
 	"os"
+	"time"
 )
 
 const dbFile = "blockchain.db"
@@ -152,6 +157,63 @@ func dbExists() bool {
 	return true
 }
 
+// データベースを開く
+// startnodeなど他のプロセスが使用中の場合は待たずに終了する
+func openDB() *bolt.DB {
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		fmt.Println("ブロックチェーンは他のプロセス（startnodeなど）が使用中です。")
+		os.Exit(1)
+	} else if err != nil {
+		log.Panic(err)
+	}
+	return db
+}
+
+// ノード用にブロックチェーンを開く
+// データベースがない場合はブロックを持たない空のブロックチェーンを作成し、
+// 初期ブロックを含む全てのブロックを他のノードから受け取る
+func OpenBlockchain() *Blockchain {
+	var tip []byte
+	db := openDB()
+	hasUTXO := true
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		// Getの値はトランザクションの終了後に書き換わることがあるためコピーする
+		tip = append([]byte(nil), b.Get([]byte("l"))...)
+		if _, err := tx.CreateBucketIfNotExists([]byte(headersBucket)); err != nil {
+			return err
+		}
+		if err := createBlockIndex(tx); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(undoBucket)); err != nil {
+			return err
+		}
+		// 新しいデータベースの場合は指定されたパラメータを保存する
+		if err := initChainParams(tx); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(utxoBucket)) == nil {
+			hasUTXO = false
+			_, err = tx.CreateBucket([]byte(utxoBucket))
+		}
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	bc := Blockchain{tip, db}
+	// UTXOセットのない古いデータベースの場合は作成する
+	if !hasUTXO && len(tip) > 0 {
+		UTXOSet{&bc}.Reindex()
+	}
+	return &bc
+}
+
 // 初期ブロックに書き込まれるデータ
 const genesisCoinbaseData = "初期ブロックのデータ"
 
@@ -164,14 +226,15 @@ func CreateBlockchain(address string) *Blockchain {
 
 	var tip []byte // 最後のブロックのハッシュ
 	// BoltDBのオープン
-	db, err := bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Panic(err) // エラー時は強制終了
-	}
+	db := openDB()
 	// データベースを更新用に開く
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		// 指定されたパラメータを保存
+		if err := initChainParams(tx); err != nil {
+			log.Panic(err)
+		}
 		// コインベーストランザクションを生成
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+		cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 		// 初期ブロックの生成
 		genesis := NewGenesisBlock(cbtx)
 		// ブロック格納用バケットの生成
@@ -189,6 +252,33 @@ func CreateBlockchain(address string) *Blockchain {
 		if err != nil {
 			log.Panic(err)
 		}
+		// ヘッダーと索引用のバケットを生成し、初期ブロックのヘッダーを保存
+		_, err = tx.CreateBucket([]byte(headersBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		_, err = tx.CreateBucket([]byte(blockIndexBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		err = putHeader(tx, &genesis.BlockHeader)
+		if err != nil {
+			log.Panic(err)
+		}
+		// UTXOセット用バケットを生成し、初期ブロックを反映
+		_, err = tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		_, err = UTXOSet{&Blockchain{genesis.Hash, db}}.update(tx, genesis)
+		if err != nil {
+			log.Panic(err)
+		}
+		// 取り消しデータ用のバケットを生成（初期ブロックは切り離さないため記録しない）
+		_, err = tx.CreateBucket([]byte(undoBucket))
+		if err != nil {
+			log.Panic(err)
+		}
 		// グローバル変数tipに初期ブロックのハッシュを代入
 		tip = genesis.Hash
 		return nil
@@ -208,27 +298,41 @@ func NewBlockchain(address string) *Blockchain {
 		os.Exit(1)
 	}
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Panic(err)
-	}
-	err = db.Update(func(tx *bolt.Tx) error {
+	db := openDB()
+	hasUTXO := false
+	err := db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-		return nil
+		// Getの値はトランザクションの終了後に書き換わることがあるためコピーする
+		tip = append([]byte(nil), b.Get([]byte("l"))...)
+		hasUTXO = tx.Bucket([]byte(utxoBucket)) != nil
+		if _, err := tx.CreateBucketIfNotExists([]byte(undoBucket)); err != nil {
+			return err
+		}
+		if err := initChainParams(tx); err != nil {
+			return err
+		}
+		return createBlockIndex(tx)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+	if len(tip) == 0 {
+		fmt.Println("ブロックチェーンにブロックがありません。startnodeで他のノードから同期してください。")
+		os.Exit(1)
+	}
 	bc := Blockchain{tip, db}
+	// UTXOセットのない古いデータベースの場合は作成する
+	if !hasUTXO {
+		UTXOSet{&bc}.Reindex()
+	}
 	return &bc
 }
 
-// 未使用のトランザクションの探索
-//	"encoding/hex"をimportに含める
-func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
-	// 未使用のトランザクション
-	var unspentTXs []Transaction
+// 未使用のトランザクション出力を全て探索
+// UTXOセットの再構築に使う（キーはトランザクションIDの16進数文字列）
+func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+	// 未使用のトランザクション出力
+	UTXO := make(map[string]TXOutputs)
 	// 使用済みのトランザクション出力
 	spentTXOs := make(map[string][]int)
 	// 最後のブロックから逆順に探索するためのイテレータ
@@ -236,44 +340,41 @@ func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
 
 	for {
 		block := bci.Next() // 一つ前のブロック
-		for _, tx := range block.Transactions {
+		// 同じブロックの中で使用された出力も除けるよう、トランザクションも後ろから探索する
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			// それぞれのトランザクションのIDを取得
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs: // ループのラベル
 			for outIdx, out := range tx.Vout {
+				// 使用できないデータ出力は含めない
+				if out.IsUnspendable() {
+					continue
+				}
 				// 出力アウトプットは使用済みか？
 				if spentTXOs[txID] != nil {
-					// 既に対象トランザクションで使用済みの
-					// 出力がある場合
 					for _, spentOut := range spentTXOs[txID] {
-						// 対象トランザクションの出力を確認し、
-						// 一致するものがあるならば、次の出力に
-						// 処理を移す
 						if spentOut == outIdx {
 							continue Outputs
 						}
 					}
 				}
-				// 未使用の場合かつ指定アドレスでアンロック
-				// でいる場合
-				if out.CanBeUnlockedWith(address) {
-					// 未使用のトランザクションとして登録
-					unspentTXs = append(unspentTXs, *tx)
+				// 未使用の出力として登録
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+					UTXO[txID] = outs
 				}
+				outs.Outputs[outIdx] = out
 			}
 
 			// トランザクションがコインベースでない時
 			if tx.IsCoinbase() == false {
 				for _, in := range tx.Vin {
-					// それぞれの入力を確認
-					if in.CanUnlockOutputWith(address) {
-						// 指定したアドレスで出力をアンロック可能な場合
-						// 入力のトランザクションidを16進数で文字列化
-						inTxID := hex.EncodeToString(in.Txid)
-						// 入力にリンクした出力を使用済み出力として登録
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-					}
+					// 入力にリンクした出力を使用済み出力として登録
+					inTxID := hex.EncodeToString(in.Txid)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
 				}
 			}
 		}
@@ -282,90 +383,351 @@ func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
 			break
 		}
 	}
-	return unspentTXs
+	return UTXO
 }
 
-// 未使用のトランザクション出力を探す
-func (bc *Blockchain) FindUTXO(address string) []TXOutput {
-	var UTXOs []TXOutput
-	unspentTransactions := bc.FindUnspentTransactions(address)
-	for _, tx := range unspentTransactions {
-		// 未使用のトランザクションから
-		// アドレスで使用可能なトランザクション出力を
-		// UTXOs配列に追記
-		for _, out := range tx.Vout {
-			if out.CanBeUnlockedWith(address) {
-				UTXOs = append(UTXOs, out)
-			}
-		}
+// ブロックのマイニング
+// 保存したブロックは同じトランザクション内でUTXOセットにも反映する
+// ctxが終了した場合は採掘を中断し、MiningCancelledErrorを返す
+// 検証に失敗した場合はBlockValidationErrorを返す
+func (bc *Blockchain) MineBlock(ctx context.Context,
+	transactions []*Transaction) (*Block, error) {
+	var lastBlock *Block
+	// データベースから最終ブロックを取得
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		lastHash := b.Get([]byte("l"))
+		lastBlock = DeserializeBlock(b.Get(lastHash))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 不正なトランザクションはマイニングしない
+	ancestors, err := bc.ancestors(lastBlock.Hash, medianTimeSpan)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = bc.validateTransactions(transactions, lastBlock.Height+1, medianTime(ancestors))
+	if err != nil {
+		return nil, err
+	}
+
+	// 新規ブロックを作成
+	newBlock, err := NewBlock(ctx, transactions, lastBlock, bc.nextBits(lastBlock.Hash))
+	if err != nil {
+		return nil, err
+	}
+	_, err = bc.AddBlock(newBlock)
+	if err != nil {
+		return nil, err
 	}
-	return UTXOs
+	return newBlock, nil
 }
 
-// 支払可能なトランザクション出力の探索
-// 支払い対象となるトランザクション出力を返す
-func (bc *Blockchain) FindSpendableOutputs(
-	address string, amount int) (int, map[string][]int) {
-	// 未使用の出力
-	unspentOutputs := make(map[string][]int)
-	// アドレスから未使用のトランザクションを取得
-	unspentTXs := bc.FindUnspentTransactions(address)
-	// 累積値
-	accumulated := 0
-
-Work:
-	for _, tx := range unspentTXs {
-		// 未使用トランザクションごとの処理
-		// IDを16進数文字列化
-		txID := hex.EncodeToString(tx.ID)
-		// それぞれの出力についてくり返す
-		for outIdx, out := range tx.Vout {
-			if out.CanBeUnlockedWith(address) && accumulated < amount {
-				// 出力が指定アドレスでアンロック可能
-				// かつ、累積値が指定数量未満の時だけ追加
-				accumulated += out.Value
-				// 未使用トランザクション出力をunspentOutputsに追加
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				// 指定数量よりも累積値が多くなったら終了
-				if accumulated >= amount {
-					break Work
+// ブロックを検証して保存し、累積の仕事量が最も多いチェーンを有効なチェーンとする
+// 最終ブロックに続くブロックは全体を検証して接続する
+// それ以外のブロックはヘッダーのみを検証して分岐したチェーンのブロックとして保存し、
+// 分岐したチェーンの仕事量が上回った場合は再編成してその内容を返す
+// ブロックチェーンが空の場合は初期ブロックのみ受け付ける
+// 検証に失敗した場合はBlockValidationErrorを返す
+func (bc *Blockchain) AddBlock(newBlock *Block) (*ReorgEvent, error) {
+	if bc.HasBlock(newBlock.Hash) {
+		return nil, nil
+	}
+	if len(bc.tip) == 0 {
+		if err := bc.validateGenesisBlock(newBlock); err != nil {
+			return nil, err
+		}
+		return nil, bc.storeBlock(newBlock, true)
+	}
+	// 前のブロックの本体を持っていること（保存したブロックは必ず初期ブロックまで遡れる）
+	if !bc.HasBlock(newBlock.PrevBlockHash) {
+		return nil, invalidBlock(ErrUnknownParent, "前のブロック %x", newBlock.PrevBlockHash)
+	}
+	if bc.isInvalid(newBlock.PrevBlockHash) {
+		return nil, invalidBlock(ErrInvalidParent, "前のブロック %x", newBlock.PrevBlockHash)
+	}
+
+	if bytes.Equal(newBlock.PrevBlockHash, bc.tip) {
+		// 保存する前にブロック全体を検証
+		if err := bc.ValidateBlock(newBlock); err != nil {
+			// 本体が書き換えられただけの場合は、正しい本体を受け取れるよう不正とはしない
+			if !errors.Is(err, ErrBadMerkleRoot) {
+				if err := bc.markInvalid(newBlock.Hash); err != nil {
+					log.Panic(err)
 				}
 			}
+			return nil, err
 		}
+		return nil, bc.storeBlock(newBlock, true)
 	}
-	return accumulated, unspentOutputs
+
+	// 分岐したチェーンのブロック
+	// トランザクションは接続する時点のUTXOセットでしか検証できないため、再編成の際に検証する
+	if _, err := bc.validateHeader(&newBlock.BlockHeader); err != nil {
+		return nil, err
+	}
+	if err := checkMerkleRoot(newBlock); err != nil {
+		return nil, err
+	}
+	if err := bc.storeBlock(newBlock, false); err != nil {
+		return nil, err
+	}
+	if bc.ChainWork(newBlock.Hash).Cmp(bc.ChainWork(bc.tip)) <= 0 {
+		return nil, nil
+	}
+	return bc.reorganize(newBlock.Hash)
 }
 
-// ブロックのマイニング
-func (bc *Blockchain) MineBlock(transactions []*Transaction) {
-	var lastHash []byte
-	// データベースからトランザクションデータと
-	// 最終ブロックのハッシュを取得
-	err := bc.db.View(func(tx *bolt.Tx) error {
+// ブロックの本体とヘッダーを保存する
+// connectの場合は最終ブロックとして接続する
+func (bc *Blockchain) storeBlock(block *Block, connect bool) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		if err := b.Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		// ヘッダーを先に受信していない場合はここで保存
+		if err := putHeader(tx, &block.BlockHeader); err != nil {
+			return err
+		}
+		if !connect {
+			return nil
+		}
+		return bc.connectBlock(tx, block)
+	})
+}
+
+// 保存済みのブロックを最終ブロックとし、UTXOセットに反映する
+func (bc *Blockchain) connectBlock(tx *bolt.Tx, block *Block) error {
+	// 最終ブロックのハッシュを記録
+	err := tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.Hash)
+	if err != nil {
+		return err
+	}
+	// UTXOセットの更新と取り消しデータの保存
+	undo, err := UTXOSet{bc}.update(tx, block)
+	if err != nil {
+		return err
+	}
+	err = putBlockUndo(tx, block.Hash, undo)
+	if err != nil {
+		return err
+	}
+	// 最終ハッシュをbc上で参照できるように代入
+	bc.tip = block.Hash
+	return nil
+}
+
+// ハッシュ値のブロックを持っているか
+func (bc *Blockchain) HasBlock(hash []byte) bool {
+	found := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		found = len(hash) > 0 && tx.Bucket([]byte(blocksBucket)).Get(hash) != nil
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+	return found
+}
 
-	// 新規ブロックを作成
-	newBlock := NewBlock(transactions, lastHash)
-	// シリアライズ化を行い、データベースに保存
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
+// ハッシュ値からブロックを取得
+func (bc *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket([]byte(blocksBucket)).Get(hash)
+		if encoded == nil || len(hash) == 0 {
+			return errors.New("ブロックが見つかりません")
+		}
+		block = DeserializeBlock(encoded)
+		return nil
+	})
+	return block, err
+}
+
+// 全てのブロックのハッシュ値（最終ブロックから初期ブロックの順）
+func (bc *Blockchain) GetBlockHashes() [][]byte {
+	return bc.headerHashes(bc.tip)
+}
+
+// IDからトランザクションを探索
+func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return *tx, nil
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return Transaction{}, errors.New("トランザクションが見つかりません")
+}
+
+// 指定したトランザクションを含むブロックを探索
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, nil
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return nil, errors.New("トランザクションが見つかりません")
+}
+
+// 指定したマークルルートを持つブロックを探索
+func (bc *Blockchain) FindBlockByMerkleRoot(root []byte) (*Block, error) {
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		if bytes.Equal(block.MerkleRoot, root) {
+			return block, nil
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return nil, errors.New("マークルルートが一致するブロックが見つかりません")
+}
+
+// 入力が参照するトランザクションを集める
+// チェーンにないトランザクションを参照している場合はエラーを返す
+func (bc *Blockchain) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+	for inID, vin := range tx.Vin {
+		prevTX, err := bc.FindTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, fmt.Errorf("入力%d: %w", inID, err)
 		}
-		// 最終ブロックのハッシュを記録
-		err = b.Put([]byte("l"), newBlock.Hash)
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+	return prevTXs, nil
+}
+
+// トランザクションの入力に署名
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Sign(privKey, prevTXs)
+}
+
+// トランザクションの入力の署名を検証
+// 参照先のトランザクションが見つからない場合はfalseを返す
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return false
+	}
+	return tx.Verify(prevTXs)
+}
+
+// 最終ブロックの高さ（ブロックがない場合は-1）
+func (bc *Blockchain) GetBestHeight() int {
+	if len(bc.tip) == 0 {
+		return -1
+	}
+	header, err := bc.GetHeader(bc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	return header.Height
+}
+
+// トランザクションの手数料（入力の合計 - 出力の合計）
+// 出力の合計が入力の合計を超える場合はエラー
+func (bc *Blockchain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	inputValue := 0
+	for _, vin := range tx.Vin {
+		prevTx, err := bc.FindTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return 0, err
 		}
-		// 最終ハッシュをbc上で参照できるように代入
-		bc.tip = newBlock.Hash
-		return nil
-	})
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return 0, ErrMissingInput
+		}
+		inputValue += prevTx.Vout[vin.Vout].Value
+	}
+	outputValue := 0
+	for _, out := range tx.Vout {
+		outputValue += out.Value
+	}
+	if outputValue > inputValue {
+		return 0, fmt.Errorf("%w: 入力 %d < 出力 %d", ErrInsufficientInput, inputValue, outputValue)
+	}
+	return inputValue - outputValue, nil
+}
+
+// ブロックチェーン上のP2PKHの出力で使われた全ての公開鍵ハッシュ
+// キーは公開鍵ハッシュの16進数文字列
+func (bc *Blockchain) UsedPubKeyHashes() map[string]bool {
+	used := make(map[string]bool)
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				if pubKeyHash := ExtractPubKeyHash(out.ScriptPubKey); pubKeyHash != nil {
+					used[hex.EncodeToString(pubKeyHash)] = true
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return used
+}
+
+// トランザクションIDとそれを含むブロックの高さの対応
+// 初期ブロックの高さを0とする
+func (bc *Blockchain) txHeights() map[string]int {
+	heights := make(map[string]int)
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			heights[hex.EncodeToString(tx.ID)] = block.Height
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return heights
+}
+
+// 指定したブロックの次のブロックの採掘難易度
+// retargetInterval個ごとに、直前の区間の生成時間から再調整する
+// ヘッダーのみを受信したブロックについても求められる
+func (bc *Blockchain) nextBits(lastHash []byte) uint32 {
+	// 区間の最初のブロックまで遡る
+	headers, err := bc.ancestors(lastHash, retargetInterval)
+	if err != nil {
+		log.Panic(err)
+	}
+	last := headers[0]
+	if (last.Height+1)%retargetInterval != 0 {
+		return last.Bits // 調整する高さでなければそのまま
+	}
+	first := headers[len(headers)-1]
+	return CalculateNextBits(last.Bits, last.Timestamp-first.Timestamp)
 }
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
 )
 
+// ウォレットのパスフレーズを渡す環境変数
+const walletPassphraseEnv = "WALLET_PASSPHRASE"
+
+// パイプからの入力を複数回読めるよう共有する
+var stdinReader = bufio.NewReader(os.Stdin)
+
 // CLI responsible for processing command line arguments
 type CLI struct {
 	bc *Blockchain
@@ -18,11 +35,78 @@ func (cli *CLI) printUsage() {
 	fmt.Println("使用方法:")
 	fmt.Println("  getbalance -address ADDRESS" +
 		"- アドレスの残高を表示する")
-	fmt.Println("  createblockchain -address ADDRESS " +
+	fmt.Println("  createwallet [-hd [-words 12|24]] " +
+		"- 新しい鍵ペア（-hdの場合はHDウォレット）を生成しウォレットに保存する")
+	fmt.Println("  restorewallet -mnemonic \"単語 ...\" " +
+		"- ニーモニックからHDウォレットを復元する")
+	fmt.Println("  getnewaddress - HDウォレットから新しい受け取りアドレスを導出する")
+	fmt.Println("  listaddresses - ウォレットの全てのアドレスを表示する")
+	fmt.Println("  dumpprivkey -address ADDRESS - アドレスの秘密鍵を表示する")
+	fmt.Println("  importprivkey -key KEY - 秘密鍵をウォレットに取り込む")
+	fmt.Println("  encryptwallet - ウォレットの秘密鍵をパスフレーズで暗号化する")
+	fmt.Println("  walletpassphrase -timeout 秒数 " +
+		"- 指定秒数の間ウォレットのロックを解除する")
+	fmt.Println("  walletlock - ウォレットをロックする")
+	fmt.Println("  createblockchain -address ADDRESS [-threads N] [-halving N] [-maturity N] " +
 		"- ブロックチェーンを生成し初期ブロック報酬をアドレスに送信する")
+	fmt.Printf("    -halving: 採掘報酬が半減するまでのブロック数（省略時は%d）\n",
+		defaultChainParams.SubsidyHalvingInterval)
+	fmt.Printf("    -maturity: コインベースの出力が使用可能になるまでのブロック数（省略時は%d）\n",
+		defaultChainParams.CoinbaseMaturity)
+	fmt.Println("  generate -address ADDRESS [-blocks N] [-threads N] " +
+		"- メモリプールのトランザクションを含むブロックをN個採掘し、報酬と手数料をアドレスに送信する")
 	fmt.Println("  printchain - ブロックチェーンの全てのブロックを出力する")
+	fmt.Println("  gettxproof -txid TXID " +
+		"- トランザクションがブロックに含まれることのマークルプルーフを表示する")
+	fmt.Println("  verifytxproof -txid TXID -root マークルルート -proof プルーフ " +
+		"- マークルプルーフを検証する")
+	fmt.Println("  reindexutxo - UTXOセットをブロックチェーンから作り直す")
+	fmt.Println("  verifychainstate - UTXOセットをブロックチェーンと照合する")
+	fmt.Println("  gettxoutsetinfo - UTXOセットの統計情報を表示する")
+	fmt.Println("  getsupply - 流通量と最大供給量を表示する")
+	fmt.Println("  decodescript -hex スクリプト - 16進数のスクリプトを解析して表示する")
+	fmt.Println("  getpubkey -address ADDRESS - アドレスの公開鍵を表示する")
+	fmt.Println("  createmultisig -n M -keys 公開鍵またはアドレス,... " +
+		"- M-of-NマルチシグのP2SHアドレスを作成しウォレットに追加する")
+	fmt.Println("  createtx -from 送信元アドレス -to 送信先アドレス -amount 送金額 [-fee 手数料] [-locktime L] " +
+		"- 署名前のトランザクションを作成する")
+	fmt.Println("  signtx -hex トランザクション " +
+		"- ウォレットの鍵でトランザクションに署名する（他の署名者の署名は保持する）")
+	fmt.Println("  createpsbt -from 送信元アドレス -to 送信先アドレス -amount 送金額 [-fee 手数料] [-locktime L] " +
+		"- 鍵を使わずに署名前のPSBTを作成する")
+	fmt.Println("  signpsbt -psbt PSBT " +
+		"- ウォレットの鍵でPSBTに署名する（ブロックチェーンは不要）")
+	fmt.Println("  combinepsbt -psbts PSBT,... - 複数の署名者のPSBTを結合する")
+	fmt.Println("  finalizepsbt -psbt PSBT - PSBTの署名を確定しトランザクションを出力する")
+	fmt.Println("  broadcasttx -hex トランザクションまたはPSBT [-miner ADDRESS] [-threads N] " +
+		"- 署名済みのトランザクションをメモリプールに追加する（-minerの場合はメモリプールからブロックを採掘する）")
+	fmt.Println("  broadcasttx -hex トランザクションまたはPSBT -node HOST:PORT " +
+		"- 署名済みのトランザクションをノードに送信する")
+	fmt.Println("  startnode -port PORT [-seed HOST:PORT,...] [-miner ADDRESS] [-threads N] [-halving N] [-maturity N] [-datadir DIR] " +
+		"- P2Pノードを起動し、seedのノードからブロックチェーンを同期する（-minerの場合は受け取ったトランザクションを採掘する）")
+	fmt.Println("    -halving, -maturity: ブロックチェーンがない場合のみ使う（同期するノードと同じ値を指定する）")
+	fmt.Println("    -datadir: ブロックチェーンを置くディレクトリ（同じマシンで複数のノードを起動する場合にノードごとに指定する）")
+	fmt.Println("  getsyncstatus [-node HOST:PORT] " +
+		"- ブロックチェーンの同期状況を表示する（-nodeの場合は起動中のノードに問い合わせる）")
+	fmt.Println("  getmempoolinfo [-node HOST:PORT] " +
+		"- メモリプールのトランザクション数、サイズ、手数料の合計を表示する")
+	fmt.Println("  getrawmempool [-node HOST:PORT] [-verbose] " +
+		"- メモリプールのトランザクションIDを受け付けた順に表示する")
+	fmt.Println("  invalidateblock -hash ブロックのハッシュ値 " +
+		"- ブロックとそれに続くブロックを不正として記録し、有効なチェーンから切り離す")
+	fmt.Println("  reconsiderblock -hash ブロックのハッシュ値 " +
+		"- invalidateblockの記録を取り消し、最も仕事量の多いチェーンに戻す")
+	fmt.Println("  anchor -from ADDRESS -file ファイル [-fee 手数料] " +
+		"- ファイルのハッシュ値を埋め込んだトランザクションをメモリプールに追加する（採掘されると記録される）")
+	fmt.Println("  verifyanchor -file ファイル " +
+		"- ファイルのハッシュ値を記録したトランザクションと記録時刻を表示する")
 	fmt.Println("  send -from 送信元アドレス " +
-		"-to 送信先アドレス -amount 送金額 - fromからtoへコインを送金する")
+		"-to 送信先アドレス -amount 送金額 [-fee 手数料] [-locktime L] [-node HOST:PORT] " +
+		"- fromからtoへ送金するトランザクションをメモリプールに追加する（-nodeの場合はノードに送信する）")
+	fmt.Println("    -node: 起動中のノードのアドレス（省略時はこのブロックチェーンのメモリプール）")
+	fmt.Println("    -threads: 使用しない（送金時には採掘しなくなったため。採掘はgenerateの-threadsで指定する）")
+	fmt.Printf("    -locktime: この高さ（%d以上の場合はUnixタイム）より後のブロックにのみ含められる\n",
+		lockTimeThreshold)
 }
 
 // パラメータの検証
@@ -33,6 +117,60 @@ func (cli *CLI) validateArgs() {
 	}
 }
 
+// パスフレーズを環境変数から読み込む、なければ入力を求める
+func readPassphrase(prompt string) string {
+	if passphrase := os.Getenv(walletPassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	// 端末から入力する場合は入力内容を表示しない
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Panic(err)
+		}
+		return string(passphrase)
+	}
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Panic(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// フラグで指定したパラメータを新しく作成するブロックチェーンのパラメータとする
+func setChainParams(halving, maturity int) {
+	params := ChainParams{halving, maturity}
+	if err := params.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	chainParams = params
+}
+
+// ウォレットファイルを読み込み、ロック中であればパスフレーズで解除する
+func (cli *CLI) openWallets() *Wallets {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.unlockWallets(wallets)
+	return wallets
+}
+
+// ロック中であればパスフレーズを求めてロックを解除する
+func (cli *CLI) unlockWallets(wallets *Wallets) {
+	if !wallets.IsLocked() {
+		return
+	}
+	err := wallets.Unlock(readPassphrase("パスフレーズ: "))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
 // ブロックの追加コマンドの処理
 // func (cli *CLI) addBlock(data string) {
 // 	cli.bc.AddBlock(data)
@@ -47,9 +185,11 @@ func (cli *CLI) printChain() {
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
+		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := NewProofOfWork(block)
+		fmt.Printf("Bits: %08x\n", block.Bits)
+		pow := NewProofOfWork(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		fmt.Println()
 		if len(block.PrevBlockHash) == 0 {
@@ -58,39 +198,935 @@ func (cli *CLI) printChain() {
 	}
 }
 
-// ブロックチェーンを生成する
-func (cli *CLI) createBlockchain(address string) {
-	bc := CreateBlockchain(address)
-	bc.db.Close()
-	fmt.Println("Done!")
+// ウォレットを生成・保存し、アドレスを表示する
+func (cli *CLI) createWallet(hd bool, words int) {
+	wallets := cli.openWallets()
+	if !hd {
+		address := wallets.CreateWallet()
+		wallets.SaveToFile()
+		fmt.Printf("新しいアドレス: %s\n", address)
+		return
+	}
+
+	// ニーモニックからシードを生成し、最初の受け取りアドレスを導出
+	mnemonic, err := NewMnemonic(words)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	seed, err := SeedFromMnemonic(mnemonic)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = wallets.SetHDSeed(seed)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	address, err := wallets.NewHDAddress(hdExternalChain)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile()
+	fmt.Println("ニーモニック（全てのアドレスの復元に必要です。安全に保管してください）:")
+	fmt.Printf("  %s\n", mnemonic)
+	fmt.Printf("新しいアドレス: %s\n", address)
+}
+
+// ニーモニックからHDウォレットを復元する
+// ブロックチェーンがある場合は使用済みのアドレスを探索して全て復元する
+func (cli *CLI) restoreWallet(mnemonic string) {
+	seed, err := SeedFromMnemonic(mnemonic)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets := cli.openWallets()
+	err = wallets.SetHDSeed(seed)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if dbExists() {
+		bc := NewBlockchain("")
+		used := bc.UsedPubKeyHashes()
+		bc.db.Close()
+		restored, err := wallets.RestoreHD(func(pubKeyHash []byte) bool {
+			return used[hex.EncodeToString(pubKeyHash)]
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("使用済みのアドレスを%d件復元しました\n", restored)
+	}
+	// 受け取り用のアドレスが一つもなければ最初のものを導出
+	if wallets.hdNext[hdExternalChain] == 0 {
+		if _, err := wallets.NewHDAddress(hdExternalChain); err != nil {
+			log.Panic(err)
+		}
+	}
+	wallets.SaveToFile()
+	fmt.Println("HDウォレットを復元しました")
+}
+
+// HDウォレットから新しい受け取りアドレスを導出する
+func (cli *CLI) getNewAddress() {
+	wallets := cli.openWallets()
+	address, err := wallets.NewHDAddress(hdExternalChain)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Println(address)
+}
+
+// ウォレットの全てのアドレスを表示する
+func (cli *CLI) listAddresses() {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, address := range wallets.GetAddresses() {
+		fmt.Println(address)
+	}
+}
+
+// アドレスの秘密鍵を16進数で表示する
+func (cli *CLI) dumpPrivKey(address string) {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.HasAddress(address) {
+		cli.unlockWallets(wallets)
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", wallet.PrivateKeyBytes())
+}
+
+// 16進数の秘密鍵をウォレットに取り込む
+func (cli *CLI) importPrivKey(privKey string) {
+	key, err := hex.DecodeString(privKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, err := NewWalletFromPrivateKey(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets := cli.openWallets()
+	address := wallets.AddWallet(wallet)
+	wallets.SaveToFile()
+	fmt.Printf("取り込んだアドレス: %s\n", address)
+}
+
+// ウォレットの秘密鍵をパスフレーズで暗号化する
+func (cli *CLI) encryptWallet() {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.IsEncrypted() {
+		fmt.Println("ウォレットはすでに暗号化されています")
+		os.Exit(1)
+	}
+	passphrase := readPassphrase("新しいパスフレーズ: ")
+	if os.Getenv(walletPassphraseEnv) == "" &&
+		readPassphrase("もう一度入力してください: ") != passphrase {
+		fmt.Println("パスフレーズが一致しません")
+		os.Exit(1)
+	}
+	if passphrase == "" {
+		fmt.Println("パスフレーズが空です")
+		os.Exit(1)
+	}
+	err = wallets.Encrypt(passphrase)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile()
+	fmt.Println("ウォレットを暗号化しました")
+}
+
+// 指定秒数の間ウォレットのロックを解除する
+func (cli *CLI) walletPassphrase(timeout int) {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if !wallets.IsEncrypted() {
+		fmt.Println("ウォレットは暗号化されていません")
+		os.Exit(1)
+	}
+	// 解除済みであってもパスフレーズを確認する
+	wallets.Lock()
+	cli.unlockWallets(wallets)
+	wallets.SaveUnlock(timeout)
+	fmt.Printf("%d秒間ロックを解除しました\n", timeout)
+}
+
+// walletpassphraseから起動され、標準入力で受け取った復号鍵をtimeout秒間保持する
+// 準備ができたら"ok"を出力し、失敗した場合はエラーを出力する
+func (cli *CLI) walletAgent(timeout int) {
+	line, err := stdinReader.ReadString('\n')
+	if err != nil {
+		log.Panic(err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(line))
+	if err == nil && len(key) != walletKeyLen {
+		err = errors.New("復号鍵の長さが正しくありません")
+	}
+	if err == nil {
+		err = runWalletAgent(key, time.Duration(timeout)*time.Second, func() {
+			fmt.Println("ok")
+			// 起動元が終了した後は出力しない
+			os.Stdout.Close()
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// ウォレットをロックする
+func (cli *CLI) walletLock() {
+	RemoveUnlock()
+	fmt.Println("ウォレットをロックしました")
+}
+
+// トランザクションのマークルプルーフを表示する
+func (cli *CLI) getTxProof(txid string) {
+	ID, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	block, err := bc.FindTransactionBlock(ID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	proof, err := block.MerkleProof(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("ブロック: %x\n", block.Hash)
+	fmt.Printf("マークルルート: %x\n", block.MerkleRoot)
+	fmt.Printf("プルーフ: %x\n", proof.Serialize())
+}
+
+// マークルプルーフを検証する
+func (cli *CLI) verifyTxProof(txid, root, proofHex string) {
+	ID, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic(err)
+	}
+	merkleRoot, err := hex.DecodeString(root)
+	if err != nil {
+		log.Panic(err)
+	}
+	proofBytes, err := hex.DecodeString(proofHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	proof, err := DeserializeMerkleProof(proofBytes)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !VerifyMerkleProof(merkleRoot, ID, proof) {
+		fmt.Println("プルーフは正しくありません")
+		os.Exit(1)
+	}
+	fmt.Println("プルーフは正しいです")
+	// ブロックチェーンがあれば、そのマークルルートを持つブロックも表示
+	if dbExists() {
+		bc := NewBlockchain("")
+		defer bc.db.Close()
+		block, err := bc.FindBlockByMerkleRoot(merkleRoot)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("ブロック: %x\n", block.Hash)
+	}
+}
+
+// UTXOセットを作り直す
+func (cli *CLI) reindexUTXO() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+	count := UTXOSet.CountTransactions()
+	fmt.Printf("完了しました！UTXOセットには%d件のトランザクションがあります。\n", count)
+}
+
+// UTXOセットとブロックチェーンから求めた未使用出力を照合する
+func (cli *CLI) verifyChainstate() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	mismatches := UTXOSet{bc}.Verify()
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("%d件の不一致があります。reindexutxoで作り直してください。\n",
+			len(mismatches))
+		os.Exit(1)
+	}
+	fmt.Println("UTXOセットはブロックチェーンと一致しています")
+}
+
+// UTXOセットの統計情報を表示する
+func (cli *CLI) getTxOutSetInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	info := UTXOSet{bc}.Info()
+	fmt.Printf("最終ブロック: %x\n", bc.tip)
+	fmt.Printf("トランザクション数: %d\n", info.Transactions)
+	fmt.Printf("未使用出力数: %d\n", info.Outputs)
+	fmt.Printf("総供給量: %d\n", info.TotalAmount)
+	fmt.Printf("ハッシュ値: %x\n", info.Hash)
+}
+
+// 流通量と最大供給量を表示する
+func (cli *CLI) getSupply() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	height := bc.GetBestHeight()
+	info := UTXOSet{bc}.Info()
+	fmt.Printf("ブロック高: %d\n", height)
+	fmt.Printf("次のブロックの報酬: %d\n", GetBlockSubsidy(height+1))
+	fmt.Printf("流通量: %d\n", info.TotalAmount)
+	fmt.Printf("最大供給量: %d\n", MaxSupply())
+	fmt.Printf("報酬の半減間隔: %dブロック\n", chainParams.SubsidyHalvingInterval)
+	fmt.Printf("コインベースの成熟: %dブロック\n", chainParams.CoinbaseMaturity)
+}
+
+// スクリプトを逆アセンブルし、種類とアドレスを表示する
+func (cli *CLI) decodeScript(scriptHex string) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		fmt.Println("スクリプトは16進数で指定してください")
+		os.Exit(1)
+	}
+	class := ClassifyScript(script)
+	fmt.Printf("asm: %s\n", DisassembleScript(script))
+	fmt.Printf("type: %s\n", class)
+	if m, _, ok := ExtractMultisig(script); ok {
+		fmt.Printf("reqSigs: %d\n", m)
+	}
+	for _, address := range ScriptAddresses(script) {
+		fmt.Printf("address: %s\n", address)
+	}
+	// redeemスクリプトとして使う場合のP2SHアドレス
+	if class != ScriptScriptHash {
+		fmt.Printf("p2sh: %s\n", ScriptHashAddress(script))
+	}
+}
+
+// アドレスの公開鍵を表示する
+func (cli *CLI) getPubKey(address string) {
+	wallets := cli.openWallets()
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", wallet.PublicKey)
+}
+
+// M-of-NマルチシグのP2SHアドレスを作成し、redeemスクリプトをウォレットに追加する
+func (cli *CLI) createMultisig(m int, keys []string) {
+	wallets := cli.openWallets()
+	redeemScript, err := wallets.NewMultisigScript(m, keys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	address := wallets.AddScript(redeemScript)
+	wallets.SaveToFile()
+	fmt.Printf("アドレス: %s\n", address)
+	fmt.Printf("redeemスクリプト: %x\n", redeemScript)
+}
+
+// 署名前のトランザクションを作成し、16進数で表示する
+// おつりは送信元のアドレスに戻す
+func (cli *CLI) createTx(from, to string, amount, fee int, lockTime uint32) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: 送信元アドレスが正しくありません")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: 送信先アドレスが正しくありません")
+	}
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+	// メモリプールにある未承認のおつりも使う
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, from, lockTime, LoadMempool(bc))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// 16進数のトランザクションを読み込む
+func decodeTransaction(txHex string) *Transaction {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		fmt.Println("トランザクションは16進数で指定してください")
+		os.Exit(1)
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		fmt.Println("トランザクションの形式が正しくありません")
+		os.Exit(1)
+	}
+	return &tx
+}
+
+// ウォレットの鍵でトランザクションに署名し、16進数で表示する
+func (cli *CLI) signTx(txHex string) {
+	tx := decodeTransaction(txHex)
+	wallets := cli.openWallets()
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	// 参照先がメモリプールにある場合はそのトランザクションを使う
+	prevTXs, err := LoadMempool(bc).prevTransactions(tx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	complete, err := wallets.SignTransaction(tx, prevTXs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", tx.Serialize())
+	fmt.Printf("署名完了: %t\n", complete)
+}
+
+// 16進数のPSBTを読み込む
+func decodePSBT(psbtHex string) *PSBT {
+	data, err := hex.DecodeString(psbtHex)
+	if err != nil {
+		fmt.Println("PSBTは16進数で指定してください")
+		os.Exit(1)
+	}
+	p, err := DeserializePSBT(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return p
+}
+
+// 署名前のPSBTを作成し、16進数で表示する
+// 秘密鍵は使わないため、鍵を持たないマシンで作成できる
+// ウォレットファイルがあればredeemスクリプトと導出パスを添える
+func (cli *CLI) createPSBT(from, to string, amount, fee int, lockTime uint32) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: 送信元アドレスが正しくありません")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: 送信先アドレスが正しくありません")
+	}
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+	// メモリプールにある未承認のおつりも使う
+	pool := LoadMempool(bc)
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, from, lockTime, pool)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	prevTXs, err := pool.prevTransactions(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	p, err := NewPSBT(tx, prevTXs)
+	if err != nil {
+		log.Panic(err)
+	}
+	// 導出パスとredeemスクリプトは暗号化されていないのでロック中でも読める
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.AddPSBTDerivations(p)
+	fmt.Printf("%x\n", p.Serialize())
+}
+
+// ウォレットの鍵でPSBTに署名し、16進数で表示する
+func (cli *CLI) signPSBT(psbtHex string) {
+	p := decodePSBT(psbtHex)
+	wallets := cli.openWallets()
+	signed, err := wallets.SignPSBT(p)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", p.Serialize())
+	fmt.Printf("追加した署名: %d\n", signed)
+	fmt.Printf("手数料: %d\n", p.Fee())
+	fmt.Printf("署名完了: %t\n", p.IsComplete())
+}
+
+// 同じトランザクションの複数のPSBTを結合し、16進数で表示する
+func (cli *CLI) combinePSBT(psbtHexes []string) {
+	p := decodePSBT(psbtHexes[0])
+	for _, psbtHex := range psbtHexes[1:] {
+		if err := p.Combine(decodePSBT(psbtHex)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("%x\n", p.Serialize())
+	fmt.Printf("署名完了: %t\n", p.IsComplete())
+}
+
+// PSBTの署名を確定し、ブロードキャストできるトランザクションを16進数で表示する
+func (cli *CLI) finalizePSBT(psbtHex string) {
+	tx, err := decodePSBT(psbtHex).Finalize()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// 署名済みのトランザクションをメモリプールに追加する
+// 署名の揃ったPSBTを指定した場合は確定してから追加する
+// minerを指定した場合はメモリプールのトランザクションを含むブロックを採掘し、採掘報酬と手数料はminerが受け取る
+// nodeを指定した場合はノードに送信する
+func (cli *CLI) broadcastTx(txHex, miner, node string) {
+	if miner != "" && !ValidateAddress(miner) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	var tx *Transaction
+	if data, err := hex.DecodeString(txHex); err == nil && IsPSBT(data) {
+		tx, err = decodePSBT(txHex).Finalize()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		tx = decodeTransaction(txHex)
+	}
+	if node != "" {
+		if err := SendTransaction(node, tx); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("トランザクションID: %x\n", tx.ID)
+		fmt.Printf("%s に送信しました\n", node)
+		return
+	}
+	bc := NewBlockchain(miner)
+	defer bc.db.Close()
+	pool := LoadMempool(bc)
+	if err := pool.Add(tx); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	pool.Save()
+	fmt.Printf("トランザクションID: %x\n", tx.ID)
+	fmt.Println("メモリプールに追加しました")
+	if miner != "" {
+		cli.mineBlocks(bc, pool, miner, 1)
+	}
+}
+
+// P2Pノードを起動する
+// ブロックチェーンがない場合はseedsのノードから初期ブロックを含めて同期する
+// dataDirを指定した場合は、そのディレクトリのブロックチェーンを使う
+// Ctrl-Cが押されるまで動作する
+func (cli *CLI) startNode(port int, seeds []string, miner, dataDir string) {
+	if miner != "" && !ValidateAddress(miner) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	if dataDir != "" {
+		changeDataDir(dataDir)
+	}
+	bc := OpenBlockchain()
+	defer bc.db.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	server := NewServer(fmt.Sprintf("localhost:%d", port), miner, bc)
+	if err := server.Run(ctx, seeds); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("ノードを停止しました")
+}
+
+// データディレクトリに移動する（ない場合は作成する）
+// データベースはカレントディレクトリに置かれるため、移動した後に開く
+func changeDataDir(dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// ブロックチェーンの同期状況を表示する
+// nodeを指定した場合は起動中のノードに問い合わせ、それ以外はデータベースから読み込む
+func (cli *CLI) getSyncStatus(node string) {
+	var status *syncStatusPayload
+	if node != "" {
+		var err error
+		status, err = QuerySyncStatus(node)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		if !dbExists() {
+			fmt.Println("ブロックチェーンがありません。")
+			os.Exit(1)
+		}
+		bc := OpenBlockchain()
+		status = &syncStatusPayload{BlockHeight: bc.GetBestHeight(), HeaderHeight: -1}
+		if best := bc.BestHeader(); best != nil {
+			status.HeaderHeight = best.Height
+		}
+		bc.db.Close()
+	}
+
+	fmt.Printf("ブロックの高さ: %d\n", status.BlockHeight)
+	fmt.Printf("ヘッダーの高さ: %d\n", status.HeaderHeight)
+	if status.HeaderHeight >= 0 {
+		fmt.Printf("進捗: %.1f%%\n", float64(status.BlockHeight+1)*100/float64(status.HeaderHeight+1))
+	}
+	if status.BlockHeight < status.HeaderHeight {
+		fmt.Println("状態: 同期中")
+	} else {
+		fmt.Println("状態: 同期済み")
+	}
+	if node == "" {
+		return
+	}
+	fmt.Printf("要求中のブロック: %d\n", status.InFlight)
+	fmt.Printf("追加待ちのブロック: %d\n", status.Pending)
+	fmt.Printf("接続中のノード: %d\n", len(status.Peers))
+	for _, p := range status.Peers {
+		fmt.Printf("  %s 高さ %d 要求中 %d\n", p.Addr, p.BestHeight, p.InFlight)
+	}
+}
+
+// ブロックを不正として記録し、最終ブロックを切り離す
+// 切り離したブロックのトランザクションはメモリプールに戻す
+func (cli *CLI) invalidateBlock(hashHex string) {
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	event, err := bc.InvalidateBlock(hash)
+	cli.restoreMempool(bc, event)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("ブロック %x を不正として記録しました\n", hash)
+	cli.printTip(bc)
+}
+
+// 不正の記録を取り消し、最も仕事量の多いチェーンに戻す
+func (cli *CLI) reconsiderBlock(hashHex string) {
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	event, err := bc.ReconsiderBlock(hash)
+	cli.restoreMempool(bc, event)
+	if err != nil {
+		// 検証に失敗したブロックは再び不正として記録されている
+		fmt.Println(err)
+		cli.printTip(bc)
+		os.Exit(1)
+	}
+	fmt.Printf("ブロック %x の不正の記録を取り消しました\n", hash)
+	cli.printTip(bc)
+}
+
+// 再編成で切り離したブロックのトランザクションをメモリプールに戻して保存する
+// 新しいチェーンで承認されたものや使用済みの出力を使うものは戻さない
+func (cli *CLI) restoreMempool(bc *Blockchain, event *ReorgEvent) {
+	if event == nil {
+		return
+	}
+	fmt.Printf("チェーンを再編成しました: %v\n", event)
+	orphaned := event.OrphanedTransactions()
+	pool := LoadMempool(bc)
+	pool.Update(orphaned)
+	pool.Save()
+	restored := 0
+	for _, tx := range orphaned {
+		if pool.Has(tx.ID) {
+			restored++
+		}
+	}
+	if len(orphaned) > 0 {
+		fmt.Printf("メモリプールに戻したトランザクション: %d / %d 件\n", restored, len(orphaned))
+	}
+}
+
+// 最終ブロックの高さとハッシュ値を表示する
+func (cli *CLI) printTip(bc *Blockchain) {
+	fmt.Printf("最終ブロック: 高さ %d %x\n", bc.GetBestHeight(), bc.tip)
+}
+
+// ブロックチェーンを生成する
+func (cli *CLI) createBlockchain(address string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	bc := CreateBlockchain(address)
+	bc.db.Close()
+	fmt.Println("Done!")
+}
+
+// 残高を取得し出力する
+func (cli *CLI) getBalance(address string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	// ブロックチェーンを生成
+	bc := NewBlockchain(address)
+	defer bc.db.Close()
+	// 対象アドレスについての未使用トランザクション出力の合計を
+	// 使用可能な金額と未成熟のコインベースの金額に分けて取得
+	scriptPubKey, err := PayToAddrScript(address)
+	if err != nil {
+		log.Panic(err)
+	}
+	spendable, immature := UTXOSet{bc}.Balance(scriptPubKey)
+	fmt.Printf("Balance of '%s': %d\n", address, spendable)
+	fmt.Printf("  未成熟: %d\n", immature)
+}
+
+// メモリプールのトランザクションを含むブロックを採掘する
+// メモリプールが空の場合は報酬のみのブロックとなる
+// コインベースの出力はchainParams.CoinbaseMaturityブロック後から使用できる
+func (cli *CLI) generate(address string, blocks int) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	bc := NewBlockchain(address)
+	defer bc.db.Close()
+	cli.mineBlocks(bc, LoadMempool(bc), address, blocks)
+}
+
+// メモリプールのトランザクションを含むブロックをblocks個採掘し、報酬と手数料をaddressに送る
+// 承認されたトランザクションはメモリプールから取り除いて保存する
+func (cli *CLI) mineBlocks(bc *Blockchain, pool *Mempool, address string, blocks int) {
+	// Ctrl-Cが押された場合は採掘を中断する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for i := 0; i < blocks; i++ {
+		block, err := bc.MineBlock(ctx, pool.BlockTransactions(address))
+		var cancelled *MiningCancelledError
+		var invalid *BlockValidationError
+		if errors.As(err, &cancelled) {
+			fmt.Println("採掘を中断しました。")
+			return
+		} else if errors.As(err, &invalid) {
+			fmt.Println(err)
+			os.Exit(1)
+		} else if err != nil {
+			log.Panic(err)
+		}
+		pool.Update(nil)
+		pool.Save()
+		fmt.Printf("ブロック高 %d: %x\n", block.Height, block.Hash)
+		if len(block.Transactions) > 1 {
+			fmt.Printf("  トランザクション: %d 件\n", len(block.Transactions)-1)
+		}
+	}
+}
+
+// ファイルのハッシュ値を埋め込んだトランザクションをメモリプールに追加する
+// 手数料はfromが支払い、generateやノードの採掘者が採掘すると記録が完了する
+func (cli *CLI) anchor(from, path string, fee int) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: アドレスが正しくありません")
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets := cli.openWallets()
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+	pool := LoadMempool(bc)
+	tx, err := NewDataTransaction(wallet, hash, fee, from, pool)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := pool.Add(tx); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	pool.Save()
+	fmt.Printf("ハッシュ値: %x\n", hash)
+	fmt.Printf("トランザクションID: %x\n", tx.ID)
+	fmt.Println("メモリプールに追加しました。採掘されると記録が完了します。")
+}
+
+// ファイルのハッシュ値を記録したトランザクションを探し、記録時刻と承認数を表示する
+func (cli *CLI) verifyAnchor(path string) {
+	hash, err := HashFile(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	block, tx, err := bc.FindDataOutput(hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("ハッシュ値: %x\n", hash)
+	fmt.Printf("トランザクションID: %x\n", tx.ID)
+	fmt.Printf("ブロック: %x (高さ %d)\n", block.Hash, block.Height)
+	fmt.Printf("ブロック時刻: %s\n", time.Unix(block.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("承認数: %d\n", bc.GetBestHeight()-block.Height+1)
+}
+
+// 送金処理
+// 送金のトランザクションをメモリプールに追加し、generateやノードの採掘者が採掘するのを待つ
+// メモリプールにある未承認のトランザクションのおつりも送金に使う
+// nodeを指定した場合はメモリプールに追加せずにノードに送信する（ノードのメモリプールにあるおつりは使わない）
+// lockTimeを過ぎていない場合はブロックに含められないため追加しない
+func (cli *CLI) send(from, to string, amount, fee int, lockTime uint32, node string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: 送信元アドレスが正しくありません")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: 送信先アドレスが正しくありません")
+	}
+	// 署名に使う送信元の鍵をウォレットファイルから取得
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.HasAddress(from) {
+		cli.unlockWallets(wallets)
+	}
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// ブロックチェーンとメモリプールを取得
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+	pool := LoadMempool(bc)
+	// HDウォレットの場合、おつりは内部チェーンの新しいアドレスに送る
+	change := from
+	if wallets.IsHD() {
+		change, err = wallets.NewHDAddress(hdInternalChain)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	// 未使用トランザクション出力を用いて送金する
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, change, lockTime, pool)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := pool.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		log.Panic(err)
+	}
+	tx.SetID()
+	if node != "" {
+		err = SendTransaction(node, tx)
+	} else if err = pool.Add(tx); err == nil {
+		pool.Save()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// おつりのアドレスを使った場合のみ導出したインデックスを保存
+	if wallets.IsHD() && len(tx.Vout) > 1 {
+		wallets.SaveToFile()
+	}
+	fmt.Printf("トランザクションID: %x\n", tx.ID)
+	fmt.Printf("手数料: %d\n", fee)
+	if node != "" {
+		fmt.Printf("%s に送信しました\n", node)
+	} else {
+		fmt.Println("メモリプールに追加しました。採掘されると送金が完了します。")
+	}
+}
+
+// メモリプールの内容を取得する
+// nodeを指定した場合は起動中のノードに問い合わせ、それ以外はデータベースから読み込む
+func (cli *CLI) mempoolContents(node string) *mempoolPayload {
+	if node != "" {
+		pool, err := QueryMempool(node)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return pool
+	}
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+	pool := LoadMempool(bc)
+	return &mempoolPayload{pool.Info(), pool.TxInfos()}
 }
 
-// 残高を取得し出力する
-func (cli *CLI) getBalance(address string) {
-	// ブロックチェーンを生成
-	bc := NewBlockchain(address)
-	defer bc.db.Close()
-	// 残高を初期化し、対象アドレスについての
-	// 未使用トランザクション出力全てを取得
-	balance := 0
-	UTXOs := bc.FindUTXO(address)
-	// 全てのValueの値の合計を求める
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
-	fmt.Printf("Balance of '%s': %d\n", address, balance)
+// メモリプールの統計情報を表示する
+func (cli *CLI) getMempoolInfo(node string) {
+	info := cli.mempoolContents(node).Info
+	fmt.Printf("トランザクション数: %d\n", info.Count)
+	fmt.Printf("サイズ: %d / %d バイト\n", info.Size, info.MaxSize)
+	fmt.Printf("手数料の合計: %d\n", info.Fees)
 }
 
-// 送金処理
-func (cli *CLI) send(from, to string, amount int) {
-	// ブロックチェーンを取得
-	bc := NewBlockchain(from)
-	defer bc.db.Close()
-	// 未使用トランザクション出力を用いて送金する
-	tx := NewUTXOTransaction(from, to, amount, bc)
-	// 新しいトランザクションを用いてブロックをマイニング
-	bc.MineBlock([]*Transaction{tx})
-	fmt.Println("成功しました!")
+// メモリプールのトランザクションIDを受け付けた順に表示する
+// verboseの場合はサイズ、手数料、受け付けた時刻、メモリプールにある親も表示する
+func (cli *CLI) getRawMempool(node string, verbose bool) {
+	for _, tx := range cli.mempoolContents(node).Transactions {
+		fmt.Printf("%x\n", tx.ID)
+		if !verbose {
+			continue
+		}
+		fmt.Printf("  サイズ: %d バイト\n", tx.Size)
+		fmt.Printf("  手数料: %d\n", tx.Fee)
+		fmt.Printf("  受付時刻: %s\n", time.Unix(tx.Time, 0).Format(time.RFC3339))
+		for _, parent := range tx.Depends {
+			fmt.Printf("  親: %x\n", parent)
+		}
+	}
 }
 
 // CLIの実行
@@ -101,22 +1137,128 @@ func (cli *CLI) Run() {
 	// addBlockCmd := flag.NewFlagSet("addblock", flag.ExitOnError)
 	// printChainコマンドの解析
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
+	getTxProofTxid := getTxProofCmd.String("txid", "", "トランザクションID")
+	verifyTxProofCmd := flag.NewFlagSet("verifytxproof", flag.ExitOnError)
+	verifyTxProofTxid := verifyTxProofCmd.String("txid", "", "トランザクションID")
+	verifyTxProofRoot := verifyTxProofCmd.String("root", "", "マークルルート")
+	verifyTxProofProof := verifyTxProofCmd.String("proof", "", "gettxproofで得たプルーフ")
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	verifyChainstateCmd := flag.NewFlagSet("verifychainstate", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	decodeScriptCmd := flag.NewFlagSet("decodescript", flag.ExitOnError)
+	decodeScriptHex := decodeScriptCmd.String("hex", "", "16進数のスクリプト")
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "公開鍵を表示するアドレス")
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigN := createMultisigCmd.Int("n", 0, "必要な署名の数")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "カンマ区切りの公開鍵またはアドレス")
+	createTxCmd := flag.NewFlagSet("createtx", flag.ExitOnError)
+	createTxFrom := createTxCmd.String("from", "", "送信元アドレス")
+	createTxTo := createTxCmd.String("to", "", "送信先アドレス")
+	createTxAmount := createTxCmd.Int("amount", 0, "送金額")
+	createTxFee := createTxCmd.Int("fee", 0, "採掘者に支払う手数料")
+	createTxLockTime := createTxCmd.Uint("locktime", 0, "ロックタイム（高さまたはUnixタイム）")
+	signTxCmd := flag.NewFlagSet("signtx", flag.ExitOnError)
+	signTxHex := signTxCmd.String("hex", "", "16進数のトランザクション")
+	createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	createPSBTFrom := createPSBTCmd.String("from", "", "送信元アドレス")
+	createPSBTTo := createPSBTCmd.String("to", "", "送信先アドレス")
+	createPSBTAmount := createPSBTCmd.Int("amount", 0, "送金額")
+	createPSBTFee := createPSBTCmd.Int("fee", 0, "採掘者に支払う手数料")
+	createPSBTLockTime := createPSBTCmd.Uint("locktime", 0, "ロックタイム（高さまたはUnixタイム）")
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	signPSBTPSBT := signPSBTCmd.String("psbt", "", "16進数のPSBT")
+	combinePSBTCmd := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	combinePSBTPSBTs := combinePSBTCmd.String("psbts", "", "カンマ区切りの16進数のPSBT")
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	finalizePSBTPSBT := finalizePSBTCmd.String("psbt", "", "16進数のPSBT")
+	broadcastTxCmd := flag.NewFlagSet("broadcasttx", flag.ExitOnError)
+	broadcastTxHex := broadcastTxCmd.String("hex", "", "16進数のトランザクションまたはPSBT")
+	broadcastTxMiner := broadcastTxCmd.String("miner", "", "採掘報酬を受け取るアドレス")
+	broadcastTxThreads := broadcastTxCmd.Int("threads", 0, "採掘に使うスレッド数")
+	broadcastTxNode := broadcastTxCmd.String("node", "", "メモリプールに追加せずに送信するノードのアドレス")
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	startNodePort := startNodeCmd.Int("port", 0, "待ち受けるポート番号")
+	startNodeSeed := startNodeCmd.String("seed", "", "最初に接続するノードのアドレス（カンマ区切り）")
+	startNodeMiner := startNodeCmd.String("miner", "", "採掘報酬を受け取るアドレス")
+	startNodeThreads := startNodeCmd.Int("threads", 0, "採掘に使うスレッド数")
+	startNodeHalving := startNodeCmd.Int("halving",
+		defaultChainParams.SubsidyHalvingInterval, "採掘報酬が半減するまでのブロック数")
+	startNodeMaturity := startNodeCmd.Int("maturity",
+		defaultChainParams.CoinbaseMaturity, "コインベースの出力が使用可能になるまでのブロック数")
+	startNodeDataDir := startNodeCmd.String("datadir", "", "ブロックチェーンを置くディレクトリ")
+	getSyncStatusCmd := flag.NewFlagSet("getsyncstatus", flag.ExitOnError)
+	getSyncStatusNode := getSyncStatusCmd.String("node", "", "問い合わせるノードのアドレス")
+	getMempoolInfoCmd := flag.NewFlagSet("getmempoolinfo", flag.ExitOnError)
+	getMempoolInfoNode := getMempoolInfoCmd.String("node", "", "問い合わせるノードのアドレス")
+	getRawMempoolCmd := flag.NewFlagSet("getrawmempool", flag.ExitOnError)
+	getRawMempoolNode := getRawMempoolCmd.String("node", "", "問い合わせるノードのアドレス")
+	getRawMempoolVerbose := getRawMempoolCmd.Bool("verbose", false, "トランザクションの詳細も表示する")
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "不正とするブロックのハッシュ値")
+	reconsiderBlockCmd := flag.NewFlagSet("reconsiderblock", flag.ExitOnError)
+	reconsiderBlockHash := reconsiderBlockCmd.String("hash", "", "不正の記録を取り消すブロックのハッシュ値")
 	// 追加するブロックデータ
 	// 第１引数: オプション名 第２引数: デフォルト値
 	// 第３引数: 説明
 	// addBlockData := addBlockCmd.String("data", "", "Block data")
 
+	// createwalletコマンドの対応
+	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	createWalletHD := createWalletCmd.Bool("hd", false, "HDウォレットを作成する")
+	createWalletWords := createWalletCmd.Int("words", 12, "ニーモニックの単語数（12または24）")
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ExitOnError)
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "復元するニーモニック")
+	getNewAddressCmd := flag.NewFlagSet("getnewaddress", flag.ExitOnError)
+	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	dumpPrivKeyCmd := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	dumpPrivKeyAddress := dumpPrivKeyCmd.String("address", "", "秘密鍵を表示するアドレス")
+	importPrivKeyCmd := flag.NewFlagSet("importprivkey", flag.ExitOnError)
+	importPrivKeyKey := importPrivKeyCmd.String("key", "", "取り込む秘密鍵（16進数）")
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	walletPassphraseCmd := flag.NewFlagSet("walletpassphrase", flag.ExitOnError)
+	walletPassphraseTimeout := walletPassphraseCmd.Int("timeout", 60, "ロックを解除する秒数")
+	walletLockCmd := flag.NewFlagSet("walletlock", flag.ExitOnError)
+	walletAgentCmd := flag.NewFlagSet(walletAgentCommand, flag.ExitOnError)
+	walletAgentTimeout := walletAgentCmd.Int("timeout", 60, "復号鍵を保持する秒数")
+
 	createBlockchainCmd :=
 		flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createBlockchainAddress :=
 		createBlockchainCmd.String(
 			"address", "", "初期ブロックの報酬を送信するアドレス")
+	createBlockchainThreads := createBlockchainCmd.Int("threads", 0, "採掘に使うスレッド数")
+	createBlockchainHalving := createBlockchainCmd.Int("halving",
+		defaultChainParams.SubsidyHalvingInterval, "採掘報酬が半減するまでのブロック数")
+	createBlockchainMaturity := createBlockchainCmd.Int("maturity",
+		defaultChainParams.CoinbaseMaturity, "コインベースの出力が使用可能になるまでのブロック数")
+
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	generateAddress := generateCmd.String("address", "", "採掘報酬を送信するアドレス")
+	generateBlocks := generateCmd.Int("blocks", 1, "採掘するブロック数")
+	generateThreads := generateCmd.Int("threads", 0, "採掘に使うスレッド数")
+
+	anchorCmd := flag.NewFlagSet("anchor", flag.ExitOnError)
+	anchorFrom := anchorCmd.String("from", "", "手数料を支払うアドレス")
+	anchorFile := anchorCmd.String("file", "", "記録するファイル")
+	anchorFee := anchorCmd.Int("fee", 0, "採掘者に支払う手数料")
+	// 採掘しなくなったため使わないが、以前のコマンドがエラーにならないよう受け付ける
+	anchorCmd.Int("threads", 0, "使用しない（採掘はgenerateで行う）")
+	verifyAnchorCmd := flag.NewFlagSet("verifyanchor", flag.ExitOnError)
+	verifyAnchorFile := verifyAnchorCmd.String("file", "", "確認するファイル")
 
 	// sendコマンドの対応
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	sendFrom := sendCmd.String("from", "", "送信元ウォレットアドレス")
 	sendTo := sendCmd.String("to", "", "送信先ウォレットアドレス")
 	sendAmount := sendCmd.Int("amount", 0, "送金額")
+	sendFee := sendCmd.Int("fee", 0, "採掘者に支払う手数料")
+	sendLockTime := sendCmd.Uint("locktime", 0, "ロックタイム（高さまたはUnixタイム）")
+	sendNode := sendCmd.String("node", "", "メモリプールに追加せずに送信するノードのアドレス")
+	// 採掘しなくなったため使わないが、以前のコマンドがエラーにならないよう受け付ける
+	sendCmd.Int("threads", 0, "使用しない（採掘はgenerateで行う）")
 
 	// getbalanceコマンドの対応
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
@@ -134,16 +1276,191 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "gettxproof": // マークルプルーフの取得
+		err := getTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifytxproof": // マークルプルーフの検証
+		err := verifyTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindexutxo": // UTXOセットの再構築
+		err := reindexUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifychainstate": // UTXOセットの照合
+		err := verifyChainstateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxoutsetinfo": // UTXOセットの統計情報
+		err := getTxOutSetInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsupply": // 流通量と最大供給量
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decodescript": // スクリプトの解析
+		err := decodeScriptCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey": // 公開鍵の表示
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig": // マルチシグアドレスの作成
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createtx": // 署名前のトランザクションの作成
+		err := createTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signtx": // トランザクションへの署名
+		err := signTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createpsbt": // 署名前のPSBTの作成
+		err := createPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signpsbt": // PSBTへの署名
+		err := signPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combinepsbt": // PSBTの結合
+		err := combinePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "finalizepsbt": // PSBTの署名の確定
+		err := finalizePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "broadcasttx": // 署名済みトランザクションの採掘
+		err := broadcastTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "startnode": // P2Pノードの起動
+		err := startNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsyncstatus": // 同期状況の表示
+		err := getSyncStatusCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getmempoolinfo": // メモリプールの統計情報
+		err := getMempoolInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getrawmempool": // メモリプールのトランザクションの一覧
+		err := getRawMempoolCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "invalidateblock": // ブロックを不正として記録
+		err := invalidateBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reconsiderblock": // 不正の記録の取り消し
+		err := reconsiderBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createwallet": // ウォレットの作成
+		err := createWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "restorewallet": // HDウォレットの復元
+		err := restoreWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getnewaddress": // 新しいアドレスの導出
+		err := getNewAddressCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listaddresses": // アドレスの一覧
+		err := listAddressesCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumpprivkey": // 秘密鍵の表示
+		err := dumpPrivKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importprivkey": // 秘密鍵の取り込み
+		err := importPrivKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "encryptwallet": // ウォレットの暗号化
+		err := encryptWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletpassphrase": // ウォレットのロック解除
+		err := walletPassphraseCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletlock": // ウォレットのロック
+		err := walletLockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case walletAgentCommand: // walletpassphraseが起動する内部コマンド
+		err := walletAgentCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain": // ブロックチェーンの作成
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "generate": // 報酬のみのブロックの採掘
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "anchor": // ファイルのハッシュ値の記録
+		err := anchorCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifyanchor": // 記録したハッシュ値の確認
+		err := verifyAnchorCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send": // 送金処理
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -166,22 +1483,263 @@ func (cli *CLI) Run() {
 		cli.printChain() // チェーンの表示
 	}
 
+	if getTxProofCmd.Parsed() { // gettxproofコマンドか？
+		if *getTxProofTxid == "" {
+			getTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTxProof(*getTxProofTxid)
+	}
+
+	if verifyTxProofCmd.Parsed() { // verifytxproofコマンドか？
+		if *verifyTxProofTxid == "" || *verifyTxProofRoot == "" {
+			verifyTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyTxProof(*verifyTxProofTxid, *verifyTxProofRoot, *verifyTxProofProof)
+	}
+
+	if reindexUTXOCmd.Parsed() { // reindexutxoコマンドか？
+		cli.reindexUTXO()
+	}
+
+	if verifyChainstateCmd.Parsed() { // verifychainstateコマンドか？
+		cli.verifyChainstate()
+	}
+
+	if getTxOutSetInfoCmd.Parsed() { // gettxoutsetinfoコマンドか？
+		cli.getTxOutSetInfo()
+	}
+
+	if getSupplyCmd.Parsed() { // getsupplyコマンドか？
+		cli.getSupply()
+	}
+
+	if decodeScriptCmd.Parsed() { // decodescriptコマンドか？
+		if *decodeScriptHex == "" {
+			decodeScriptCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeScript(*decodeScriptHex)
+	}
+
+	if getPubKeyCmd.Parsed() { // getpubkeyコマンドか？
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress)
+	}
+
+	if createMultisigCmd.Parsed() { // createmultisigコマンドか？
+		if *createMultisigN <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigN, strings.Split(*createMultisigKeys, ","))
+	}
+
+	if createTxCmd.Parsed() { // createtxコマンドか？
+		if *createTxFrom == "" || *createTxTo == "" || *createTxAmount <= 0 || *createTxFee < 0 ||
+			*createTxLockTime > math.MaxUint32 {
+			createTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createTx(*createTxFrom, *createTxTo, *createTxAmount, *createTxFee, uint32(*createTxLockTime))
+	}
+
+	if signTxCmd.Parsed() { // signtxコマンドか？
+		if *signTxHex == "" {
+			signTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signTx(*signTxHex)
+	}
+
+	if createPSBTCmd.Parsed() { // createpsbtコマンドか？
+		if *createPSBTFrom == "" || *createPSBTTo == "" || *createPSBTAmount <= 0 || *createPSBTFee < 0 ||
+			*createPSBTLockTime > math.MaxUint32 {
+			createPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createPSBT(*createPSBTFrom, *createPSBTTo, *createPSBTAmount, *createPSBTFee, uint32(*createPSBTLockTime))
+	}
+
+	if signPSBTCmd.Parsed() { // signpsbtコマンドか？
+		if *signPSBTPSBT == "" {
+			signPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signPSBT(*signPSBTPSBT)
+	}
+
+	if combinePSBTCmd.Parsed() { // combinepsbtコマンドか？
+		if *combinePSBTPSBTs == "" {
+			combinePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combinePSBT(strings.Split(*combinePSBTPSBTs, ","))
+	}
+
+	if finalizePSBTCmd.Parsed() { // finalizepsbtコマンドか？
+		if *finalizePSBTPSBT == "" {
+			finalizePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(*finalizePSBTPSBT)
+	}
+
+	if broadcastTxCmd.Parsed() { // broadcasttxコマンドか？
+		if *broadcastTxHex == "" || (*broadcastTxMiner != "" && *broadcastTxNode != "") {
+			broadcastTxCmd.Usage()
+			os.Exit(1)
+		}
+		miningThreads = *broadcastTxThreads
+		cli.broadcastTx(*broadcastTxHex, *broadcastTxMiner, *broadcastTxNode)
+	}
+
+	if startNodeCmd.Parsed() { // startnodeコマンドか？
+		if *startNodePort <= 0 || *startNodePort > 65535 {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		miningThreads = *startNodeThreads
+		var seeds []string
+		if *startNodeSeed != "" {
+			seeds = strings.Split(*startNodeSeed, ",")
+		}
+		setChainParams(*startNodeHalving, *startNodeMaturity)
+		cli.startNode(*startNodePort, seeds, *startNodeMiner, *startNodeDataDir)
+	}
+
+	if getSyncStatusCmd.Parsed() { // getsyncstatusコマンドか？
+		cli.getSyncStatus(*getSyncStatusNode)
+	}
+
+	if getMempoolInfoCmd.Parsed() { // getmempoolinfoコマンドか？
+		cli.getMempoolInfo(*getMempoolInfoNode)
+	}
+
+	if getRawMempoolCmd.Parsed() { // getrawmempoolコマンドか？
+		cli.getRawMempool(*getRawMempoolNode, *getRawMempoolVerbose)
+	}
+
+	if invalidateBlockCmd.Parsed() { // invalidateblockコマンドか？
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.invalidateBlock(*invalidateBlockHash)
+	}
+
+	if reconsiderBlockCmd.Parsed() { // reconsiderblockコマンドか？
+		if *reconsiderBlockHash == "" {
+			reconsiderBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.reconsiderBlock(*reconsiderBlockHash)
+	}
+
+	if createWalletCmd.Parsed() { // createwalletコマンドか？
+		cli.createWallet(*createWalletHD, *createWalletWords)
+	}
+
+	if restoreWalletCmd.Parsed() { // restorewalletコマンドか？
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.restoreWallet(*restoreWalletMnemonic)
+	}
+
+	if getNewAddressCmd.Parsed() { // getnewaddressコマンドか？
+		cli.getNewAddress()
+	}
+
+	if listAddressesCmd.Parsed() { // listaddressesコマンドか？
+		cli.listAddresses()
+	}
+
+	if dumpPrivKeyCmd.Parsed() { // dumpprivkeyコマンドか？
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpPrivKey(*dumpPrivKeyAddress)
+	}
+
+	if importPrivKeyCmd.Parsed() { // importprivkeyコマンドか？
+		if *importPrivKeyKey == "" {
+			importPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importPrivKey(*importPrivKeyKey)
+	}
+
+	if encryptWalletCmd.Parsed() { // encryptwalletコマンドか？
+		cli.encryptWallet()
+	}
+
+	if walletPassphraseCmd.Parsed() { // walletpassphraseコマンドか？
+		if *walletPassphraseTimeout <= 0 {
+			walletPassphraseCmd.Usage()
+			os.Exit(1)
+		}
+		cli.walletPassphrase(*walletPassphraseTimeout)
+	}
+
+	if walletLockCmd.Parsed() { // walletlockコマンドか？
+		cli.walletLock()
+	}
+
+	if walletAgentCmd.Parsed() { // walletagentコマンドか？
+		cli.walletAgent(*walletAgentTimeout)
+	}
+
 	if createBlockchainCmd.Parsed() { // createBlockchainコマンドか？
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
 			os.Exit(1)
 		}
+		miningThreads = *createBlockchainThreads
+		setChainParams(*createBlockchainHalving, *createBlockchainMaturity)
 		cli.createBlockchain(*createBlockchainAddress)
 	}
 
+	if generateCmd.Parsed() { // generateコマンドか？
+		if *generateAddress == "" || *generateBlocks <= 0 {
+			generateCmd.Usage()
+			os.Exit(1)
+		}
+		miningThreads = *generateThreads
+		cli.generate(*generateAddress, *generateBlocks)
+	}
+
+	if anchorCmd.Parsed() { // anchorコマンドか？
+		if *anchorFrom == "" || *anchorFile == "" || *anchorFee < 0 {
+			anchorCmd.Usage()
+			os.Exit(1)
+		}
+		cli.anchor(*anchorFrom, *anchorFile, *anchorFee)
+	}
+
+	if verifyAnchorCmd.Parsed() { // verifyanchorコマンドか？
+		if *verifyAnchorFile == "" {
+			verifyAnchorCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyAnchor(*verifyAnchorFile)
+	}
+
 	if sendCmd.Parsed() { // sendコマンドの場合
 		// 検証
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 ||
+			*sendLockTime > math.MaxUint32 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 		// 送金処理
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, uint32(*sendLockTime), *sendNode)
 	}
 	if getBalanceCmd.Parsed() { // getbalanceコマンドの場合
 		if *getBalanceAddress == "" {
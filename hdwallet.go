@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// 強化導出（hardened）となるインデックスの開始値
+const HardenedKeyStart = uint32(0x80000000)
+
+// BIP44のパス m/44'/0'/0'/chain/index
+const hdPurpose = 44
+const hdCoinType = 0
+const hdAccount = 0
+
+// 受け取り用（外部）とおつり用（内部）のチェーン
+const hdExternalChain = 0
+const hdInternalChain = 1
+
+// 復元時に未使用アドレスがこの数だけ続いたら探索を終える
+const hdGapLimit = 20
+
+// マスター鍵を導出するHMACの鍵（SLIP-0010のP-256用）
+var hdMasterKeySeed = []byte("Nist256p1 seed")
+
+// 拡張秘密鍵（秘密鍵とチェーンコードの組）
+type ExtendedKey struct {
+	Key       []byte // 秘密鍵（32バイト）
+	ChainCode []byte // チェーンコード（32バイト）
+}
+
+// シードからマスター鍵を生成
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, errors.New("シードの長さが正しくありません")
+	}
+	n := elliptic.P256().Params().N
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, hdMasterKeySeed)
+		mac.Write(data)
+		I := mac.Sum(nil)
+		// 秘密鍵として使えない値の場合はIを元にやり直す
+		k := new(big.Int).SetBytes(I[:32])
+		if k.Sign() != 0 && k.Cmp(n) < 0 {
+			return &ExtendedKey{I[:32], I[32:]}, nil
+		}
+		data = I
+	}
+}
+
+// 子の拡張秘密鍵の導出
+// indexがHardenedKeyStart以上の場合は強化導出
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	var data []byte
+	if index >= HardenedKeyStart {
+		// 0x00 + 秘密鍵 + インデックス
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		// 圧縮公開鍵 + インデックス
+		x, y := curve.ScalarBaseMult(k.Key)
+		data = elliptic.MarshalCompressed(curve, x, y)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	parent := new(big.Int).SetBytes(k.Key)
+	for {
+		mac := hmac.New(sha512.New, k.ChainCode)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		// 子の秘密鍵 = (IL + 親の秘密鍵) mod n
+		il := new(big.Int).SetBytes(I[:32])
+		child := new(big.Int).Add(il, parent)
+		child.Mod(child, n)
+		if il.Cmp(n) < 0 && child.Sign() != 0 {
+			return &ExtendedKey{child.FillBytes(make([]byte, 32)), I[32:]}, nil
+		}
+		// 無効な鍵となった場合は 0x01 + IR + インデックス でやり直す
+		data = append([]byte{0x01}, I[32:]...)
+		data = binary.BigEndian.AppendUint32(data, index)
+	}
+}
+
+// "m/44'/0'/0'/0/1" のような導出パスをインデックスの列に変換
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("導出パス'%s'が正しくありません", path)
+	}
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h")
+		if hardened {
+			part = part[:len(part)-1]
+		}
+		index, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || uint32(index) >= HardenedKeyStart {
+			return nil, fmt.Errorf("導出パス'%s'が正しくありません", path)
+		}
+		if hardened {
+			index += uint64(HardenedKeyStart)
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// シードから導出パスに従ってウォレットを導出
+func DeriveWallet(seed []byte, path string) (*Wallet, error) {
+	indexes, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		key, err = key.Child(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewWalletFromPrivateKey(key.Key)
+}
+
+// BIP44のチェーンとインデックスから導出パスを生成
+func hdPath(chain, index uint32) string {
+	return fmt.Sprintf("m/%d'/%d'/%d'/%d/%d",
+		hdPurpose, hdCoinType, hdAccount, chain, index)
+}
+
+// 新しいニーモニック（words = 12 または 24 単語）を生成
+func NewMnemonic(words int) (string, error) {
+	if words != 12 && words != 24 {
+		return "", errors.New("単語数は12または24を指定してください")
+	}
+	// 12単語 = 128ビット、24単語 = 256ビット
+	entropy, err := bip39.NewEntropy(words / 3 * 32)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// ニーモニックを検証しシードに変換
+func SeedFromMnemonic(mnemonic string) ([]byte, error) {
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, errors.New("ニーモニックが正しくありません")
+	}
+	return seed, nil
+}
+
+// HDウォレットのシードを持っているか
+func (ws Wallets) IsHD() bool {
+	return len(ws.hdSeed) > 0 || len(ws.cipherSeed) > 0
+}
+
+// HDウォレットのシードを設定
+func (ws *Wallets) SetHDSeed(seed []byte) error {
+	if ws.IsHD() {
+		return errors.New("HDウォレットのシードはすでに設定されています")
+	}
+	if ws.IsLocked() {
+		return ErrWalletLocked
+	}
+	ws.hdSeed = seed
+	ws.hdNext = [2]uint32{0, 0}
+	return nil
+}
+
+// 指定チェーンの次のインデックスでアドレスを導出し、追加する
+func (ws *Wallets) NewHDAddress(chain uint32) (string, error) {
+	if !ws.IsHD() {
+		return "", errors.New("HDウォレットではありません。createwallet -hdで作成してください")
+	}
+	if ws.IsLocked() {
+		return "", ErrWalletLocked
+	}
+	path := hdPath(chain, ws.hdNext[chain])
+	wallet, err := DeriveWallet(ws.hdSeed, path)
+	if err != nil {
+		return "", err
+	}
+	ws.hdNext[chain]++
+	address := ws.AddWallet(wallet)
+	ws.hdPaths[address] = path
+	return address, nil
+}
+
+// 使用済みアドレスを探索してHDウォレットのアドレスを復元
+// isUsedは公開鍵ハッシュがブロックチェーン上で使われているかを返す
+func (ws *Wallets) RestoreHD(isUsed func(pubKeyHash []byte) bool) (int, error) {
+	restored := 0
+	for _, chain := range []uint32{hdExternalChain, hdInternalChain} {
+		gap := 0
+		for index := uint32(0); gap < hdGapLimit; index++ {
+			wallet, err := DeriveWallet(ws.hdSeed, hdPath(chain, index))
+			if err != nil {
+				return restored, err
+			}
+			if !isUsed(HashPubKey(wallet.PublicKey)) {
+				gap++
+				continue
+			}
+			// 使用済みの所までを全て追加する
+			for ws.hdNext[chain] <= index {
+				if _, err := ws.NewHDAddress(chain); err != nil {
+					return restored, err
+				}
+				restored++
+			}
+			gap = 0
+		}
+	}
+	return restored, nil
+}
+
+// アドレスの導出パス（HDウォレット以外の鍵の場合は空）
+func (ws Wallets) HDPath(address string) string {
+	return ws.hdPaths[address]
+}
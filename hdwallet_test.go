@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// SLIP-0010のテストベクター（nist256p1、シード000102...0f）
+func TestDeriveKey(t *testing.T) {
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	tests := []struct {
+		path      string
+		chainCode string
+		key       string
+	}{
+		{"m",
+			"beeb672fe4621673f722f38529c07392fecaa61015c80c34f29ce8b41b3cb6ea",
+			"612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2"},
+		{"m/0'",
+			"3460cea53e6a6bb5fb391eeef3237ffd8724bf0a40e94943c98b83825342ee11",
+			"6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c"},
+		{"m/0'/1",
+			"4187afff1aafa8445010097fb99d23aee9f599450c7bd140b6826ac22ba21d0c",
+			"284e9d38d07d21e4e281b645089a94f4cf5a5a81369acf151a1c3a57f18b2129"},
+	}
+	for _, test := range tests {
+		indexes, err := ParseDerivationPath(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := NewMasterKey(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range indexes {
+			key, err = key.Child(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if hex.EncodeToString(key.ChainCode) != test.chainCode {
+			t.Errorf("%s: chain code = %x, want %s", test.path, key.ChainCode, test.chainCode)
+		}
+		if hex.EncodeToString(key.Key) != test.key {
+			t.Errorf("%s: key = %x, want %s", test.path, key.Key, test.key)
+		}
+	}
+}
+
+// 同じニーモニックからは同じアドレスが導出されるか
+func TestMnemonicRestore(t *testing.T) {
+	mnemonic, err := NewMnemonic(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed1, err := SeedFromMnemonic(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed2, _ := SeedFromMnemonic(mnemonic)
+	w1, _ := DeriveWallet(seed1, hdPath(hdExternalChain, 3))
+	w2, _ := DeriveWallet(seed2, hdPath(hdExternalChain, 3))
+	if string(w1.GetAddress()) != string(w2.GetAddress()) {
+		t.Errorf("restored address %s, want %s", w2.GetAddress(), w1.GetAddress())
+	}
+	if _, err := SeedFromMnemonic(mnemonic + " abandon"); err == nil {
+		t.Error("SeedFromMnemonic accepted an invalid mnemonic")
+	}
+}
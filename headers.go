@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// ブロックヘッダー格納用のバケット
+// 全てのブロックのヘッダーに加え、ブロック本体をまだ受信していないヘッダーも保存する
+// キー"l"には累積の仕事量が最も多い（不正でない）ヘッダーのハッシュ値を記録する
+const headersBucket = "headers"
+
+// ブロックの索引を格納するバケット（キーはブロックのハッシュ値）
+const blockIndexBucket = "blockindex"
+
+// ヘッダーごとにノードが記録する情報
+// 前後のブロックをたどるのに必要な高さと前のブロックも持ち、ヘッダーを復元せずに済むようにする
+type blockIndex struct {
+	ChainWork     []byte // 初期ブロックからこのブロックまでの仕事量の合計（big.Intのバイト列）
+	Invalid       bool   // このブロックまたは前のブロックが不正
+	Height        int    // ブロックの高さ
+	PrevBlockHash []byte // 前のブロックのハッシュ値
+
+	hash []byte // ブロックのハッシュ値（バケットのキーのため保存しない）
+}
+
+// 累積の仕事量
+func (index *blockIndex) Work() *big.Int {
+	return new(big.Int).SetBytes(index.ChainWork)
+}
+
+// 索引のシリアライズ
+func (index *blockIndex) Serialize() []byte {
+	var result bytes.Buffer
+	if err := gob.NewEncoder(&result).Encode(index); err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+// 索引の復元
+func deserializeBlockIndex(hash, encoded []byte) *blockIndex {
+	var index blockIndex
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&index); err != nil {
+		log.Panic(err)
+	}
+	index.hash = append([]byte{}, hash...)
+	return &index
+}
+
+// 索引の取得（ない場合はnil）
+func getBlockIndex(tx *bolt.Tx, hash []byte) *blockIndex {
+	encoded := tx.Bucket([]byte(blockIndexBucket)).Get(hash)
+	if encoded == nil || len(hash) == 0 {
+		return nil
+	}
+	return deserializeBlockIndex(hash, encoded)
+}
+
+// 索引の更新
+func updateBlockIndex(tx *bolt.Tx, index *blockIndex) error {
+	return tx.Bucket([]byte(blockIndexBucket)).Put(index.hash, index.Serialize())
+}
+
+// 全てのブロックの索引（高さの順）
+func sortedBlockIndexes(tx *bolt.Tx) []*blockIndex {
+	var indexes []*blockIndex
+	c := tx.Bucket([]byte(blockIndexBucket)).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		indexes = append(indexes, deserializeBlockIndex(k, v))
+	}
+	sort.SliceStable(indexes, func(i, j int) bool { return indexes[i].Height < indexes[j].Height })
+	return indexes
+}
+
+// 前のブロックの索引から、ヘッダーの累積の仕事量を求めて索引を保存する
+// 前のブロックが不正な場合は不正とする
+func putBlockIndex(tx *bolt.Tx, header *BlockHeader) (*blockIndex, error) {
+	work := CalculateWork(header.Bits)
+	index := &blockIndex{
+		Height:        header.Height,
+		PrevBlockHash: header.PrevBlockHash,
+		hash:          header.Hash,
+	}
+	if parent := getBlockIndex(tx, header.PrevBlockHash); parent != nil {
+		work.Add(work, parent.Work())
+		index.Invalid = parent.Invalid
+	}
+	index.ChainWork = work.Bytes()
+	return index, updateBlockIndex(tx, index)
+}
+
+// ハッシュ値からヘッダーを取得
+func (bc *Blockchain) GetHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket([]byte(headersBucket)).Get(hash)
+		if encoded == nil || len(hash) == 0 {
+			return errors.New("ヘッダーが見つかりません")
+		}
+		header = DeserializeHeader(encoded)
+		return nil
+	})
+	return header, err
+}
+
+// ハッシュ値のヘッダーを持っているか
+func (bc *Blockchain) HasHeader(hash []byte) bool {
+	_, err := bc.GetHeader(hash)
+	return err == nil
+}
+
+// 累積の仕事量が最も多いヘッダー（ヘッダーがない場合はnil）
+func (bc *Blockchain) BestHeader() *BlockHeader {
+	var header *BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		if best := b.Get([]byte("l")); best != nil {
+			header = DeserializeHeader(b.Get(best))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return header
+}
+
+// ブロックの累積の仕事量
+func (bc *Blockchain) ChainWork(hash []byte) *big.Int {
+	var work *big.Int
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		index := getBlockIndex(tx, hash)
+		if index == nil {
+			return errors.New("ヘッダーが見つかりません")
+		}
+		work = index.Work()
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return work
+}
+
+// 不正と記録されたブロックか
+func (bc *Blockchain) isInvalid(hash []byte) bool {
+	invalid := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if index := getBlockIndex(tx, hash); index != nil {
+			invalid = index.Invalid
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return invalid
+}
+
+// ヘッダーを保存し、累積の仕事量が最も多いヘッダーであれば記録する
+func putHeader(tx *bolt.Tx, header *BlockHeader) error {
+	b := tx.Bucket([]byte(headersBucket))
+	if b.Get(header.Hash) != nil {
+		return nil
+	}
+	if err := b.Put(header.Hash, header.Serialize()); err != nil {
+		return err
+	}
+	index, err := putBlockIndex(tx, header)
+	if err != nil || index.Invalid {
+		return err
+	}
+	// 仕事量が同じ場合は先に受け取ったヘッダーを優先する
+	if best := b.Get([]byte("l")); best != nil {
+		if getBlockIndex(tx, best).Work().Cmp(index.Work()) >= 0 {
+			return nil
+		}
+	}
+	return b.Put([]byte("l"), header.Hash)
+}
+
+// 全てのヘッダー（高さの順）
+// 索引を作成する際にのみ使い、それ以外は索引をたどる
+func sortedHeaders(tx *bolt.Tx) []*BlockHeader {
+	var headers []*BlockHeader
+	c := tx.Bucket([]byte(headersBucket)).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if bytes.Equal(k, []byte("l")) {
+			continue
+		}
+		headers = append(headers, DeserializeHeader(v))
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Height < headers[j].Height })
+	return headers
+}
+
+// 不正でないヘッダーのうち、累積の仕事量が最も多いものを選び直す
+// 仕事量が同じ場合は最終ブロックを優先する
+func selectBestHeader(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(headersBucket))
+	var best []byte
+	var bestWork *big.Int
+	if tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("l")); tip != nil {
+		if index := getBlockIndex(tx, tip); index != nil && !index.Invalid {
+			best, bestWork = append([]byte{}, tip...), index.Work()
+		}
+	}
+	c := tx.Bucket([]byte(blockIndexBucket)).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		index := deserializeBlockIndex(k, v)
+		if index.Invalid {
+			continue
+		}
+		if bestWork == nil || index.Work().Cmp(bestWork) > 0 {
+			best, bestWork = index.hash, index.Work()
+		}
+	}
+	if best == nil {
+		return b.Delete([]byte("l"))
+	}
+	return b.Put([]byte("l"), best)
+}
+
+// 索引用のバケットがない古いデータベースの場合は、全てのヘッダーから作成する
+func createBlockIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(blockIndexBucket)) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket([]byte(blockIndexBucket)); err != nil {
+		return err
+	}
+	for _, header := range sortedHeaders(tx) {
+		if _, err := putBlockIndex(tx, header); err != nil {
+			return err
+		}
+	}
+	return selectBestHeader(tx)
+}
+
+// ブロックとそれに続く全てのブロックを不正として記録し、最も仕事量の多いヘッダーを選び直す
+// 有効なチェーンのブロックの場合も切り離しはしない
+func (bc *Blockchain) markInvalid(hash []byte) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		invalid := map[string]bool{string(hash): true}
+		for _, index := range sortedBlockIndexes(tx) {
+			if invalid[string(index.PrevBlockHash)] {
+				invalid[string(index.hash)] = true
+			}
+			if !invalid[string(index.hash)] || index.Invalid {
+				continue
+			}
+			index.Invalid = true
+			if err := updateBlockIndex(tx, index); err != nil {
+				return err
+			}
+		}
+		return selectBestHeader(tx)
+	})
+}
+
+// ブロックとその前後の全てのブロックの不正の記録を取り消し、最も仕事量の多いヘッダーを選び直す
+func (bc *Blockchain) clearInvalid(hash []byte) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		var cleared []*blockIndex
+		// 前のブロック
+		for index := getBlockIndex(tx, hash); index != nil; index = getBlockIndex(tx, index.PrevBlockHash) {
+			cleared = append(cleared, index)
+		}
+		// 続くブロック
+		descendants := map[string]bool{string(hash): true}
+		for _, index := range sortedBlockIndexes(tx) {
+			if descendants[string(index.PrevBlockHash)] {
+				descendants[string(index.hash)] = true
+				cleared = append(cleared, index)
+			}
+		}
+		for _, index := range cleared {
+			if !index.Invalid {
+				continue
+			}
+			index.Invalid = false
+			if err := updateBlockIndex(tx, index); err != nil {
+				return err
+			}
+		}
+		return selectBestHeader(tx)
+	})
+}
+
+// 本体を持っている不正でないブロックのうち、累積の仕事量が最も多いもののハッシュ値
+// 仕事量が同じ場合は最終ブロックを優先する
+func (bc *Blockchain) bestBlock() []byte {
+	var best []byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		var bestWork *big.Int
+		if tip := blocks.Get([]byte("l")); tip != nil {
+			if index := getBlockIndex(tx, tip); index != nil && !index.Invalid {
+				best, bestWork = append([]byte{}, tip...), index.Work()
+			}
+		}
+		c := tx.Bucket([]byte(blockIndexBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if blocks.Get(k) == nil {
+				continue
+			}
+			index := deserializeBlockIndex(k, v)
+			if index.Invalid {
+				continue
+			}
+			if bestWork == nil || index.Work().Cmp(bestWork) > 0 {
+				best, bestWork = index.hash, index.Work()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return best
+}
+
+// ヘッダーを検証して保存する
+// 前のブロックのヘッダーを持っていない場合はErrUnknownParentの、
+// 前のブロックが不正な場合はErrInvalidParentのBlockValidationErrorを返す
+func (bc *Blockchain) AddHeader(header *BlockHeader) error {
+	if bc.HasHeader(header.Hash) {
+		return nil
+	}
+	if bc.isInvalid(header.PrevBlockHash) {
+		return invalidBlock(ErrInvalidParent, "前のブロック %x", header.PrevBlockHash)
+	}
+	var err error
+	if len(header.PrevBlockHash) == 0 {
+		// 初期ブロックは最初の1つのみ受け付ける
+		if bc.BestHeader() != nil {
+			return invalidBlock(ErrUnknownParent, "異なる初期ブロック %x", header.Hash)
+		}
+		err = validateGenesisHeader(header)
+	} else {
+		_, err = bc.validateHeader(header)
+	}
+	if err != nil {
+		return err
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		return putHeader(tx, header)
+	})
+}
+
+// hashのヘッダーから初期ブロックまでのハッシュ値（新しい順）
+func (bc *Blockchain) headerHashes(hash []byte) [][]byte {
+	var hashes [][]byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		for len(hash) > 0 {
+			encoded := b.Get(hash)
+			if encoded == nil {
+				break
+			}
+			hashes = append(hashes, hash)
+			hash = DeserializeHeader(encoded).PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return hashes
+}
+
+// 最も仕事量の多いヘッダーまでのうち、本体をまだ持っていないブロックのヘッダー（古い順）
+// 分岐したチェーンの場合は、本体を持っているブロックからの分岐したブロックを含む
+func (bc *Blockchain) missingBlocks() []*BlockHeader {
+	var headers []*BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		blocks := tx.Bucket([]byte(blocksBucket))
+		hash := b.Get([]byte("l"))
+		for len(hash) > 0 && blocks.Get(hash) == nil {
+			header := DeserializeHeader(b.Get(hash))
+			headers = append(headers, header)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	// 古い順に並べ替える
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	return headers
+}
+
+// 2つのブロックの分岐点（共通の祖先のうち最も新しいもの）のヘッダー
+func (bc *Blockchain) findFork(a, b []byte) (*BlockHeader, error) {
+	headerA, err := bc.GetHeader(a)
+	if err != nil {
+		return nil, err
+	}
+	headerB, err := bc.GetHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	for !bytes.Equal(headerA.Hash, headerB.Hash) {
+		// 高い方から遡る
+		if headerA.Height >= headerB.Height {
+			headerA, err = bc.GetHeader(headerA.PrevBlockHash)
+		} else {
+			headerB, err = bc.GetHeader(headerB.PrevBlockHash)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return headerA, nil
+}
+
+// ブロックロケーター
+// 最も仕事量の多いヘッダーから10個は全て、それ以降は間隔を倍にしながらハッシュ値を集め、最後に初期ブロックを加える
+func (bc *Blockchain) headerLocator() [][]byte {
+	var hashes [][]byte
+	if best := bc.BestHeader(); best != nil {
+		hashes = bc.headerHashes(best.Hash)
+	}
+	var locator [][]byte
+	step := 1
+	for i := 0; i < len(hashes); i += step {
+		locator = append(locator, hashes[i])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(hashes) > 0 && !bytes.Equal(locator[len(locator)-1], hashes[len(hashes)-1]) {
+		locator = append(locator, hashes[len(hashes)-1])
+	}
+	return locator
+}
+
+// ロケーターの中で最初に見つかったブロックより後のヘッダー（古い順に最大max個）
+// 本体を持っているブロックのみを返し、見つからない場合は初期ブロックから返す
+func (bc *Blockchain) headersAfter(locator [][]byte, max int) []*BlockHeader {
+	hashes := bc.GetBlockHashes()
+	index := make(map[string]int)
+	for i, hash := range hashes {
+		index[string(hash)] = i
+	}
+	start := len(hashes) - 1
+	for _, hash := range locator {
+		if i, ok := index[string(hash)]; ok {
+			start = i - 1
+			break
+		}
+	}
+	var headers []*BlockHeader
+	for i := start; i >= 0 && len(headers) < max; i-- {
+		header, err := bc.GetHeader(hashes[i])
+		if err != nil {
+			log.Panic(err)
+		}
+		headers = append(headers, header)
+	}
+	return headers
+}
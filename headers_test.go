@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// ヘッダーの高さ（比較用）
+func headerHeights(headers []*BlockHeader) []int {
+	var heights []int
+	for _, header := range headers {
+		heights = append(heights, header.Height)
+	}
+	return heights
+}
+
+// 高さの並びが一致するか
+func equalHeights(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ヘッダーのシリアライズと復元
+func TestBlockHeaderSerialize(t *testing.T) {
+	header := &BlockHeader{1, []byte{1, 2}, []byte{3, 4}, []byte{5, 6}, 7, 0x1d00ffff, 8}
+	decoded := DeserializeHeader(header.Serialize())
+	if decoded.Timestamp != header.Timestamp || !bytes.Equal(decoded.PrevBlockHash, header.PrevBlockHash) ||
+		!bytes.Equal(decoded.MerkleRoot, header.MerkleRoot) || !bytes.Equal(decoded.Hash, header.Hash) ||
+		decoded.Nonce != header.Nonce || decoded.Bits != header.Bits || decoded.Height != header.Height {
+		t.Errorf("DeserializeHeader() = %+v, want %+v", decoded, header)
+	}
+}
+
+// ヘッダーのみでPoWを検証し、書き換えを検出できるか
+func TestCheckProofOfWork(t *testing.T) {
+	header := &BlockHeader{Timestamp: 1, MerkleRoot: []byte{1}, Bits: BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-8))}
+	header.Nonce, header.Hash = NewProofOfWork(header).Run()
+	if err := checkProofOfWork(header); err != nil {
+		t.Fatalf("checkProofOfWork() = %v", err)
+	}
+
+	modified := *header
+	modified.MerkleRoot = []byte{2}
+	if err := checkProofOfWork(&modified); !errors.Is(err, ErrBadProofOfWork) {
+		t.Errorf("checkProofOfWork() with modified merkle root = %v, want %v", err, ErrBadProofOfWork)
+	}
+}
+
+// ヘッダーのみを検証して保存し、本体のないブロックを返すか
+// 前のブロックがない、難易度が違う、前のブロックが不正なヘッダーは保存しない
+func TestAddHeader(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	coinbase := func(height int) []*Transaction {
+		return []*Transaction{NewCoinbaseTX(address, "", height, 0)}
+	}
+
+	first := newTestBlock(t, bc, nil, coinbase(1), nil)
+	if err := bc.AddHeader(&first.BlockHeader); err != nil {
+		t.Fatalf("AddHeader() = %v", err)
+	}
+	second := newTestBlock(t, bc, first, coinbase(2), nil)
+	if err := bc.AddHeader(&second.BlockHeader); err != nil {
+		t.Fatalf("AddHeader() = %v", err)
+	}
+	if best := bc.BestHeader(); !bytes.Equal(best.Hash, second.Hash) {
+		t.Errorf("BestHeader() = %x, want %x", best.Hash, second.Hash)
+	}
+	if bc.GetBestHeight() != 0 {
+		t.Errorf("GetBestHeight() = %d, want 0 before the blocks arrive", bc.GetBestHeight())
+	}
+	if heights := headerHeights(bc.missingBlocks()); !equalHeights(heights, []int{1, 2}) {
+		t.Errorf("missingBlocks() = %v, want [1 2]", heights)
+	}
+	if _, err := bc.AddBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	if heights := headerHeights(bc.missingBlocks()); !equalHeights(heights, []int{2}) {
+		t.Errorf("missingBlocks() after AddBlock() = %v, want [2]", heights)
+	}
+
+	tests := []struct {
+		name   string
+		prev   *Block
+		modify func(*Block)
+		err    error
+	}{
+		{"unknown parent", second, func(b *Block) { b.PrevBlockHash = []byte{1} }, ErrUnknownParent},
+		{"bits", second, func(b *Block) { b.Bits = BigToCompact(powLimit) }, ErrBadDifficulty},
+		{"height", second, func(b *Block) { b.Height++ }, ErrBadHeight},
+	}
+	for _, test := range tests {
+		block := newTestBlock(t, bc, test.prev, coinbase(3), test.modify)
+		if err := bc.AddHeader(&block.BlockHeader); !errors.Is(err, test.err) {
+			t.Errorf("%s: AddHeader() = %v, want %v", test.name, err, test.err)
+		}
+		if bc.HasHeader(block.Hash) {
+			t.Errorf("%s: rejected header was stored", test.name)
+		}
+	}
+
+	// 不正なブロックに続くヘッダーは受け付けず、最も仕事量の多いヘッダーは有効なものに戻る
+	if err := bc.markInvalid(second.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if best := bc.BestHeader(); !bytes.Equal(best.Hash, first.Hash) {
+		t.Errorf("BestHeader() after markInvalid() = %x, want %x", best.Hash, first.Hash)
+	}
+	child := newTestBlock(t, bc, second, coinbase(3), nil)
+	if err := bc.AddHeader(&child.BlockHeader); !errors.Is(err, ErrInvalidParent) {
+		t.Errorf("AddHeader() after an invalid parent = %v, want %v", err, ErrInvalidParent)
+	}
+	if blocks := bc.missingBlocks(); len(blocks) != 0 {
+		t.Errorf("missingBlocks() after markInvalid() = %v, want none", headerHeights(blocks))
+	}
+}
+
+// ロケーターは最も仕事量の多いヘッダーから間隔を広げながら初期ブロックまでを含み、
+// 相手はその中で最初に見つかったブロックの続きを返すか
+func TestHeaderLocator(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	addTestBlocks(t, bc, wallet, 15)
+
+	// 高さ15から6までの10個、その後は2、4、8個おき、最後に初期ブロック
+	var heights []int
+	for _, hash := range bc.headerLocator() {
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		heights = append(heights, header.Height)
+	}
+	if want := []int{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 4, 0}; !equalHeights(heights, want) {
+		t.Errorf("headerLocator() heights = %v, want %v", heights, want)
+	}
+
+	hashes := bc.GetBlockHashes() // 新しい順
+	unknown := []byte{1}
+	tests := []struct {
+		name    string
+		locator [][]byte
+		max     int
+		want    []int
+	}{
+		{"common block", [][]byte{unknown, hashes[10], hashes[15]}, maxHeadersSize, []int{6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+		{"max", [][]byte{hashes[10]}, 3, []int{6, 7, 8}},
+		{"up to date", [][]byte{hashes[0]}, maxHeadersSize, nil},
+		{"no common block", [][]byte{unknown}, 2, []int{0, 1}},
+	}
+	for _, test := range tests {
+		if heights := headerHeights(bc.headersAfter(test.locator, test.max)); !equalHeights(heights, test.want) {
+			t.Errorf("%s: headersAfter() = %v, want %v", test.name, heights, test.want)
+		}
+	}
+}
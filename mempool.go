@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// 未承認のトランザクションを保存するバケット（キーは受け付けた順の通し番号）
+// ノードの停止中やCLIのコマンド間でメモリプールを引き継ぐ
+const mempoolBucket = "mempool"
+
+// メモリプールの上限
+const (
+	maxMempoolSize = 1024 * 1024    // シリアライズしたトランザクションの合計バイト数
+	mempoolExpiry  = 72 * time.Hour // 承認されないまま保持する期間
+)
+
+// メモリプールに追加できない場合のエラー
+var (
+	ErrAlreadyInMempool = errors.New("メモリプールにすでにあります")
+	ErrMempoolConflict  = errors.New("メモリプールの他のトランザクションと同じ出力を使用しています")
+	ErrMempoolFull      = errors.New("メモリプールが上限に達しており、手数料が低いため追加できません")
+	ErrMempoolExpired   = errors.New("メモリプールの保持期間を過ぎています")
+)
+
+// メモリプールのトランザクション
+type mempoolEntry struct {
+	tx    *Transaction
+	size  int       // シリアライズしたバイト数
+	fee   int       // 手数料
+	added time.Time // 受け付けた時刻
+}
+
+// 手数料率がotherより低いか（同じ場合は古い方を低いとする）
+func (e *mempoolEntry) lessThan(other *mempoolEntry) bool {
+	if l, r := e.fee*other.size, other.fee*e.size; l != r {
+		return l < r
+	}
+	return e.added.Before(other.added)
+}
+
+// メモリプールに保存する形式
+type mempoolRecord struct {
+	Transaction *Transaction
+	Added       int64 // 受け付けた時刻（Unixタイム）
+}
+
+// メモリプールの統計情報
+type MempoolInfo struct {
+	Count   int // トランザクションの数
+	Size    int // シリアライズしたトランザクションの合計バイト数
+	MaxSize int // 合計バイト数の上限
+	Fees    int // 手数料の合計
+}
+
+// メモリプールのトランザクションの情報
+type MempoolTxInfo struct {
+	ID      []byte
+	Size    int
+	Fee     int
+	Time    int64    // 受け付けた時刻（Unixタイム）
+	Depends [][]byte // メモリプールにある親トランザクションのID
+}
+
+// 未承認のトランザクションの集合（メモリプール）
+// UTXOセットとメモリプールにある親トランザクションの出力を使用するトランザクションのみを受け付け、
+// 同じ出力を使用する複数のトランザクションは先に受け付けたものだけを保持する
+type Mempool struct {
+	bc      *Blockchain
+	MaxSize int           // 合計バイト数の上限
+	Expiry  time.Duration // 保持する期間
+
+	order   []*mempoolEntry          // 受け付けた順（親は必ず子より前）
+	entries map[string]*mempoolEntry // キーはトランザクションIDの16進数文字列
+	spent   map[string]*mempoolEntry // 使用済みの出力（"ID:インデックス"）と使用したトランザクション
+	size    int
+}
+
+// 空のメモリプールの生成
+func NewMempool(bc *Blockchain) *Mempool {
+	m := &Mempool{bc: bc, MaxSize: maxMempoolSize, Expiry: mempoolExpiry}
+	m.reset()
+	return m
+}
+
+func (m *Mempool) reset() {
+	m.order = nil
+	m.entries = make(map[string]*mempoolEntry)
+	m.spent = make(map[string]*mempoolEntry)
+	m.size = 0
+}
+
+// データベースに保存したメモリプールを読み込む
+// 承認済みや期限切れなど、現在のチェーンで受け付けられないトランザクションは捨てる
+func LoadMempool(bc *Blockchain) *Mempool {
+	m := NewMempool(bc)
+	var records []mempoolRecord
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mempoolBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record mempoolRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, record := range records {
+		m.add(record.Transaction, time.Unix(record.Added, 0))
+	}
+	return m
+}
+
+// メモリプールをデータベースに保存する
+func (m *Mempool) Save() {
+	err := m.bc.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(mempoolBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(mempoolBucket))
+		if err != nil {
+			return err
+		}
+		for i, entry := range m.order {
+			var buff bytes.Buffer
+			record := mempoolRecord{entry.tx, entry.added.Unix()}
+			if err := gob.NewEncoder(&buff).Encode(record); err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(i))
+			if err := b.Put(key, buff.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// トランザクションを検証して追加する
+func (m *Mempool) Add(tx *Transaction) error {
+	m.Expire(time.Now())
+	return m.add(tx, time.Now())
+}
+
+func (m *Mempool) add(tx *Transaction, added time.Time) error {
+	if tx.IsCoinbase() {
+		return errors.New("コインベースは受け付けません")
+	}
+	if m.Has(tx.ID) {
+		return ErrAlreadyInMempool
+	}
+	if time.Since(added) > m.Expiry {
+		return ErrMempoolExpired
+	}
+	for _, vin := range tx.Vin {
+		if spender := m.spent[outpointKey(vin.Txid, vin.Vout)]; spender != nil {
+			return fmt.Errorf("%w: %s (%x)", ErrMempoolConflict, outpointKey(vin.Txid, vin.Vout), spender.tx.ID)
+		}
+	}
+
+	// メモリプールにある祖先に続けて次のブロックに含められるかを検証する
+	parents := m.ancestors(tx)
+	transactions := make([]*Transaction, 0, len(parents)+1)
+	parentFees := 0
+	for _, parent := range parents {
+		transactions = append(transactions, parent.tx)
+		parentFees += parent.fee
+	}
+	fees, err := m.validate(append(transactions, tx))
+	if err != nil {
+		return err
+	}
+
+	entry := &mempoolEntry{tx, len(tx.Serialize()), fees - parentFees, added}
+	m.order = append(m.order, entry)
+	m.entries[hex.EncodeToString(tx.ID)] = entry
+	for _, vin := range tx.Vin {
+		m.spent[outpointKey(vin.Txid, vin.Vout)] = entry
+	}
+	m.size += entry.size
+
+	// 上限を超えた場合は手数料率の低いものから子孫とともに取り除く
+	for m.size > m.MaxSize {
+		lowest := m.order[0]
+		for _, e := range m.order[1:] {
+			if e.lessThan(lowest) {
+				lowest = e
+			}
+		}
+		m.remove(lowest)
+	}
+	if !m.Has(tx.ID) {
+		return ErrMempoolFull
+	}
+	return nil
+}
+
+// トランザクションが次のブロックに含められるかを検証し、手数料の合計を返す
+// 報酬を0とした仮のコインベースを先頭に置き、ブロックと同じ規則で検証する
+func (m *Mempool) validate(transactions []*Transaction) (int, error) {
+	if len(m.bc.tip) == 0 {
+		return 0, errors.New("ブロックチェーンにブロックがありません")
+	}
+	coinbase := &Transaction{nil, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{{0, nil}}, 0}
+	coinbase.SetID()
+	ancestors, err := m.bc.ancestors(m.bc.tip, medianTimeSpan)
+	if err != nil {
+		log.Panic(err)
+	}
+	return m.bc.validateTransactions(append([]*Transaction{coinbase}, transactions...),
+		m.bc.GetBestHeight()+1, medianTime(ancestors))
+}
+
+// メモリプールにあるtxの祖先（受け付けた順）
+func (m *Mempool) ancestors(tx *Transaction) []*mempoolEntry {
+	found := make(map[*mempoolEntry]bool)
+	queue := []*Transaction{tx}
+	for len(queue) > 0 {
+		for _, vin := range queue[0].Vin {
+			parent := m.entries[hex.EncodeToString(vin.Txid)]
+			if parent != nil && !found[parent] {
+				found[parent] = true
+				queue = append(queue, parent.tx)
+			}
+		}
+		queue = queue[1:]
+	}
+	var ancestors []*mempoolEntry
+	for _, entry := range m.order {
+		if found[entry] {
+			ancestors = append(ancestors, entry)
+		}
+	}
+	return ancestors
+}
+
+// トランザクションとその子孫を取り除く
+func (m *Mempool) remove(entry *mempoolEntry) {
+	removed := map[string]bool{hex.EncodeToString(entry.tx.ID): true}
+	old := m.order
+	m.reset()
+	for _, e := range old {
+		if !removed[hex.EncodeToString(e.tx.ID)] {
+			for _, vin := range e.tx.Vin {
+				if removed[hex.EncodeToString(vin.Txid)] {
+					removed[hex.EncodeToString(e.tx.ID)] = true
+					break
+				}
+			}
+		}
+		if removed[hex.EncodeToString(e.tx.ID)] {
+			continue
+		}
+		m.order = append(m.order, e)
+		m.entries[hex.EncodeToString(e.tx.ID)] = e
+		for _, vin := range e.tx.Vin {
+			m.spent[outpointKey(vin.Txid, vin.Vout)] = e
+		}
+		m.size += e.size
+	}
+}
+
+// 保持期間を過ぎたトランザクションを子孫とともに取り除き、取り除いた数を返す
+func (m *Mempool) Expire(now time.Time) int {
+	count := len(m.order)
+	// 再編成で戻したものがあるため、受け付けた順は時刻の順とは限らない
+	for _, e := range append([]*mempoolEntry{}, m.order...) {
+		if m.Has(e.tx.ID) && now.Sub(e.added) > m.Expiry {
+			m.remove(e)
+		}
+	}
+	return count - len(m.order)
+}
+
+// 最終ブロックが変わった後に、全てのトランザクションを検証し直す
+// 承認されたものや、ブロックのトランザクションと同じ出力を使用するものは取り除かれる
+// orphanedは再編成で切り離したブロックのトランザクションで、メモリプールの先頭に戻す
+func (m *Mempool) Update(orphaned []*Transaction) {
+	old := m.order
+	m.reset()
+	for _, tx := range orphaned {
+		m.add(tx, time.Now())
+	}
+	for _, e := range old {
+		m.add(e.tx, e.added)
+	}
+}
+
+// メモリプールにあるトランザクションか
+func (m *Mempool) Has(id []byte) bool {
+	return m.entries[hex.EncodeToString(id)] != nil
+}
+
+// IDからトランザクションを取得（ない場合はnil）
+func (m *Mempool) Get(id []byte) *Transaction {
+	if entry := m.entries[hex.EncodeToString(id)]; entry != nil {
+		return entry.tx
+	}
+	return nil
+}
+
+// 全てのトランザクション（受け付けた順）
+func (m *Mempool) Transactions() []*Transaction {
+	var transactions []*Transaction
+	for _, entry := range m.order {
+		transactions = append(transactions, entry.tx)
+	}
+	return transactions
+}
+
+// 次のブロックに含めるトランザクション
+// minerへのコインベースを先頭に、メモリプールの全てのトランザクションを親が子より前になるよう並べる
+func (m *Mempool) BlockTransactions(miner string) []*Transaction {
+	fees := 0
+	for _, entry := range m.order {
+		fees += entry.fee
+	}
+	cbTx := NewCoinbaseTX(miner, "", m.bc.GetBestHeight()+1, fees)
+	return append([]*Transaction{cbTx}, m.Transactions()...)
+}
+
+// メモリプールの統計情報
+func (m *Mempool) Info() MempoolInfo {
+	info := MempoolInfo{Count: len(m.order), Size: m.size, MaxSize: m.MaxSize}
+	for _, entry := range m.order {
+		info.Fees += entry.fee
+	}
+	return info
+}
+
+// 全てのトランザクションの情報（受け付けた順）
+func (m *Mempool) TxInfos() []MempoolTxInfo {
+	var infos []MempoolTxInfo
+	for _, entry := range m.order {
+		info := MempoolTxInfo{ID: entry.tx.ID, Size: entry.size, Fee: entry.fee, Time: entry.added.Unix()}
+		for _, vin := range entry.tx.Vin {
+			if m.Has(vin.Txid) {
+				info.Depends = append(info.Depends, vin.Txid)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// 支払可能なトランザクション出力の探索
+// UTXOセットの出力のうちメモリプールで使用済みのものを除き、メモリプールのトランザクションの未使用の出力を加える
+func (m *Mempool) FindSpendableOutputs(scriptPubKey []byte, amount int) (int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+	collect := func(txID []byte, outIdx int, out TXOutput) {
+		if bytes.Equal(out.ScriptPubKey, scriptPubKey) && accumulated < amount &&
+			m.spent[outpointKey(txID, outIdx)] == nil {
+			accumulated += out.Value
+			id := hex.EncodeToString(txID)
+			unspentOutputs[id] = append(unspentOutputs[id], outIdx)
+		}
+	}
+	// 次のブロックで使用できる出力のみを対象とする
+	height := m.bc.GetBestHeight() + 1
+	err := m.bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			outs := DeserializeOutputs(v)
+			if !outs.IsMature(height) {
+				return nil
+			}
+			for _, outIdx := range outs.sortedIndexes() {
+				collect(k, outIdx, outs.Outputs[outIdx])
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, entry := range m.order {
+		for outIdx, out := range entry.tx.Vout {
+			if !out.IsUnspendable() {
+				collect(entry.tx.ID, outIdx, out)
+			}
+		}
+	}
+	return accumulated, unspentOutputs
+}
+
+// トランザクションの入力に署名する
+// 参照先がメモリプールにある場合はそのトランザクションを使う
+func (m *Mempool) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := m.prevTransactions(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Sign(privKey, prevTXs)
+}
+
+// 入力が参照するトランザクションをメモリプールとチェーンから集める
+func (m *Mempool) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+	for inID, vin := range tx.Vin {
+		prevTx := m.Get(vin.Txid)
+		if prevTx == nil {
+			found, err := m.bc.FindTransaction(vin.Txid)
+			if err != nil {
+				return nil, fmt.Errorf("入力%d: %w", inID, err)
+			}
+			prevTx = &found
+		}
+		prevTXs[hex.EncodeToString(prevTx.ID)] = *prevTx
+	}
+	return prevTXs, nil
+}
+
+// 出力を表すキー
+func outpointKey(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
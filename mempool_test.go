@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// メモリプール用のブロックチェーン
+// 最初の2つのブロックのコインベースが次のブロックで使用可能になるまで採掘する
+func newTestMempool(t *testing.T) (*Mempool, *Wallet, []*Transaction) {
+	t.Helper()
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := addTestBlocks(t, bc, wallet, chainParams.CoinbaseMaturity+1)
+	return NewMempool(bc), wallet, []*Transaction{genesis.Transactions[0], blocks[0].Transactions[0]}
+}
+
+// 手数料feeを払ってprevの最初の出力を使用するトランザクション
+func newTestFeeSpend(t *testing.T, wallet *Wallet, prev *Transaction, fee int) *Transaction {
+	t.Helper()
+	return newTestSpend(t, wallet, prev, 0, prev.Vout[0].Value-fee, nil)
+}
+
+// UTXOセットと未承認の親の出力を使うトランザクションを受け付け、
+// 二重使用や検証に失敗するものは受け付けないか
+func TestMempoolAdd(t *testing.T) {
+	m, wallet, funding := newTestMempool(t)
+	parent := newTestFeeSpend(t, wallet, funding[0], 1)
+	child := newTestFeeSpend(t, wallet, parent, 2)
+	grandchild := newTestFeeSpend(t, wallet, child, 3)
+	for _, tx := range []*Transaction{parent, child, grandchild} {
+		if err := m.Add(tx); err != nil {
+			t.Fatalf("Add() = %v", err)
+		}
+	}
+	if info := m.Info(); info.Count != 3 || info.Fees != 6 {
+		t.Errorf("Info() = %+v, want 3 transactions with fees 6", info)
+	}
+	if infos := m.TxInfos(); len(infos[2].Depends) != 1 || !bytes.Equal(infos[2].Depends[0], child.ID) {
+		t.Errorf("TxInfos()[2].Depends = %x, want the child", infos[2].Depends)
+	}
+
+	unknown := &Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}},
+		[]TXOutput{*NewTXOutput(10, string(wallet.GetAddress()))}, 0}
+	immature, err := m.bc.GetBlock(m.bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tx   *Transaction
+		err  error
+	}{
+		{"already in mempool", child, ErrAlreadyInMempool},
+		{"conflict", newTestFeeSpend(t, wallet, funding[0], 2), ErrMempoolConflict},
+		{"conflict with a parent", newTestFeeSpend(t, wallet, parent, 1), ErrMempoolConflict},
+		{"missing input", newTestFeeSpend(t, wallet, unknown, 1), ErrMissingInput},
+		{"insufficient input", newTestFeeSpend(t, wallet, funding[1], -1), ErrInsufficientInput},
+		{"immature coinbase", newTestFeeSpend(t, wallet, immature.Transactions[0], 1), ErrImmatureCoinbase},
+	}
+	for _, test := range tests {
+		if err := m.Add(test.tx); !errors.Is(err, test.err) {
+			t.Errorf("%s: Add() = %v, want %v", test.name, err, test.err)
+		}
+	}
+	if info := m.Info(); info.Count != 3 {
+		t.Errorf("Info().Count = %d after rejected transactions, want 3", info.Count)
+	}
+}
+
+// 上限を超えた場合は手数料率の低いものから子孫とともに取り除き、
+// 追加したものが取り除かれた場合はErrMempoolFullを返すか
+func TestMempoolFull(t *testing.T) {
+	m, wallet, funding := newTestMempool(t)
+	parent := newTestFeeSpend(t, wallet, funding[0], 1)
+	child := newTestFeeSpend(t, wallet, parent, 1)
+	for _, tx := range []*Transaction{parent, child} {
+		if err := m.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.MaxSize = m.Info().Size
+
+	low := newTestFeeSpend(t, wallet, funding[1], 0)
+	if err := m.Add(low); err != ErrMempoolFull {
+		t.Errorf("Add() with the lowest fee rate = %v, want ErrMempoolFull", err)
+	}
+	if m.Has(low.ID) || !m.Has(parent.ID) || !m.Has(child.ID) {
+		t.Error("a transaction other than the lowest fee rate was evicted")
+	}
+
+	// 手数料率の高いものを受け付けると、最も低い親が子とともに取り除かれる
+	high := newTestFeeSpend(t, wallet, funding[1], 5)
+	if err := m.Add(high); err != nil {
+		t.Fatalf("Add() with a high fee rate = %v", err)
+	}
+	if !m.Has(high.ID) || m.Has(parent.ID) || m.Has(child.ID) {
+		t.Errorf("Transactions() = %x, want only the high fee transaction", m.TxInfos())
+	}
+	if info := m.Info(); info.Size > m.MaxSize || m.spent[outpointKey(funding[0].ID, 0)] != nil {
+		t.Errorf("Info() = %+v, evicted outputs still spent %v", info, m.spent[outpointKey(funding[0].ID, 0)] != nil)
+	}
+}
+
+// ブロックの追加後に、承認されたものとブロックと同じ出力を使うものを取り除き、
+// 承認された親を持つ子は残すか
+func TestMempoolUpdate(t *testing.T) {
+	m, wallet, funding := newTestMempool(t)
+	confirmed := newTestFeeSpend(t, wallet, funding[0], 1)
+	child := newTestFeeSpend(t, wallet, confirmed, 1)
+	conflict := newTestFeeSpend(t, wallet, funding[1], 1)
+	for _, tx := range []*Transaction{confirmed, child, conflict} {
+		if err := m.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addTestBlocks(t, m.bc, wallet, 1, confirmed, newTestFeeSpend(t, wallet, funding[1], 2))
+	m.Update(nil)
+	if m.Has(confirmed.ID) || m.Has(conflict.ID) || !m.Has(child.ID) {
+		t.Errorf("Transactions() after Update() = %x, want only the child", m.TxInfos())
+	}
+	if infos := m.TxInfos(); len(infos) != 1 || len(infos[0].Depends) != 0 {
+		t.Errorf("TxInfos() = %+v, want the child without dependencies", infos)
+	}
+
+	// 保存したメモリプールを読み込み直せる
+	m.Save()
+	if loaded := LoadMempool(m.bc); !loaded.Has(child.ID) || loaded.Info().Count != 1 {
+		t.Errorf("LoadMempool() = %x, want the child", loaded.TxInfos())
+	}
+}
+
+// 期限切れのトランザクションとその子孫のみを取り除き、使用済みの出力も解放するか
+func TestMempoolExpire(t *testing.T) {
+	m, wallet, funding := newTestMempool(t)
+	now := time.Now()
+	expiring := now.Add(-m.Expiry + time.Minute)
+	old := newTestFeeSpend(t, wallet, funding[0], 1)
+	child := newTestFeeSpend(t, wallet, old, 1)
+	grandchild := newTestFeeSpend(t, wallet, child, 1)
+	other := newTestFeeSpend(t, wallet, funding[1], 1)
+	if err := m.add(old, expiring); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*Transaction{child, grandchild, other} {
+		if err := m.add(tx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed := m.Expire(now.Add(2 * time.Minute)); removed != 3 {
+		t.Errorf("Expire() = %d, want 3", removed)
+	}
+	if m.Has(old.ID) || m.Has(child.ID) || m.Has(grandchild.ID) || !m.Has(other.ID) {
+		t.Errorf("Transactions() = %x, want only %x", m.TxInfos(), other.ID)
+	}
+	if info := m.Info(); info.Count != 1 || info.Size != len(other.Serialize()) {
+		t.Errorf("Info() = %+v, want 1 transaction of %d bytes", info, len(other.Serialize()))
+	}
+	if m.spent[outpointKey(funding[0].ID, 0)] != nil {
+		t.Errorf("output spent by an expired transaction is still marked as spent")
+	}
+}
+
+// 手数料率の比較（同じ場合は古い方を低いとする）
+func TestMempoolEntryLessThan(t *testing.T) {
+	now := time.Now()
+	low := &mempoolEntry{fee: 1, size: 200, added: now}
+	high := &mempoolEntry{fee: 1, size: 100, added: now}
+	older := &mempoolEntry{fee: 2, size: 200, added: now.Add(-time.Second)}
+	if !low.lessThan(high) || high.lessThan(low) {
+		t.Errorf("fee rate 1/200 should be lower than 1/100")
+	}
+	if !older.lessThan(high) || high.lessThan(older) {
+		t.Errorf("the older entry should be lower when fee rates are equal")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// マークルツリー
+type MerkleTree struct {
+	RootNode *MerkleNode     // ルートノード
+	levels   [][]*MerkleNode // 葉からルートまでの各段のノード
+}
+
+// マークルツリーのノード
+type MerkleNode struct {
+	Left  *MerkleNode // 左の子ノード
+	Right *MerkleNode // 右の子ノード
+	Data  []byte      // ハッシュ値
+}
+
+// マークルプルーフの1段分
+type MerkleProofStep struct {
+	Hash []byte // 兄弟ノードのハッシュ値
+	Left bool   // 兄弟ノードが左側にあるか
+}
+
+// トランザクションがブロックに含まれることの証明
+// 葉からルートまでの兄弟ノードを順に並べたもの
+type MerkleProof []MerkleProofStep
+
+// 葉と内部ノードのハッシュ値を区別するために先頭に付けるバイト
+// 内部ノードのハッシュ値をトランザクションIDと偽ってプルーフを作れないようにする
+const (
+	merkleLeafPrefix     = 0x00
+	merkleInteriorPrefix = 0x01
+)
+
+// 葉のハッシュ値
+func merkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return hash[:]
+}
+
+// 左右の子のハッシュ値から内部ノードのハッシュ値を求める
+func merkleInteriorHash(left, right []byte) []byte {
+	joined := append(append([]byte{merkleInteriorPrefix}, left...), right...)
+	hash := sha256.Sum256(joined)
+	return hash[:]
+}
+
+// ノードの生成
+// 葉の場合はdataのハッシュ値、それ以外は左右の子を連結したハッシュ値を持つ
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	mNode := MerkleNode{}
+	if left == nil && right == nil {
+		mNode.Data = merkleLeafHash(data)
+	} else {
+		mNode.Data = merkleInteriorHash(left.Data, right.Data)
+	}
+	mNode.Left = left
+	mNode.Right = right
+	return &mNode
+}
+
+// 葉のデータ（トランザクションID）の並びからマークルツリーを生成
+// 各段でノードが奇数個の場合は最後のノードを複製する
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	tree := MerkleTree{}
+	if len(data) == 0 {
+		hash := sha256.Sum256([]byte{})
+		tree.RootNode = NewMerkleNode(nil, nil, hash[:])
+		return &tree
+	}
+
+	var nodes []*MerkleNode
+	for _, datum := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, datum))
+	}
+	for {
+		if len(nodes)%2 != 0 && len(nodes) > 1 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+		tree.levels = append(tree.levels, nodes)
+		if len(nodes) == 1 {
+			break
+		}
+		var level []*MerkleNode
+		for j := 0; j < len(nodes); j += 2 {
+			level = append(level, NewMerkleNode(nodes[j], nodes[j+1], nil))
+		}
+		nodes = level
+	}
+	tree.RootNode = nodes[0]
+	return &tree
+}
+
+// 葉のデータに対するマークルプルーフを生成
+func (t *MerkleTree) Proof(datum []byte) (MerkleProof, error) {
+	if len(t.levels) == 0 {
+		return nil, errors.New("マークルツリーが空です")
+	}
+	leaf := merkleLeafHash(datum)
+	index := -1
+	for i, node := range t.levels[0] {
+		if bytes.Equal(node.Data, leaf) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("指定したデータはマークルツリーに含まれていません")
+	}
+
+	var proof MerkleProof
+	// 各段で兄弟ノードを記録しながらルートへ向かう
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if index%2 == 0 {
+			proof = append(proof, MerkleProofStep{level[index+1].Data, false})
+		} else {
+			proof = append(proof, MerkleProofStep{level[index-1].Data, true})
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// マークルプルーフの検証
+// txidの葉のハッシュ値からプルーフに従ってハッシュを求め、rootと一致するかを確認
+func VerifyMerkleProof(root, txid []byte, proof MerkleProof) bool {
+	hash := merkleLeafHash(txid)
+	for _, step := range proof {
+		if step.Left {
+			hash = merkleInteriorHash(step.Hash, hash)
+		} else {
+			hash = merkleInteriorHash(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
+
+// マークルプルーフのシリアライゼーション
+// 各段を 位置（1バイト、左=1）+ ハッシュ値（32バイト）で連結
+func (p MerkleProof) Serialize() []byte {
+	var result []byte
+	for _, step := range p {
+		side := byte(0)
+		if step.Left {
+			side = 1
+		}
+		result = append(result, side)
+		result = append(result, step.Hash...)
+	}
+	return result
+}
+
+// マークルプルーフのデシリアライゼーション
+func DeserializeMerkleProof(data []byte) (MerkleProof, error) {
+	const stepLen = 1 + sha256.Size
+	if len(data)%stepLen != 0 {
+		return nil, errors.New("マークルプルーフの長さが正しくありません")
+	}
+	var proof MerkleProof
+	for i := 0; i < len(data); i += stepLen {
+		if data[i] > 1 {
+			return nil, errors.New("マークルプルーフの形式が正しくありません")
+		}
+		proof = append(proof, MerkleProofStep{data[i+1 : i+stepLen], data[i] == 1})
+	}
+	return proof, nil
+}
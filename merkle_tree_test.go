@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+// 葉の数を変えて、全ての葉のプルーフが検証できるか
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var data [][]byte
+		for i := 0; i < n; i++ {
+			hash := sha256.Sum256([]byte(fmt.Sprintf("tx%d", i)))
+			data = append(data, hash[:])
+		}
+		tree := NewMerkleTree(data)
+		root := tree.RootNode.Data
+		for i, datum := range data {
+			proof, err := tree.Proof(datum)
+			if err != nil {
+				t.Fatalf("n=%d i=%d: %v", n, i, err)
+			}
+			decoded, err := DeserializeMerkleProof(proof.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(root, datum, decoded) {
+				t.Errorf("n=%d i=%d: proof is not valid", n, i)
+			}
+			other := sha256.Sum256([]byte("other"))
+			if VerifyMerkleProof(root, other[:], decoded) {
+				t.Errorf("n=%d i=%d: proof is valid for another txid", n, i)
+			}
+		}
+	}
+}
+
+// 内部ノードのハッシュ値や、空のプルーフでルート自体を示しても検証に失敗するか
+func TestVerifyMerkleProofRejectsInteriorNode(t *testing.T) {
+	var data [][]byte
+	for i := 0; i < 4; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("tx%d", i)))
+		data = append(data, hash[:])
+	}
+	tree := NewMerkleTree(data)
+	root := tree.RootNode.Data
+	left, right := tree.RootNode.Left, tree.RootNode.Right
+
+	if VerifyMerkleProof(root, left.Data, MerkleProof{{right.Data, false}}) {
+		t.Error("proof is valid for an interior node")
+	}
+	if VerifyMerkleProof(root, root, nil) {
+		t.Error("empty proof is valid for the root")
+	}
+}
+
+// 2つの葉のルートが、葉と内部ノードを区別したハッシュ値になるか
+func TestNewMerkleTree(t *testing.T) {
+	left := sha256.Sum256([]byte("left"))
+	right := sha256.Sum256([]byte("right"))
+	tree := NewMerkleTree([][]byte{left[:], right[:]})
+	leftLeaf := sha256.Sum256(append([]byte{0}, left[:]...))
+	rightLeaf := sha256.Sum256(append([]byte{0}, right[:]...))
+	want := sha256.Sum256(append(append([]byte{1}, leftLeaf[:]...), rightLeaf[:]...))
+	if fmt.Sprintf("%x", tree.RootNode.Data) != fmt.Sprintf("%x", want) {
+		t.Errorf("root = %x, want %x", tree.RootNode.Data, want)
+	}
+}
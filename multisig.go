@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// redeemスクリプトをウォレットに追加し、そのP2SHアドレスを返す
+// 追加したアドレスへの支払いはsigntxで署名できるようになる
+func (ws *Wallets) AddScript(script []byte) string {
+	address := ScriptHashAddress(script)
+	ws.scripts[address] = script
+	return address
+}
+
+// P2SHアドレスのredeemスクリプト
+func (ws Wallets) GetScript(address string) ([]byte, bool) {
+	script, ok := ws.scripts[address]
+	return script, ok
+}
+
+// 公開鍵に対応するウォレット（持っていない場合やロック中はnil）
+func (ws Wallets) walletForPubKey(pubKey []byte) *Wallet {
+	address := string(encodeAddress(version, HashPubKey(pubKey)))
+	return ws.Wallets[address]
+}
+
+// 公開鍵（16進数）またはウォレット内のアドレスの並びから
+// M-of-Nマルチシグのredeemスクリプトを作成
+func (ws Wallets) NewMultisigScript(m int, keys []string) ([]byte, error) {
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if ValidateAddress(key) {
+			wallet, err := ws.GetWallet(key)
+			if err != nil {
+				return nil, err
+			}
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if err != nil || len(pubKey) != 64 {
+			return nil, fmt.Errorf("'%s'は公開鍵またはウォレット内のアドレスではありません", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return NewMultisigScript(m, pubKeys)
+}
+
+// トランザクションの入力にウォレットの鍵で署名する
+// P2PKHの入力と、redeemスクリプトが分かるP2SHマルチシグの入力に署名し、
+// 他の署名者がすでに付けた署名は保持する
+// 全ての入力の検証が通る（署名が揃った）場合にtrueを返す
+func (ws Wallets) SignTransaction(tx *Transaction, prevTXs map[string]Transaction) (bool, error) {
+	if tx.IsCoinbase() {
+		return true, nil
+	}
+	for inID, vin := range tx.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return false, fmt.Errorf("入力%d: 参照先の出力が見つかりません", inID)
+		}
+		scriptPubKey := prevTx.Vout[vin.Vout].ScriptPubKey
+
+		switch ClassifyScript(scriptPubKey) {
+		case ScriptPubKeyHash:
+			address := ScriptAddresses(scriptPubKey)[0]
+			wallet, ok := ws.Wallets[address]
+			if !ok {
+				continue // 他の署名者の鍵
+			}
+			signature := signHash(wallet.PrivateKey, tx.SignatureHash(inID, scriptPubKey))
+			tx.Vin[inID].ScriptSig = append(pushData(signature), pushData(wallet.PublicKey)...)
+		case ScriptScriptHash:
+			scriptSig, err := ws.signMultisig(tx, inID, scriptPubKey)
+			if err != nil {
+				return false, fmt.Errorf("入力%d: %w", inID, err)
+			}
+			tx.Vin[inID].ScriptSig = scriptSig
+		default:
+			return false, fmt.Errorf("入力%d: 署名できない種類の出力です", inID)
+		}
+	}
+	tx.SetID()
+	return tx.Verify(prevTXs), nil
+}
+
+// P2SHマルチシグの入力のScriptSigを作成
+// ScriptSig: OP_0 <署名1> ... <署名M> <redeemスクリプト>
+// 既存の署名とウォレットの鍵による署名を、公開鍵の順に最大M個並べる
+func (ws Wallets) signMultisig(tx *Transaction, inID int, scriptPubKey []byte) ([]byte, error) {
+	scriptHash := ExtractScriptHash(scriptPubKey)
+	ops, _ := parseScript(tx.Vin[inID].ScriptSig)
+
+	// redeemスクリプトはウォレットから、なければ他の署名者のScriptSigから得る
+	redeemScript, ok := ws.GetScript(ScriptAddresses(scriptPubKey)[0])
+	if !ok && len(ops) > 0 {
+		last := ops[len(ops)-1].data
+		if bytes.Equal(HashPubKey(last), scriptHash) {
+			redeemScript = last
+		}
+	}
+	if redeemScript == nil {
+		return nil, errors.New("redeemスクリプトが分かりません。createmultisigで追加してください")
+	}
+	m, pubKeys, ok := ExtractMultisig(redeemScript)
+	if !ok {
+		return nil, errors.New("マルチシグ以外のredeemスクリプトには署名できません")
+	}
+
+	// 既存の署名（先頭のダミーと最後のredeemスクリプトを除く）
+	var existing [][]byte
+	if len(ops) >= 2 {
+		for _, op := range ops[1 : len(ops)-1] {
+			existing = append(existing, op.data)
+		}
+	}
+
+	hash := tx.SignatureHash(inID, redeemScript)
+	var sigs [][]byte
+	for _, pubKey := range pubKeys {
+		if len(sigs) == m {
+			break
+		}
+		found := false
+		for _, sig := range existing {
+			if verifySignature(pubKey, hash, sig) {
+				sigs = append(sigs, sig)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if wallet := ws.walletForPubKey(pubKey); wallet != nil {
+			sigs = append(sigs, signHash(wallet.PrivateKey, hash))
+		}
+	}
+
+	return multisigScriptSig(sigs, redeemScript), nil
+}
+
+// 署名とredeemスクリプトからP2SHマルチシグのScriptSigを組み立てる
+func multisigScriptSig(sigs [][]byte, redeemScript []byte) []byte {
+	scriptSig := []byte{OP_0} // OP_CHECKMULTISIGのダミー要素
+	for _, sig := range sigs {
+		scriptSig = append(scriptSig, pushData(sig)...)
+	}
+	return append(scriptSig, pushData(redeemScript)...)
+}
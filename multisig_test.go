@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// 鍵を1つだけ持つ署名者のウォレット
+func newSignerWallets(wallet *Wallet) *Wallets {
+	ws := &Wallets{
+		Wallets: make(map[string]*Wallet),
+		scripts: make(map[string][]byte),
+	}
+	ws.AddWallet(wallet)
+	return ws
+}
+
+// 2-of-3マルチシグを署名者ごとに部分署名して完成させる
+func TestSignTransactionMultisig(t *testing.T) {
+	keys := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	var pubKeys []string
+	for _, key := range keys {
+		pubKeys = append(pubKeys, hex.EncodeToString(key.PublicKey))
+	}
+
+	var signers []*Wallets
+	var address string
+	for _, key := range keys {
+		ws := newSignerWallets(key)
+		redeemScript, err := ws.NewMultisigScript(2, pubKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		address = ws.AddScript(redeemScript)
+		signers = append(signers, ws)
+	}
+
+	scriptPubKey, err := PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTx := Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{{10, scriptPubKey}}, 0}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+	tx := &Transaction{nil, []TXInput{{prevTx.ID, 0, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(9, address)}, 0}
+
+	// 1人目の署名だけでは完成しない
+	complete, err := signers[2].SignTransaction(tx, prevTXs)
+	if err != nil || complete {
+		t.Fatalf("SignTransaction() = %v, %v, want incomplete", complete, err)
+	}
+	// redeemスクリプトを知らない署名者もScriptSigから署名できる
+	other := newSignerWallets(keys[0])
+	complete, err = other.SignTransaction(tx, prevTXs)
+	if err != nil || !complete {
+		t.Fatalf("SignTransaction() = %v, %v, want complete", complete, err)
+	}
+	if err := tx.VerifyScripts([]TXOutput{prevTx.Vout[0]}); err != nil {
+		t.Errorf("VerifyScripts() = %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// ブロックチェーンのパラメータを格納するバケット
+const paramsBucket = "params"
+
+// ブロックチェーンの作成時に選べる規則
+// 全てのノードが同じ値を使う必要があるため、作成時にデータベースに保存し、
+// 以降は保存した値を使う
+type ChainParams struct {
+	SubsidyHalvingInterval int // 採掘報酬が半減するまでのブロック数
+	CoinbaseMaturity       int // コインベースの出力が使用可能になるまでに必要なブロック数
+}
+
+// 既定のパラメータ
+var defaultChainParams = ChainParams{
+	SubsidyHalvingInterval: 50,
+	CoinbaseMaturity:       10,
+}
+
+// 使用中のパラメータ
+// ブロックチェーンを開くとデータベースに保存された値に置き換わる
+var chainParams = defaultChainParams
+
+// パラメータが有効な範囲か
+func (p ChainParams) Validate() error {
+	if p.SubsidyHalvingInterval <= 0 {
+		return errors.New("採掘報酬が半減するまでのブロック数は1以上にしてください")
+	}
+	if p.CoinbaseMaturity < 0 {
+		return errors.New("コインベースの成熟に必要なブロック数は0以上にしてください")
+	}
+	return nil
+}
+
+// データベースのキーとパラメータ
+func (p *ChainParams) fields() map[string]*int {
+	return map[string]*int{
+		"halving":  &p.SubsidyHalvingInterval,
+		"maturity": &p.CoinbaseMaturity,
+	}
+}
+
+// データベースに保存されたパラメータを使用中のパラメータとする
+// 保存されていないもの（作成時や以前のデータベース）は使用中の値を保存する
+func initChainParams(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(paramsBucket))
+	if err != nil {
+		return err
+	}
+	for name, value := range chainParams.fields() {
+		stored := b.Get([]byte(name))
+		if stored == nil {
+			if err := b.Put([]byte(name), []byte(strconv.Itoa(*value))); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := strconv.Atoi(string(stored))
+		if err != nil {
+			return err
+		}
+		*value = n
+	}
+	return nil
+}
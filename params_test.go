@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// 作成時のパラメータがデータベースに保存され、開き直したときに使われるか
+func TestChainParamsStored(t *testing.T) {
+	defer func(params ChainParams) { chainParams = params }(chainParams)
+	custom := ChainParams{SubsidyHalvingInterval: 7, CoinbaseMaturity: 0}
+	chainParams = custom
+	bc, _ := newTestChain(t)
+	bc.db.Close()
+
+	chainParams = defaultChainParams
+	bc = NewBlockchain("")
+	defer bc.db.Close()
+	if chainParams != custom {
+		t.Errorf("chainParams = %+v, want %+v", chainParams, custom)
+	}
+}
+
+// 範囲外のパラメータを受け付けないか
+func TestChainParamsValidate(t *testing.T) {
+	tests := []struct {
+		params ChainParams
+		ok     bool
+	}{
+		{defaultChainParams, true},
+		{ChainParams{1, 0}, true},
+		{ChainParams{0, 10}, false},
+		{ChainParams{50, -1}, false},
+	}
+	for _, test := range tests {
+		if err := test.params.Validate(); (err == nil) != test.ok {
+			t.Errorf("Validate() of %+v = %v, want ok=%v", test.params, err, test.ok)
+		}
+	}
+}
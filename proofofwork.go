@@ -2,87 +2,307 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Int64の最大値
 var maxNonce = math.MaxInt64
 
-// マイニング難易度
+// 初期ブロックのマイニング難易度
 // 先頭何ビットが0となるようなnonceを採掘
 const targetBits = 8
 
+// 初期ブロックのターゲットのcompact表現
+var initialBits = BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-targetBits))
+
+// 最も易しいターゲット（先頭4ビットが0）
+var powLimit = new(big.Int).Lsh(big.NewInt(1), 256-4)
+
+// 難易度を調整するブロックの間隔
+const retargetInterval = 10
+
+// 目標とするブロックの生成間隔（秒）
+const targetBlockSpacing = 10
+
+// retargetInterval個のブロックの生成にかける目標時間（秒）
+const targetTimespan = retargetInterval * targetBlockSpacing
+
 // 要import math/big
 type ProofOfWork struct {
-	block  *Block
+	header *BlockHeader
 	target *big.Int
+
+	Threads          int                  // 採掘に使うゴルーチン数（0以下ならCPU数）
+	OnProgress       func(MiningProgress) // 採掘状況の通知先（nilなら通知しない）
+	ProgressInterval time.Duration        // 採掘状況を通知する間隔
+}
+
+// 採掘の進捗状況
+type MiningProgress struct {
+	Hashes  uint64        // これまでに計算したハッシュの数
+	Elapsed time.Duration // 採掘開始からの経過時間
+}
+
+// 1秒あたりのハッシュ計算数
+func (p MiningProgress) HashRate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Hashes) / p.Elapsed.Seconds()
 }
 
+// 採掘に使うゴルーチン数（generate、createblockchain、broadcasttx、startnodeの-threadsで指定、0ならCPU数）
+var miningThreads = 0
+
+// 採掘状況の既定の通知間隔
+const defaultProgressInterval = time.Second
+
 // PoWの生成
-func NewProofOfWork(b *Block) *ProofOfWork {
-	// 1をbig.Int型に変換
-	target := big.NewInt(1)
-	// 256からtargetBits引いた分だけ左算術シフト
-	target.Lsh(target, uint(256-targetBits))
+// PoWの対象はブロックヘッダーのみ
+func NewProofOfWork(h *BlockHeader) *ProofOfWork {
+	// ブロック自身の難易度からターゲットを求める
+	target := CompactToBig(h.Bits)
 
 	// ProofOfWorkの構造体を生成し、
 	// そのポインタをpowに代入
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{h, target, miningThreads, nil, defaultProgressInterval}
 	return pow
 }
 
-// nonceを代入してPoW比較対象の元データを作成
-func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	// 前ブロックのハッシュ、タイムスタンプ、データ、
-	// マイニング難易度とnonceを連結したバイト配列の生成
-	data := bytes.Join( //2次元バイト配列を連結し一つのバイト配列に
+// nonce以外のPoW比較対象の元データ
+func (pow *ProofOfWork) prepareHeader() []byte {
+	// 前ブロックのハッシュ、マークルルート、タイムスタンプ、
+	// マイニング難易度、高さを連結したバイト配列の生成
+	return bytes.Join( //2次元バイト配列を連結し一つのバイト配列に
 		[][]byte{
-			pow.block.PrevBlockHash,
+			pow.header.PrevBlockHash,
 			//pow.block.Data,
-			pow.block.HashTransactions(), // 追加
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
-			IntToHex(int64(nonce)),
+			pow.header.MerkleRoot,
+			IntToHex(pow.header.Timestamp),
+			IntToHex(int64(pow.header.Bits)),
+			IntToHex(int64(pow.header.Height)),
 		},
 		[]byte{}, // 区切りデータ（空データ）
 	)
-	return data
 }
 
+// nonceを代入してPoW比較対象の元データを作成
+func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return append(pow.prepareHeader(), IntToHex(int64(nonce))...)
+}
+
+// 採掘が中断された場合のエラー
+type MiningCancelledError struct {
+	Cause error // context.Canceled または context.DeadlineExceeded
+}
+
+func (e *MiningCancelledError) Error() string {
+	return fmt.Sprintf("採掘が中断されました: %v", e.Cause)
+}
+
+func (e *MiningCancelledError) Unwrap() error {
+	return e.Cause
+}
+
+// 全てのnonceを試しても見つからなかった場合のエラー
+var ErrNonceExhausted = errors.New("条件を満たすnonceが見つかりません")
+
 // PoW作業
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int // big.Int型のハッシュ
-	var hash [32]byte   // バイト配列のハッシュ
-	nonce := 0
-
-	fmt.Printf("ブロックの採掘 データ＝ \"%s\"\n", pow.block.Transactions)
-
-	for nonce < maxNonce { // ０から最大値まで繰り返す
-		data := pow.prepareData(nonce)                // nonceを含めたデータの結合
-		hash = sha256.Sum256(data)                    // 結合データのハッシュ値算出(32バイト)
-		fmt.Printf("\rnonce=%d:hash=%x", nonce, hash) // ハッシュ値出力（同一行に上書き出力）
-		hashInt.SetBytes(hash[:])                     // バイト配列で値を代入
-		if hashInt.Cmp(pow.target) == -1 {            // ハッシュ値とtargetを比較
-			break // ハッシュ値の方が小さい場合終了
-		} else {
-			nonce++ // ハッシュ値の方が大きい場合次の数にトライ
+	nonce, hash, err := pow.RunContext(context.Background())
+	if err != nil {
+		log.Panic(err)
+	}
+	return nonce, hash
+}
+
+// 中断可能なPoW作業
+// nonceの範囲をThreads個のゴルーチンで分担して探索し、
+// いずれかが見つけた時点、またはctxが終了した時点で全てのゴルーチンを終了する
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	threads := pow.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	header := pow.prepareHeader() // 全てのnonceで共通のデータ
+
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+	solutions := make(chan solution, threads)
+	var found int32   // 見つかった場合、または中断した場合に1
+	var hashes uint64 // 全ゴルーチンで計算したハッシュの数
+	var wg sync.WaitGroup
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		// i番目のゴルーチンは i, i+threads, i+2*threads, ... を探索
+		go func(start int) {
+			defer wg.Done()
+			var hashInt big.Int
+			data := make([]byte, len(header)+8)
+			copy(data, header)
+			count := uint64(0)
+			for nonce := start; nonce < maxNonce; nonce += threads {
+				// 一定回数ごとに集計し、他のゴルーチンが見つけていないか確認
+				count++
+				if count%1024 == 0 {
+					atomic.AddUint64(&hashes, 1024)
+					if atomic.LoadInt32(&found) != 0 {
+						return
+					}
+				}
+				// nonceをビッグエンディアンで末尾に書き込む（IntToHexと同じ）
+				binary.BigEndian.PutUint64(data[len(header):], uint64(nonce))
+				hash := sha256.Sum256(data)
+				hashInt.SetBytes(hash[:])
+				if hashInt.Cmp(pow.target) == -1 {
+					if atomic.CompareAndSwapInt32(&found, 0, 1) {
+						solutions <- solution{nonce, hash[:]}
+					}
+					return
+				}
+				if nonce > maxNonce-threads {
+					return // これ以上増やすと桁あふれする
+				}
+			}
+		}(i)
+	}
+	// 全ゴルーチンが終了したら結果のチャネルを閉じる
+	go func() {
+		wg.Wait()
+		close(solutions)
+	}()
+
+	// 一定間隔で採掘状況を通知
+	startTime := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	if pow.OnProgress != nil && pow.ProgressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(pow.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					pow.OnProgress(MiningProgress{
+						atomic.LoadUint64(&hashes), time.Since(startTime)})
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case result, ok := <-solutions:
+		if !ok {
+			return 0, nil, ErrNonceExhausted
 		}
+		return result.nonce, result.hash, nil
+	case <-ctx.Done():
+		// 全てのゴルーチンを停止させ、終了を待つ
+		atomic.StoreInt32(&found, 1)
+		for range solutions {
+		}
+		return 0, nil, &MiningCancelledError{ctx.Err()}
 	}
-	fmt.Print("\n\n")
-	return nonce, hash[:]
 }
 
 // PoWのブロックの検証
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int // big.Int型の変数
 	//
-	data := pow.prepareData(pow.block.Nonce)
+	data := pow.prepareData(pow.header.Nonce)
 	hash := sha256.Sum256(data) // ハッシュ値を求める
 	hashInt.SetBytes(hash[:])   // big.Intにハッシュ値を代入
 	// 基準値よりも低ければtrue, そうだなければfalse
 	isValid := hashInt.Cmp(pow.target) == -1
 	return isValid
 }
+
+// compact表現（上位1バイトが指数、下位3バイトが仮数）をターゲットに変換
+// ターゲット = 仮数 * 256^(指数-3)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+	// 符号ビットが立っている場合は負の値
+	if compact&0x00800000 != 0 {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// ターゲットをcompact表現に変換
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Rsh(n, 8*(exponent-3))
+		mantissa = uint32(tn.Uint64())
+	}
+	// 仮数の最上位ビットは符号を表すので、立つ場合は1バイトずらす
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
+
+// 難易度の再調整
+// 直前のretargetInterval個のブロックにかかった時間から新しいターゲットを求める
+// 急激な変化を防ぐため、変化の幅は4倍までに制限する
+func CalculateNextBits(bits uint32, actualTimespan int64) uint32 {
+	if actualTimespan < targetTimespan/4 {
+		actualTimespan = targetTimespan / 4
+	}
+	if actualTimespan > targetTimespan*4 {
+		actualTimespan = targetTimespan * 4
+	}
+	// 新しいターゲット = 古いターゲット * 実際の時間 / 目標時間
+	newTarget := CompactToBig(bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+	return BigToCompact(newTarget)
+}
+
+// ブロック1つ分の仕事量（ターゲット以下のハッシュ値を見つけるのに必要な計算回数の期待値）
+// 仕事量 = 2^256 / (ターゲット + 1)
+func CalculateWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
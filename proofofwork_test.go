@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// compact表現との相互変換
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x20010000, "100000000000000000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+	}
+	for _, test := range tests {
+		target := CompactToBig(test.compact)
+		if target.Text(16) != test.target {
+			t.Errorf("CompactToBig(%08x) = %s, want %s", test.compact, target.Text(16), test.target)
+		}
+		if compact := BigToCompact(target); compact != test.compact {
+			t.Errorf("BigToCompact(%s) = %08x, want %08x", test.target, compact, test.compact)
+		}
+	}
+}
+
+// 難易度の再調整と4倍の制限
+func TestCalculateNextBits(t *testing.T) {
+	bits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 240))
+	target := CompactToBig(bits)
+
+	tests := []struct {
+		timespan int64
+		factor   *big.Rat // 新しいターゲット / 古いターゲット
+	}{
+		{targetTimespan, big.NewRat(1, 1)},
+		{targetTimespan * 2, big.NewRat(2, 1)},
+		{targetTimespan / 2, big.NewRat(1, 2)},
+		{targetTimespan * 100, big.NewRat(4, 1)},
+		{1, big.NewRat(1, 4)},
+	}
+	for _, test := range tests {
+		got := CompactToBig(CalculateNextBits(bits, test.timespan))
+		want := new(big.Int).Mul(target, test.factor.Num())
+		want.Div(want, test.factor.Denom())
+		if got.Cmp(want) != 0 {
+			t.Errorf("timespan %d: target = %x, want %x", test.timespan, got, want)
+		}
+	}
+}
+
+// 採掘したnonceが検証を通るか
+func TestProofOfWorkRun(t *testing.T) {
+	block := &BlockHeader{Timestamp: 1, Bits: BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-12))}
+	for _, threads := range []int{1, 4} {
+		pow := NewProofOfWork(block)
+		pow.Threads = threads
+		block.Nonce, block.Hash = pow.Run()
+		if !pow.Validate() {
+			t.Errorf("threads=%d: nonce %d is not valid", threads, block.Nonce)
+		}
+	}
+}
+
+// スレッド数ごとの採掘速度の比較
+// go test -bench ProofOfWork -benchtime 20x
+func BenchmarkProofOfWorkRun(b *testing.B) {
+	bits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-16))
+	for _, threads := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			var hashes uint64
+			for i := 0; i < b.N; i++ {
+				// タイムスタンプを変えて毎回異なる問題を解く
+				block := &BlockHeader{Timestamp: int64(i), Bits: bits}
+				pow := NewProofOfWork(block)
+				pow.Threads = threads
+				nonce, _ := pow.Run()
+				hashes += uint64(nonce) + 1
+			}
+			b.ReportMetric(float64(hashes)/b.Elapsed().Seconds(), "hashes/s")
+		})
+	}
+}
+
+// 中断した場合にMiningCancelledErrorが返るか
+func TestProofOfWorkRunContextCancel(t *testing.T) {
+	// 見つかることのないターゲット
+	block := &BlockHeader{Timestamp: 1, Bits: BigToCompact(big.NewInt(1))}
+	pow := NewProofOfWork(block)
+	pow.Threads = 2
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, hash, err := pow.RunContext(ctx)
+	var cancelled *MiningCancelledError
+	if !errors.As(err, &cancelled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext error = %v, want MiningCancelledError", err)
+	}
+	if hash != nil {
+		t.Errorf("RunContext returned hash %x with error", hash)
+	}
+}
+
+// 仕事量 = 2^256 / (ターゲット + 1)
+func TestCalculateWork(t *testing.T) {
+	tests := []struct {
+		shift uint // ターゲット = 2^shift
+		work  int64
+	}{
+		{240, 1<<16 - 1},
+		{239, 1<<17 - 1},
+		{252, 1<<4 - 1},
+	}
+	for _, test := range tests {
+		bits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), test.shift))
+		if work := CalculateWork(bits); work.Cmp(big.NewInt(test.work)) != 0 {
+			t.Errorf("CalculateWork(%08x) = %v, want %d", bits, work, test.work)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 部分署名済みトランザクション（PSBT）の先頭に付ける識別子
+var psbtMagic = []byte("psbt\xff")
+
+// 部分署名済みトランザクション
+// 署名前のトランザクションに、署名に必要な情報と集まった署名を添えたもの
+// 鍵を持たないマシンで作成し、オフラインのマシンで署名してから
+// 署名を結合・確定してブロードキャストする
+type PSBT struct {
+	Tx      Transaction  // 署名前のトランザクション（ScriptSigは空）
+	Inputs  []PSBTInput  // 入力ごとの情報（Tx.Vinと同じ順）
+	Outputs []PSBTOutput // 出力ごとの情報（Tx.Voutと同じ順）
+}
+
+// PSBTの入力の情報
+type PSBTInput struct {
+	// 入力が参照するトランザクション全体
+	// ハッシュ値がTxidと一致することで、ブロックチェーンを持たない署名者も
+	// 使用する金額とスクリプトを確認できる
+	PrevTx         Transaction
+	RedeemScript   []byte            // P2SHのredeemスクリプト
+	PartialSigs    map[string][]byte // 公開鍵（16進数） -> 署名
+	Derivations    map[string]string // 鍵のアドレス -> HDウォレットの導出パス
+	FinalScriptSig []byte            // 確定したScriptSig
+}
+
+// PSBTの出力の情報
+type PSBTOutput struct {
+	RedeemScript []byte            // P2SHのredeemスクリプト
+	Derivations  map[string]string // 鍵のアドレス -> HDウォレットの導出パス
+}
+
+// 署名前のトランザクションからPSBTを作成
+// prevTXsは入力が参照するトランザクション
+func NewPSBT(tx *Transaction, prevTXs map[string]Transaction) (*PSBT, error) {
+	p := &PSBT{Tx: tx.TrimmedCopy()}
+	p.Tx.SetID()
+	for inID, vin := range tx.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok {
+			return nil, fmt.Errorf("入力%d: 参照先のトランザクションが見つかりません", inID)
+		}
+		p.Inputs = append(p.Inputs, PSBTInput{
+			PrevTx:      prevTx,
+			PartialSigs: make(map[string][]byte),
+			Derivations: make(map[string]string),
+		})
+	}
+	for range tx.Vout {
+		p.Outputs = append(p.Outputs, PSBTOutput{Derivations: make(map[string]string)})
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PSBTのシリアライズ
+func (p *PSBT) Serialize() []byte {
+	var encoded bytes.Buffer
+	encoded.Write(psbtMagic)
+	err := gob.NewEncoder(&encoded).Encode(p)
+	if err != nil {
+		log.Panic(err)
+	}
+	return encoded.Bytes()
+}
+
+// PSBTのデシリアライズ
+func DeserializePSBT(data []byte) (*PSBT, error) {
+	if !IsPSBT(data) {
+		return nil, errors.New("PSBTではありません")
+	}
+	var p PSBT
+	err := gob.NewDecoder(bytes.NewReader(data[len(psbtMagic):])).Decode(&p)
+	if err != nil {
+		return nil, errors.New("PSBTの形式が正しくありません")
+	}
+	// 空のmapはgobで保存されないため作り直す
+	for i := range p.Inputs {
+		if p.Inputs[i].PartialSigs == nil {
+			p.Inputs[i].PartialSigs = make(map[string][]byte)
+		}
+		if p.Inputs[i].Derivations == nil {
+			p.Inputs[i].Derivations = make(map[string]string)
+		}
+	}
+	for i := range p.Outputs {
+		if p.Outputs[i].Derivations == nil {
+			p.Outputs[i].Derivations = make(map[string]string)
+		}
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// データがPSBTの識別子で始まるか
+func IsPSBT(data []byte) bool {
+	return bytes.HasPrefix(data, psbtMagic)
+}
+
+// PSBTの内容が整合しているかの検証
+func (p *PSBT) check() error {
+	if len(p.Tx.Vin) == 0 || p.Tx.IsCoinbase() {
+		return errors.New("PSBTのトランザクションに入力がありません")
+	}
+	if len(p.Inputs) != len(p.Tx.Vin) || len(p.Outputs) != len(p.Tx.Vout) {
+		return errors.New("PSBTの入出力の数がトランザクションと一致しません")
+	}
+	for inID, vin := range p.Tx.Vin {
+		if len(vin.ScriptSig) > 0 {
+			return fmt.Errorf("入力%d: 署名前のトランザクションにScriptSigがあります", inID)
+		}
+		// 参照先のトランザクションが差し替えられていないことを確認
+		prevTx := p.Inputs[inID].PrevTx
+		if !bytes.Equal(prevTx.ID, vin.Txid) || !bytes.Equal(prevTx.Hash(), vin.Txid) {
+			return fmt.Errorf("入力%d: 参照先のトランザクションが一致しません", inID)
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return fmt.Errorf("入力%d: 存在しない出力を参照しています", inID)
+		}
+	}
+	return nil
+}
+
+// 入力inIDが使用する出力
+func (p *PSBT) prevOutput(inID int) TXOutput {
+	return p.Inputs[inID].PrevTx.Vout[p.Tx.Vin[inID].Vout]
+}
+
+// 各入力が使用する出力（入力の順）
+func (p *PSBT) prevOutputs() []TXOutput {
+	var prevOuts []TXOutput
+	for inID := range p.Inputs {
+		prevOuts = append(prevOuts, p.prevOutput(inID))
+	}
+	return prevOuts
+}
+
+// 手数料（入力の合計 - 出力の合計）
+func (p *PSBT) Fee() int {
+	fee := 0
+	for inID := range p.Inputs {
+		fee += p.prevOutput(inID).Value
+	}
+	for _, out := range p.Tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
+// 別の署名者のPSBTから署名などの情報を取り込む
+func (p *PSBT) Combine(other *PSBT) error {
+	if !bytes.Equal(p.Tx.Hash(), other.Tx.Hash()) {
+		return errors.New("異なるトランザクションのPSBTは結合できません")
+	}
+	for i := range p.Inputs {
+		in, otherIn := &p.Inputs[i], other.Inputs[i]
+		if in.RedeemScript == nil {
+			in.RedeemScript = otherIn.RedeemScript
+		}
+		if in.FinalScriptSig == nil {
+			in.FinalScriptSig = otherIn.FinalScriptSig
+		}
+		for pubKey, sig := range otherIn.PartialSigs {
+			in.PartialSigs[pubKey] = sig
+		}
+		for address, path := range otherIn.Derivations {
+			in.Derivations[address] = path
+		}
+	}
+	for i := range p.Outputs {
+		out, otherOut := &p.Outputs[i], other.Outputs[i]
+		if out.RedeemScript == nil {
+			out.RedeemScript = otherOut.RedeemScript
+		}
+		for address, path := range otherOut.Derivations {
+			out.Derivations[address] = path
+		}
+	}
+	return nil
+}
+
+// 入力inIDのredeemスクリプト（P2SHの場合）
+func (p *PSBT) redeemScript(inID int, scriptPubKey []byte) ([]byte, error) {
+	redeemScript := p.Inputs[inID].RedeemScript
+	if redeemScript == nil {
+		return nil, errors.New("redeemスクリプトが分かりません")
+	}
+	if !bytes.Equal(HashPubKey(redeemScript), ExtractScriptHash(scriptPubKey)) {
+		return nil, errors.New("redeemスクリプトが出力のスクリプトハッシュと一致しません")
+	}
+	return redeemScript, nil
+}
+
+// 集まった署名から入力inIDのScriptSigを組み立てる
+func (p *PSBT) finalScriptSig(inID int) ([]byte, error) {
+	in := p.Inputs[inID]
+	if in.FinalScriptSig != nil {
+		return in.FinalScriptSig, nil
+	}
+	scriptPubKey := p.prevOutput(inID).ScriptPubKey
+
+	switch ClassifyScript(scriptPubKey) {
+	case ScriptPubKeyHash:
+		pubKeyHash := ExtractPubKeyHash(scriptPubKey)
+		hash := p.Tx.SignatureHash(inID, scriptPubKey)
+		for pubKeyHex, sig := range in.PartialSigs {
+			pubKey, err := hex.DecodeString(pubKeyHex)
+			if err != nil || !bytes.Equal(HashPubKey(pubKey), pubKeyHash) {
+				continue
+			}
+			if verifySignature(pubKey, hash, sig) {
+				return append(pushData(sig), pushData(pubKey)...), nil
+			}
+		}
+		return nil, errors.New("署名がありません")
+	case ScriptScriptHash:
+		redeemScript, err := p.redeemScript(inID, scriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		m, pubKeys, ok := ExtractMultisig(redeemScript)
+		if !ok {
+			return nil, errors.New("マルチシグ以外のredeemスクリプトは確定できません")
+		}
+		// 正しい署名を公開鍵の順に最大M個並べる
+		hash := p.Tx.SignatureHash(inID, redeemScript)
+		var sigs [][]byte
+		for _, pubKey := range pubKeys {
+			sig, ok := in.PartialSigs[hex.EncodeToString(pubKey)]
+			if ok && len(sigs) < m && verifySignature(pubKey, hash, sig) {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(sigs) < m {
+			return nil, fmt.Errorf("署名が足りません（%d/%d）", len(sigs), m)
+		}
+		return multisigScriptSig(sigs, redeemScript), nil
+	}
+	return nil, errors.New("確定できない種類の出力です")
+}
+
+// 全ての入力の署名が揃っているか
+func (p *PSBT) IsComplete() bool {
+	for inID := range p.Inputs {
+		if _, err := p.finalScriptSig(inID); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// 署名を確定し、ブロードキャストできるトランザクションを返す
+// 確定したScriptSigはPSBTにも記録する
+func (p *PSBT) Finalize() (*Transaction, error) {
+	tx := p.Tx.TrimmedCopy()
+	for inID := range p.Inputs {
+		scriptSig, err := p.finalScriptSig(inID)
+		if err != nil {
+			return nil, fmt.Errorf("入力%d: %w", inID, err)
+		}
+		tx.Vin[inID].ScriptSig = scriptSig
+	}
+	if err := tx.VerifyScripts(p.prevOutputs()); err != nil {
+		return nil, err
+	}
+	for inID := range p.Inputs {
+		p.Inputs[inID].FinalScriptSig = tx.Vin[inID].ScriptSig
+	}
+	tx.SetID()
+	return &tx, nil
+}
+
+// ウォレットのアドレスと導出パスをPSBTに記録する
+// 鍵をまだ導出していないHDウォレットでも署名できるようにするためのもの
+func (ws Wallets) AddPSBTDerivations(p *PSBT) {
+	// スクリプトに含まれる鍵のアドレスに導出パスがあれば記録
+	addHints := func(derivations map[string]string, script, redeemScript []byte) {
+		addresses := ScriptAddresses(script)
+		if redeemScript != nil {
+			addresses = append(addresses, ScriptAddresses(redeemScript)...)
+		}
+		for _, address := range addresses {
+			if path := ws.HDPath(address); path != "" {
+				derivations[address] = path
+			}
+		}
+	}
+	for inID := range p.Inputs {
+		in := &p.Inputs[inID]
+		scriptPubKey := p.prevOutput(inID).ScriptPubKey
+		if ClassifyScript(scriptPubKey) == ScriptScriptHash && in.RedeemScript == nil {
+			in.RedeemScript, _ = ws.GetScript(ScriptAddresses(scriptPubKey)[0])
+		}
+		addHints(in.Derivations, scriptPubKey, in.RedeemScript)
+	}
+	for outID, vout := range p.Tx.Vout {
+		out := &p.Outputs[outID]
+		if ClassifyScript(vout.ScriptPubKey) == ScriptScriptHash && out.RedeemScript == nil {
+			out.RedeemScript, _ = ws.GetScript(ScriptAddresses(vout.ScriptPubKey)[0])
+		}
+		addHints(out.Derivations, vout.ScriptPubKey, out.RedeemScript)
+	}
+}
+
+// アドレスの鍵を返す
+// ウォレットにない場合は導出パスのヒントに従ってHDウォレットのシードから導出する
+func (ws Wallets) psbtKey(address string, derivations map[string]string) *Wallet {
+	if wallet, ok := ws.Wallets[address]; ok {
+		return wallet
+	}
+	path, ok := derivations[address]
+	if !ok || len(ws.hdSeed) == 0 {
+		return nil
+	}
+	wallet, err := DeriveWallet(ws.hdSeed, path)
+	if err != nil || string(wallet.GetAddress()) != address {
+		return nil // 別のシードの導出パス
+	}
+	return wallet
+}
+
+// ウォレットの鍵でPSBTの入力に署名し、追加した署名の数を返す
+// 署名に必要な情報はPSBTに含まれるため、ブロックチェーンは不要
+func (ws Wallets) SignPSBT(p *PSBT) (int, error) {
+	signed := 0
+	for inID := range p.Inputs {
+		in := &p.Inputs[inID]
+		if in.FinalScriptSig != nil {
+			continue
+		}
+		scriptPubKey := p.prevOutput(inID).ScriptPubKey
+
+		switch ClassifyScript(scriptPubKey) {
+		case ScriptPubKeyHash:
+			wallet := ws.psbtKey(ScriptAddresses(scriptPubKey)[0], in.Derivations)
+			if wallet == nil {
+				continue // 他の署名者の鍵
+			}
+			hash := p.Tx.SignatureHash(inID, scriptPubKey)
+			in.PartialSigs[hex.EncodeToString(wallet.PublicKey)] = signHash(wallet.PrivateKey, hash)
+			signed++
+		case ScriptScriptHash:
+			if in.RedeemScript == nil {
+				in.RedeemScript, _ = ws.GetScript(ScriptAddresses(scriptPubKey)[0])
+			}
+			redeemScript, err := p.redeemScript(inID, scriptPubKey)
+			if err != nil {
+				return signed, fmt.Errorf("入力%d: %w", inID, err)
+			}
+			_, pubKeys, ok := ExtractMultisig(redeemScript)
+			if !ok {
+				return signed, fmt.Errorf("入力%d: マルチシグ以外のredeemスクリプトには署名できません", inID)
+			}
+			hash := p.Tx.SignatureHash(inID, redeemScript)
+			for _, pubKey := range pubKeys {
+				address := string(encodeAddress(version, HashPubKey(pubKey)))
+				wallet := ws.psbtKey(address, in.Derivations)
+				if wallet == nil {
+					continue
+				}
+				in.PartialSigs[hex.EncodeToString(pubKey)] = signHash(wallet.PrivateKey, hash)
+				signed++
+			}
+		default:
+			return signed, fmt.Errorf("入力%d: 署名できない種類の出力です", inID)
+		}
+	}
+	return signed, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// P2SHマルチシグの出力を使用するPSBT
+func newMultisigPSBT(t *testing.T, keys []*Wallet) *PSBT {
+	var pubKeys [][]byte
+	for _, key := range keys {
+		pubKeys = append(pubKeys, key.PublicKey)
+	}
+	redeemScript, err := NewMultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTx := Transaction{nil, []TXInput{{[]byte{}, -1, []byte{1}, sequenceFinal}},
+		[]TXOutput{{10, NewP2SHScript(HashPubKey(redeemScript))}}, 0}
+	prevTx.SetID()
+	tx := &Transaction{nil, []TXInput{{prevTx.ID, 0, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(9, ScriptHashAddress(redeemScript))}, 0}
+	p, err := NewPSBT(tx, map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Inputs[0].RedeemScript = redeemScript
+	return p
+}
+
+// 署名者ごとに署名したPSBTを結合して確定する
+func TestPSBTCombineAndFinalize(t *testing.T) {
+	keys := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	p := newMultisigPSBT(t, keys)
+	if p.Fee() != 1 {
+		t.Errorf("Fee() = %d, want 1", p.Fee())
+	}
+
+	// シリアライズしたものを各署名者に渡す
+	var signedPSBTs []*PSBT
+	for _, key := range []*Wallet{keys[0], keys[2]} {
+		copied, err := DeserializePSBT(p.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := newSignerWallets(key).SignPSBT(copied)
+		if err != nil || signed != 1 {
+			t.Fatalf("SignPSBT() = %d, %v", signed, err)
+		}
+		if copied.IsComplete() {
+			t.Error("IsComplete() = true with one signature")
+		}
+		signedPSBTs = append(signedPSBTs, copied)
+	}
+	if _, err := signedPSBTs[0].Finalize(); err == nil {
+		t.Error("Finalize() succeeded with one signature")
+	}
+
+	if err := signedPSBTs[0].Combine(signedPSBTs[1]); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := signedPSBTs[0].Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.VerifyScripts(p.prevOutputs()); err != nil {
+		t.Errorf("VerifyScripts() = %v", err)
+	}
+}
+
+// 導出パスのヒントでまだ導出していない鍵を使って署名する
+func TestSignPSBTDerivationHint(t *testing.T) {
+	seed := make([]byte, 32)
+	path := hdPath(hdExternalChain, 5)
+	key, err := DeriveWallet(seed, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(key.GetAddress())
+	prevTx := Transaction{nil, []TXInput{{[]byte{}, -1, []byte{1}, sequenceFinal}}, []TXOutput{*NewTXOutput(10, address)}, 0}
+	prevTx.SetID()
+	tx := &Transaction{nil, []TXInput{{prevTx.ID, 0, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(10, address)}, 0}
+	p, err := NewPSBT(tx, map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := newSignerWallets(NewWallet())
+	ws.hdSeed = seed
+	if signed, _ := ws.SignPSBT(p); signed != 0 {
+		t.Fatalf("SignPSBT() signed %d inputs without a hint", signed)
+	}
+	p.Inputs[0].Derivations[address] = path
+	if signed, err := ws.SignPSBT(p); err != nil || signed != 1 {
+		t.Fatalf("SignPSBT() = %d, %v", signed, err)
+	}
+	if _, err := p.Finalize(); err != nil {
+		t.Errorf("Finalize() = %v", err)
+	}
+}
+
+// 参照先のトランザクションを書き換えたPSBTは読み込まない
+func TestDeserializePSBTTampered(t *testing.T) {
+	p := newMultisigPSBT(t, []*Wallet{NewWallet(), NewWallet(), NewWallet()})
+	p.Inputs[0].PrevTx.Vout[0].Value = 100
+	if _, err := DeserializePSBT(p.Serialize()); err == nil {
+		t.Error("DeserializePSBT() accepted a modified previous transaction")
+	}
+	if _, err := DeserializePSBT(p.Tx.Serialize()); err == nil {
+		t.Error("DeserializePSBT() accepted a raw transaction")
+	}
+}
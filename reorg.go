@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// チェーンの再編成
+// 分岐したチェーンの累積の仕事量が有効なチェーンを上回った場合に、
+// 分岐点までのブロックを切り離し、分岐したチェーンのブロックを接続する
+type ReorgEvent struct {
+	OldTip       []byte       // 再編成前の最終ブロックのハッシュ値
+	NewTip       []byte       // 再編成後の最終ブロックのハッシュ値
+	Fork         *BlockHeader // 分岐点のブロック
+	Disconnected []*Block     // 切り離したブロック（新しい順）
+	Connected    []*Block     // 接続したブロック（古い順）
+}
+
+// 再編成の深さ（切り離したブロックの数）
+func (e *ReorgEvent) Depth() int {
+	return len(e.Disconnected)
+}
+
+// 切り離したブロックのトランザクションのうち、新しいチェーンに含まれないもの
+// コインベースを除き、承認された順に返す
+func (e *ReorgEvent) OrphanedTransactions() []*Transaction {
+	confirmed := make(map[string]bool)
+	for _, block := range e.Connected {
+		for _, tx := range block.Transactions {
+			confirmed[hex.EncodeToString(tx.ID)] = true
+		}
+	}
+	var orphaned []*Transaction
+	for i := len(e.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range e.Disconnected[i].Transactions {
+			if !tx.IsCoinbase() && !confirmed[hex.EncodeToString(tx.ID)] {
+				orphaned = append(orphaned, tx)
+			}
+		}
+	}
+	return orphaned
+}
+
+// 再編成の内容を文字列で表現
+func (e *ReorgEvent) String() string {
+	return fmt.Sprintf("深さ %d 分岐点 高さ %d %x → 最終ブロック %x",
+		e.Depth(), e.Fork.Height, e.Fork.Hash, e.NewTip)
+}
+
+// newTipのブロックを最終ブロックとするチェーンに切り替える
+// 分岐点まで最終ブロックを切り離した後、分岐したチェーンのブロックを検証しながら接続する
+// 検証に失敗した場合は、そのブロック以降を不正として記録して元のチェーンに戻す
+// 切り離しや接続の途中で失敗した場合も元のチェーンに戻すため、
+// 切り離したブロックのトランザクションが失われることはない
+func (bc *Blockchain) reorganize(newTip []byte) (*ReorgEvent, error) {
+	fork, err := bc.findFork(bc.tip, newTip)
+	if err != nil {
+		log.Panic(err) // 同じ初期ブロックから続くヘッダーのみを保存している
+	}
+	// 分岐したチェーンのブロック（古い順）
+	var branch [][]byte
+	for _, hash := range bc.headerHashes(newTip) {
+		if bytes.Equal(hash, fork.Hash) {
+			break
+		}
+		branch = append([][]byte{hash}, branch...)
+	}
+
+	event := &ReorgEvent{OldTip: bc.tip, Fork: fork}
+	for !bytes.Equal(bc.tip, fork.Hash) {
+		block, err := bc.DisconnectTip()
+		if err != nil {
+			bc.restoreChain(event)
+			return nil, err
+		}
+		event.Disconnected = append(event.Disconnected, block)
+	}
+	for _, hash := range branch {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			log.Panic(err) // 前のブロックを持っているブロックのみを保存している
+		}
+		if err := bc.ValidateBlock(block); err != nil {
+			bc.restoreChain(event)
+			if err := bc.markInvalid(block.Hash); err != nil {
+				log.Panic(err)
+			}
+			return nil, err
+		}
+		if err := bc.db.Update(func(tx *bolt.Tx) error {
+			return bc.connectBlock(tx, block)
+		}); err != nil {
+			bc.restoreChain(event)
+			return nil, err
+		}
+		event.Connected = append(event.Connected, block)
+	}
+	event.NewTip = bc.tip
+	return event, nil
+}
+
+// 再編成を中断し、切り離したブロックを接続し直して元のチェーンに戻す
+// 元のチェーンのブロックは検証済みのため、検証せずに接続する
+func (bc *Blockchain) restoreChain(event *ReorgEvent) {
+	for range event.Connected {
+		if _, err := bc.DisconnectTip(); err != nil {
+			log.Panic(err)
+		}
+	}
+	for i := len(event.Disconnected) - 1; i >= 0; i-- {
+		block := event.Disconnected[i]
+		err := bc.db.Update(func(tx *bolt.Tx) error {
+			return bc.connectBlock(tx, block)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// ブロックとそれに続く全てのブロックを不正として記録する
+// 有効なチェーンのブロックの場合は、そのブロックまで切り離した後、
+// 残りのブロックのうち累積の仕事量が最も多いチェーンに切り替え、再編成の内容を返す
+func (bc *Blockchain) InvalidateBlock(hash []byte) (*ReorgEvent, error) {
+	header, err := bc.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.PrevBlockHash) == 0 {
+		return nil, errors.New("初期ブロックは不正にできません")
+	}
+	if err := bc.markInvalid(hash); err != nil {
+		return nil, err
+	}
+	oldTip := bc.tip
+	if fork, err := bc.findFork(bc.tip, hash); err == nil && bytes.Equal(fork.Hash, hash) {
+		for !bytes.Equal(bc.tip, header.PrevBlockHash) {
+			if _, err := bc.DisconnectTip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bc.activateBestChain(oldTip)
+}
+
+// 不正の記録を取り消し、累積の仕事量が最も多いチェーンに切り替えて再編成の内容を返す
+// 取り消したブロックは接続する際に改めて検証する
+func (bc *Blockchain) ReconsiderBlock(hash []byte) (*ReorgEvent, error) {
+	if !bc.HasHeader(hash) {
+		return nil, errors.New("ヘッダーが見つかりません")
+	}
+	if err := bc.clearInvalid(hash); err != nil {
+		return nil, err
+	}
+	return bc.activateBestChain(bc.tip)
+}
+
+// 本体を持っているブロックのうち、最終ブロックより累積の仕事量が多いチェーンがあれば切り替える
+// 切り替え先のブロックが検証に失敗した場合は不正として記録し、次の候補を試す
+// 途中で何度切り替えても、oldTipから最終的な最終ブロックまでの再編成の内容にまとめて返す
+// エラーの場合も最終ブロックが変わっていれば再編成の内容を返す
+func (bc *Blockchain) activateBestChain(oldTip []byte) (*ReorgEvent, error) {
+	var lastErr error
+	for {
+		best := bc.bestBlock()
+		if best == nil || bytes.Equal(best, bc.tip) {
+			break
+		}
+		if _, err := bc.reorganize(best); err != nil {
+			lastErr = err
+			var invalid *BlockValidationError
+			if !errors.As(err, &invalid) {
+				break
+			}
+		}
+	}
+	event, err := bc.reorgEventSince(oldTip)
+	if err != nil {
+		return nil, err
+	}
+	return event, lastErr
+}
+
+// oldTipから現在の最終ブロックまでの再編成の内容（最終ブロックが変わっていない場合はnil）
+// 切り離したブロックも保存したままなので、分岐点から両方のチェーンを遡って求める
+func (bc *Blockchain) reorgEventSince(oldTip []byte) (*ReorgEvent, error) {
+	if bytes.Equal(oldTip, bc.tip) {
+		return nil, nil
+	}
+	fork, err := bc.findFork(oldTip, bc.tip)
+	if err != nil {
+		return nil, err
+	}
+	event := &ReorgEvent{OldTip: oldTip, NewTip: bc.tip, Fork: fork}
+	for hash := oldTip; !bytes.Equal(hash, fork.Hash); {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		event.Disconnected = append(event.Disconnected, block)
+		hash = block.PrevBlockHash
+	}
+	for hash := bc.tip; !bytes.Equal(hash, fork.Hash); {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		event.Connected = append([]*Block{block}, event.Connected...)
+		hash = block.PrevBlockHash
+	}
+	return event, nil
+}
+
+// 最終ブロックを切り離し、取り消しデータを使ってUTXOセットを前のブロックの状態に戻す
+// 切り離したブロックは分岐したチェーンのブロックとして保存したままにする
+func (bc *Blockchain) DisconnectTip() (*Block, error) {
+	block, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.PrevBlockHash) == 0 {
+		return nil, errors.New("初期ブロックは切り離せません")
+	}
+	var undo *blockUndo
+	err = bc.db.View(func(tx *bolt.Tx) error {
+		undo = getBlockUndo(tx, block.Hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 取り消しデータを保存する前に接続されたブロックの場合は、チェーンを遡って求める
+	if undo == nil {
+		spent, err := bc.spentOutputs(block)
+		if err != nil {
+			return nil, err
+		}
+		undo = &blockUndo{spent}
+	}
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		// このブロックで作られた出力を削除
+		for _, t := range block.Transactions {
+			if err := b.Delete(t.ID); err != nil {
+				return err
+			}
+		}
+		// このブロックで使用された出力を未使用に戻す
+		for _, s := range undo.Spent {
+			outs := TXOutputs{make(map[int]TXOutput), s.Height, s.Coinbase}
+			if encoded := b.Get(s.Txid); encoded != nil {
+				outs = DeserializeOutputs(encoded)
+			}
+			outs.Outputs[s.Vout] = s.Output
+			if err := b.Put(s.Txid, outs.Serialize()); err != nil {
+				return err
+			}
+		}
+		// 切り離したブロックの取り消しデータは、接続し直す際に作り直す
+		if err := tx.Bucket([]byte(undoBucket)).Delete(block.Hash); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.PrevBlockHash); err != nil {
+			return err
+		}
+		bc.tip = block.PrevBlockHash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// ブロックの入力が使用した出力を、前のブロックから遡って探す
+// 取り消しデータのない古いデータベースのブロックを切り離す場合に使う
+// 同じブロックの中で作られて使用された出力は含めない
+func (bc *Blockchain) spentOutputs(block *Block) ([]spentOutput, error) {
+	created := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		created[hex.EncodeToString(tx.ID)] = true
+	}
+	var inputs []TXInput
+	needed := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if id := hex.EncodeToString(vin.Txid); !created[id] {
+				inputs = append(inputs, vin)
+				needed[id] = true
+			}
+		}
+	}
+
+	// 参照先のトランザクションとそれを含むブロック
+	found := make(map[string]*Transaction)
+	heights := make(map[string]int)
+	hash := block.PrevBlockHash
+	for len(found) < len(needed) && len(hash) > 0 {
+		prev, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range prev.Transactions {
+			if id := hex.EncodeToString(tx.ID); needed[id] {
+				found[id] = tx
+				heights[id] = prev.Height
+			}
+		}
+		hash = prev.PrevBlockHash
+	}
+
+	var spent []spentOutput
+	for _, vin := range inputs {
+		id := hex.EncodeToString(vin.Txid)
+		tx, ok := found[id]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(tx.Vout) {
+			return nil, fmt.Errorf("入力 %s:%d が参照する出力が見つかりません", id, vin.Vout)
+		}
+		spent = append(spent, spentOutput{vin.Txid, vin.Vout, tx.Vout[vin.Vout], heights[id], tx.IsCoinbase()})
+	}
+	return spent, nil
+}
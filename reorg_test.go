@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// UTXOセットに出力が未使用として残っているか
+func hasUTXO(t *testing.T, bc *Blockchain, txid []byte, vout int) bool {
+	t.Helper()
+	found := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if encoded := tx.Bucket([]byte(utxoBucket)).Get(txid); encoded != nil {
+			_, found = DeserializeOutputs(encoded).Outputs[vout]
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// ブロックのハッシュ値の並びが一致するか
+func equalBlocks(blocks []*Block, want ...*Block) bool {
+	if len(blocks) != len(want) {
+		return false
+	}
+	for i := range blocks {
+		if !bytes.Equal(blocks[i].Hash, want[i].Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// 切り離したブロックのトランザクションのうち、新しいチェーンにないものを古い順に返すか
+func TestOrphanedTransactions(t *testing.T) {
+	tx := func(id byte, coinbase bool) *Transaction {
+		vin := TXInput{[]byte{id}, 0, nil, sequenceFinal}
+		if coinbase {
+			vin = TXInput{[]byte{}, -1, nil, sequenceFinal}
+		}
+		return &Transaction{[]byte{id}, []TXInput{vin}, []TXOutput{{1, nil}}, 0}
+	}
+	block := func(transactions ...*Transaction) *Block {
+		return &Block{Transactions: transactions}
+	}
+	event := &ReorgEvent{
+		// 新しい順
+		Disconnected: []*Block{
+			block(tx(10, true), tx(3, false)),
+			block(tx(11, true), tx(1, false), tx(2, false)),
+		},
+		Connected: []*Block{
+			block(tx(12, true), tx(2, false)),
+		},
+	}
+	orphaned := event.OrphanedTransactions()
+	want := [][]byte{{1}, {3}}
+	if len(orphaned) != len(want) {
+		t.Fatalf("OrphanedTransactions() returned %d transactions, want %d", len(orphaned), len(want))
+	}
+	for i, tx := range orphaned {
+		if !bytes.Equal(tx.ID, want[i]) {
+			t.Errorf("OrphanedTransactions()[%d] = %x, want %x", i, tx.ID, want[i])
+		}
+	}
+}
+
+// 2つに分岐したチェーンの間で、仕事量が上回った方に切り替わるか
+// 分岐したチェーンのブロックが不正な場合は元のチェーンに戻り、そのブロックを不正と記録するか
+func TestReorganize(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding := genesis.Transactions[0]
+	addTestBlocks(t, bc, wallet, chainParams.CoinbaseMaturity+1)
+	fork, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := string(NewWallet().GetAddress())
+	mine := func(prev *Block, txs ...*Transaction) *Block {
+		coinbase := NewCoinbaseTX(other, "", prev.Height+1, 0)
+		return newTestBlock(t, bc, prev, append([]*Transaction{coinbase}, txs...), nil)
+	}
+	add := func(block *Block) *ReorgEvent {
+		t.Helper()
+		event, err := bc.AddBlock(block)
+		if err != nil {
+			t.Fatalf("AddBlock() at height %d = %v", block.Height, err)
+		}
+		return event
+	}
+	// 有効なチェーンがどちらであるかを、最終ブロックとUTXOセットで確認する
+	checkTip := func(step string, tip *Block, spent bool) {
+		t.Helper()
+		if !bytes.Equal(bc.tip, tip.Hash) || !bytes.Equal(bc.BestHeader().Hash, tip.Hash) {
+			t.Errorf("%s: tip = %x, best header = %x, want %x", step, bc.tip, bc.BestHeader().Hash, tip.Hash)
+		}
+		if hasUTXO(t, bc, funding.ID, 0) == spent {
+			t.Errorf("%s: funding output spent = %v, want %v", step, !spent, spent)
+		}
+	}
+
+	// Aのチェーン: 初期ブロックの報酬を使うトランザクションを含む
+	spend := newTestSpend(t, wallet, funding, 0, funding.Vout[0].Value, nil)
+	a1 := addTestBlocks(t, bc, wallet, 1, spend)[0]
+	checkTip("a1", a1, true)
+
+	// Bのチェーン: 仕事量が同じ間は分岐したチェーンとして保存するのみ
+	b1 := mine(fork)
+	if event := add(b1); event != nil || !bc.HasBlock(b1.Hash) {
+		t.Fatalf("AddBlock() of a side chain block = %v, stored %v", event, bc.HasBlock(b1.Hash))
+	}
+	checkTip("b1", a1, true)
+	if hasUTXO(t, bc, b1.Transactions[0].ID, 0) {
+		t.Error("side chain coinbase was added to the UTXO set")
+	}
+
+	// 仕事量が上回ると切り替え、Aのトランザクションは未承認に戻る
+	b2 := mine(b1)
+	event := add(b2)
+	if event == nil || event.Depth() != 1 || !equalBlocks(event.Disconnected, a1) || !equalBlocks(event.Connected, b1, b2) {
+		t.Fatalf("AddBlock() = %v, want a reorganization from a1 to b1, b2", event)
+	}
+	if orphaned := event.OrphanedTransactions(); len(orphaned) != 1 || !bytes.Equal(orphaned[0].ID, spend.ID) {
+		t.Errorf("OrphanedTransactions() = %d transactions, want the spend of a1", len(orphaned))
+	}
+	checkTip("b2", b2, false)
+	if hasUTXO(t, bc, spend.ID, 0) || hasUTXO(t, bc, a1.Transactions[0].ID, 0) || !hasUTXO(t, bc, b2.Transactions[0].ID, 0) {
+		t.Error("UTXO set does not match the b chain")
+	}
+
+	// Aのチェーンの不正なブロックで仕事量が上回った場合は、Bのチェーンに戻る
+	a2 := mine(a1)
+	if event := add(a2); event != nil {
+		t.Fatalf("AddBlock() with equal work = %v, want no reorganization", event)
+	}
+	unknown := &Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(1, string(wallet.GetAddress()))}, 0}
+	bad := mine(a2, newTestSpend(t, wallet, unknown, 0, 1, nil))
+	if _, err := bc.AddBlock(bad); !errors.Is(err, ErrMissingInput) {
+		t.Fatalf("AddBlock() of an invalid branch block = %v, want %v", err, ErrMissingInput)
+	}
+	checkTip("invalid a3", b2, false)
+	if !hasUTXO(t, bc, b1.Transactions[0].ID, 0) || hasUTXO(t, bc, a2.Transactions[0].ID, 0) {
+		t.Error("UTXO set was not restored to the b chain")
+	}
+	if !bc.isInvalid(bad.Hash) || bc.isInvalid(a2.Hash) || bc.isInvalid(a1.Hash) {
+		t.Errorf("isInvalid() = %v, %v, %v for a3, a2, a1, want only a3",
+			bc.isInvalid(bad.Hash), bc.isInvalid(a2.Hash), bc.isInvalid(a1.Hash))
+	}
+
+	// 有効なブロックで上回ればAのチェーンに戻る
+	a3 := mine(a2)
+	event = add(a3)
+	if event == nil || !equalBlocks(event.Disconnected, b2, b1) || !equalBlocks(event.Connected, a1, a2, a3) {
+		t.Fatalf("AddBlock() = %v, want a reorganization from b2 to a3", event)
+	}
+	checkTip("a3", a3, true)
+	if !hasUTXO(t, bc, spend.ID, 0) || hasUTXO(t, bc, b1.Transactions[0].ID, 0) {
+		t.Error("UTXO set does not match the a chain")
+	}
+}
+
+// 不正として記録したブロックまで切り離し、取り消すと接続し直して、それぞれ再編成の内容を返すか
+func TestInvalidateReconsiderBlock(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding := genesis.Transactions[0]
+	addTestBlocks(t, bc, wallet, chainParams.CoinbaseMaturity+1)
+	fork := bc.tip
+	spend := newTestSpend(t, wallet, funding, 0, funding.Vout[0].Value, nil)
+	blocks := addTestBlocks(t, bc, wallet, 2, spend)
+	// データベースから読み込んだ最終ブロックで再編成の内容を求める
+	bc.db.Close()
+	bc = NewBlockchain("")
+	t.Cleanup(func() { bc.db.Close() })
+
+	if _, err := bc.InvalidateBlock(genesis.Hash); err == nil {
+		t.Error("InvalidateBlock() of the genesis block succeeded")
+	}
+	event, err := bc.InvalidateBlock(blocks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.Depth() != 2 || !equalBlocks(event.Disconnected, blocks[1], blocks[0]) ||
+		len(event.Connected) != 0 || !bytes.Equal(event.Fork.Hash, fork) {
+		t.Fatalf("InvalidateBlock() = %v, want 2 blocks disconnected to %x", event, fork)
+	}
+	if orphaned := event.OrphanedTransactions(); len(orphaned) != 1 || !bytes.Equal(orphaned[0].ID, spend.ID) {
+		t.Errorf("OrphanedTransactions() = %d transactions, want the spend", len(orphaned))
+	}
+	if !bytes.Equal(bc.tip, fork) || !hasUTXO(t, bc, funding.ID, 0) {
+		t.Error("InvalidateBlock() did not disconnect the blocks from the UTXO set")
+	}
+
+	event, err = bc.ReconsiderBlock(blocks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.Depth() != 0 || !equalBlocks(event.Connected, blocks...) {
+		t.Fatalf("ReconsiderBlock() = %v, want 2 blocks connected", event)
+	}
+	if !bytes.Equal(bc.tip, blocks[1].Hash) || hasUTXO(t, bc, funding.ID, 0) {
+		t.Error("ReconsiderBlock() did not connect the blocks again")
+	}
+	// 最終ブロックが変わらない場合はnil
+	if event, err := bc.ReconsiderBlock(blocks[0].Hash); event != nil || err != nil {
+		t.Errorf("second ReconsiderBlock() = %v, %v, want nil", event, err)
+	}
+}
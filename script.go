@@ -0,0 +1,916 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// オペコード（値はビットコインと同じ）
+const (
+	OP_0                   = 0x00
+	OP_PUSHDATA1           = 0x4c
+	OP_PUSHDATA2           = 0x4d
+	OP_1NEGATE             = 0x4f
+	OP_1                   = 0x51
+	OP_16                  = 0x60
+	OP_NOP                 = 0x61
+	OP_IF                  = 0x63
+	OP_NOTIF               = 0x64
+	OP_ELSE                = 0x67
+	OP_ENDIF               = 0x68
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_SWAP                = 0x7c
+	OP_SIZE                = 0x82
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_1ADD                = 0x8b
+	OP_1SUB                = 0x8c
+	OP_NEGATE              = 0x8f
+	OP_NOT                 = 0x91
+	OP_ADD                 = 0x93
+	OP_SUB                 = 0x94
+	OP_BOOLAND             = 0x9a
+	OP_BOOLOR              = 0x9b
+	OP_NUMEQUAL            = 0x9c
+	OP_NUMEQUALVERIFY      = 0x9d
+	OP_LESSTHAN            = 0x9f
+	OP_GREATERTHAN         = 0xa0
+	OP_MIN                 = 0xa3
+	OP_MAX                 = 0xa4
+	OP_WITHIN              = 0xa5
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+// 逆アセンブル用のオペコード名
+var opcodeNames = map[byte]string{
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "-1",
+	OP_NOP:                 "OP_NOP",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_1ADD:                "OP_1ADD",
+	OP_1SUB:                "OP_1SUB",
+	OP_NEGATE:              "OP_NEGATE",
+	OP_NOT:                 "OP_NOT",
+	OP_ADD:                 "OP_ADD",
+	OP_SUB:                 "OP_SUB",
+	OP_BOOLAND:             "OP_BOOLAND",
+	OP_BOOLOR:              "OP_BOOLOR",
+	OP_NUMEQUAL:            "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY:      "OP_NUMEQUALVERIFY",
+	OP_LESSTHAN:            "OP_LESSTHAN",
+	OP_GREATERTHAN:         "OP_GREATERTHAN",
+	OP_MIN:                 "OP_MIN",
+	OP_MAX:                 "OP_MAX",
+	OP_WITHIN:              "OP_WITHIN",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// スクリプトの制限
+const maxScriptElementSize = 520 // プッシュできるデータの最大バイト数
+const maxStackSize = 1000        // スタックの最大要素数
+const maxScriptNumLen = 4        // 数値として扱うデータの最大バイト数
+const maxMultisigKeys = 20       // マルチシグの公開鍵の最大数
+const maxDataCarrierSize = 80    // データ出力に埋め込めるデータの最大バイト数
+
+// スクリプトの種類
+const (
+	ScriptNonStandard = "nonstandard" // 標準以外
+	ScriptPubKeyHash  = "pubkeyhash"  // P2PKH
+	ScriptScriptHash  = "scripthash"  // P2SH
+	ScriptMultisig    = "multisig"    // M-of-Nマルチシグ
+	ScriptNullData    = "nulldata"    // OP_RETURNによるデータ出力
+)
+
+// スクリプトの評価に失敗した場合のエラー
+var ErrScriptFailed = errors.New("スクリプトの検証に失敗しました")
+
+// 評価失敗の原因を付けたエラーの生成
+func scriptError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrScriptFailed, fmt.Sprintf(format, args...))
+}
+
+// スクリプトを構成する命令
+type scriptOp struct {
+	opcode byte   // オペコード
+	data   []byte // プッシュするデータ（プッシュ命令の場合）
+}
+
+// データをプッシュする命令か（OP_0 〜 OP_PUSHDATA2）
+func (op scriptOp) isPushData() bool {
+	return op.opcode <= OP_PUSHDATA2
+}
+
+// バイト列のスクリプトを命令の並びに分解
+// 途中で終わっている場合はそこまでの命令とエラーを返す
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+		var n int
+		switch {
+		case opcode < OP_PUSHDATA1:
+			n = int(opcode) // オペコードの値がそのままデータ長
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return ops, scriptError("スクリプトが途中で終わっています")
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return ops, scriptError("スクリプトが途中で終わっています")
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		default:
+			ops = append(ops, scriptOp{opcode, nil})
+			continue
+		}
+		if i+n > len(script) {
+			return ops, scriptError("スクリプトが途中で終わっています")
+		}
+		ops = append(ops, scriptOp{opcode, script[i : i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+// データのプッシュのみで構成されたスクリプトか
+func isPushOnly(script []byte) bool {
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			return false
+		}
+	}
+	return true
+}
+
+// データをプッシュする命令を生成
+// データ長に応じて最短の命令を選ぶ
+func pushData(data []byte) []byte {
+	n := len(data)
+	switch {
+	case n == 0:
+		return []byte{OP_0}
+	case n < OP_PUSHDATA1:
+		return append([]byte{byte(n)}, data...)
+	case n <= 0xff:
+		return append([]byte{OP_PUSHDATA1, byte(n)}, data...)
+	default:
+		prefix := []byte{OP_PUSHDATA2, 0, 0}
+		binary.LittleEndian.PutUint16(prefix[1:], uint16(n))
+		return append(prefix, data...)
+	}
+}
+
+// 数値をプッシュする命令を生成
+func pushInt(n int64) []byte {
+	switch {
+	case n == 0:
+		return []byte{OP_0}
+	case n == -1:
+		return []byte{OP_1NEGATE}
+	case n >= 1 && n <= 16:
+		return []byte{byte(OP_1 + n - 1)}
+	}
+	return pushData(encodeScriptNum(n))
+}
+
+// 数値をスクリプト上の表現に変換
+// リトルエンディアンで、最上位バイトの最上位ビットが符号
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	// 最上位ビットが使われている場合は符号用のバイトを追加
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+// スクリプト上の表現から数値に変換
+func decodeScriptNum(data []byte) (int64, error) {
+	if len(data) > maxScriptNumLen {
+		return 0, scriptError("数値が%dバイトを超えています", maxScriptNumLen)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+	last := len(data) - 1
+	if data[last]&0x80 != 0 {
+		result &^= int64(0x80) << uint(8*last)
+		return -result, nil
+	}
+	return result, nil
+}
+
+// スタック上のデータを真偽値として解釈
+// 全て0（負の0を含む）の場合は偽
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// 最後のバイトが0x80の場合は負の0
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+// 真偽値をスタック上の表現に変換
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// スクリプトの実行環境
+type scriptEngine struct {
+	tx         *Transaction // 検証するトランザクション
+	inputIndex int          // 検証する入力のインデックス
+	stack      [][]byte     // スタック
+}
+
+// スタックにプッシュ
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+// スタックからポップ
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, scriptError("スタックが空です")
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+// スタックから数値としてポップ
+func (e *scriptEngine) popNum() (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data)
+}
+
+// スタックから真偽値としてポップ
+func (e *scriptEngine) popBool() (bool, error) {
+	data, err := e.pop()
+	if err != nil {
+		return false, err
+	}
+	return castToBool(data), nil
+}
+
+// スクリプトの実行
+// CHECKSIGの署名対象には実行中のスクリプトscriptを用いる
+func (e *scriptEngine) execute(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	var conditions []bool // OP_IFの条件のスタック
+	for _, op := range ops {
+		if len(op.data) > maxScriptElementSize {
+			return scriptError("プッシュするデータが%dバイトを超えています", maxScriptElementSize)
+		}
+		executing := true
+		for _, c := range conditions {
+			executing = executing && c
+		}
+
+		// 制御構文は実行しない分岐の中でも対応関係を追う
+		switch op.opcode {
+		case OP_IF, OP_NOTIF:
+			value := false
+			if executing {
+				value, err = e.popBool()
+				if err != nil {
+					return err
+				}
+				if op.opcode == OP_NOTIF {
+					value = !value
+				}
+			}
+			conditions = append(conditions, value)
+			continue
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return scriptError("OP_IFのないOP_ELSEです")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return scriptError("OP_IFのないOP_ENDIFです")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+		if !executing {
+			continue
+		}
+
+		err = e.step(op, script)
+		if err != nil {
+			return err
+		}
+		if len(e.stack) > maxStackSize {
+			return scriptError("スタックの要素数が%dを超えています", maxStackSize)
+		}
+	}
+	if len(conditions) != 0 {
+		return scriptError("OP_ENDIFがありません")
+	}
+	return nil
+}
+
+// 命令を1つ実行
+func (e *scriptEngine) step(op scriptOp, script []byte) error {
+	// データと数値のプッシュ
+	switch {
+	case op.isPushData():
+		e.push(append([]byte{}, op.data...))
+		return nil
+	case op.opcode == OP_1NEGATE:
+		e.push(encodeScriptNum(-1))
+		return nil
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		e.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+	case OP_VERIFY:
+		ok, err := e.popBool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return scriptError("OP_VERIFYが失敗しました")
+		}
+	case OP_RETURN:
+		return scriptError("OP_RETURNが実行されました")
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(top)
+		e.push(append([]byte{}, top...))
+	case OP_SWAP:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(a)
+		e.push(b)
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return scriptError("スタックが空です")
+		}
+		e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.opcode == OP_EQUALVERIFY {
+			if !equal {
+				return scriptError("OP_EQUALVERIFYが失敗しました")
+			}
+			return nil
+		}
+		e.push(boolBytes(equal))
+	case OP_1ADD, OP_1SUB, OP_NEGATE, OP_NOT:
+		a, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_1ADD:
+			e.push(encodeScriptNum(a + 1))
+		case OP_1SUB:
+			e.push(encodeScriptNum(a - 1))
+		case OP_NEGATE:
+			e.push(encodeScriptNum(-a))
+		case OP_NOT:
+			e.push(boolBytes(a == 0))
+		}
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY,
+		OP_LESSTHAN, OP_GREATERTHAN, OP_MIN, OP_MAX:
+		b, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_ADD:
+			e.push(encodeScriptNum(a + b))
+		case OP_SUB:
+			e.push(encodeScriptNum(a - b))
+		case OP_BOOLAND:
+			e.push(boolBytes(a != 0 && b != 0))
+		case OP_BOOLOR:
+			e.push(boolBytes(a != 0 || b != 0))
+		case OP_NUMEQUAL:
+			e.push(boolBytes(a == b))
+		case OP_NUMEQUALVERIFY:
+			if a != b {
+				return scriptError("OP_NUMEQUALVERIFYが失敗しました")
+			}
+		case OP_LESSTHAN:
+			e.push(boolBytes(a < b))
+		case OP_GREATERTHAN:
+			e.push(boolBytes(a > b))
+		case OP_MIN:
+			if b < a {
+				a = b
+			}
+			e.push(encodeScriptNum(a))
+		case OP_MAX:
+			if b > a {
+				a = b
+			}
+			e.push(encodeScriptNum(a))
+		}
+	case OP_WITHIN:
+		// x min max → min <= x < max
+		upper, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		lower, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		e.push(boolBytes(lower <= x && x < upper))
+	case OP_SHA256:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		e.push(hash[:])
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(HashPubKey(data))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+		ok := e.checkSig(sig, pubKey, script)
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !ok {
+				return scriptError("OP_CHECKSIGVERIFYが失敗しました")
+			}
+			return nil
+		}
+		e.push(boolBytes(ok))
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig(script)
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return scriptError("OP_CHECKMULTISIGVERIFYが失敗しました")
+			}
+			return nil
+		}
+		e.push(boolBytes(ok))
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+	default:
+		return scriptError("不明なオペコード 0x%02x", op.opcode)
+	}
+	return nil
+}
+
+// スタックの先頭の数値を取り除かずに読む
+func (e *scriptEngine) peekNum() (int64, error) {
+	if len(e.stack) == 0 {
+		return 0, scriptError("スタックが空です")
+	}
+	return decodeScriptNum(e.stack[len(e.stack)-1])
+}
+
+// OP_CHECKLOCKTIMEVERIFY
+// トランザクションのLockTimeがスタックの先頭の値以上（同じ種類）であることを確認する
+// LockTimeはブロックの検証で強制されるため、その高さ・時刻までは出力を使用できない
+func (e *scriptEngine) checkLockTime() error {
+	lockTime, err := e.peekNum()
+	if err != nil {
+		return err
+	}
+	if lockTime < 0 {
+		return scriptError("ロックタイムが負の値です")
+	}
+	if e.tx == nil {
+		return scriptError("OP_CHECKLOCKTIMEVERIFYが失敗しました")
+	}
+	txLockTime := int64(e.tx.LockTime)
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return scriptError("ロックタイムの種類（高さ・時刻）が一致しません")
+	}
+	if lockTime > txLockTime {
+		return scriptError("ロックタイム %d に達していません", lockTime)
+	}
+	// SequenceがsequenceFinalの場合はLockTimeが無視されるため認めない
+	if e.tx.Vin[e.inputIndex].Sequence == sequenceFinal {
+		return scriptError("入力のSequenceによりロックタイムが無効になっています")
+	}
+	return nil
+}
+
+// OP_CHECKSEQUENCEVERIFY
+// 入力の相対ロックタイムがスタックの先頭のブロック数以上であることを確認する
+func (e *scriptEngine) checkSequence() error {
+	blocks, err := e.peekNum()
+	if err != nil {
+		return err
+	}
+	if blocks < 0 {
+		return scriptError("相対ロックタイムが負の値です")
+	}
+	if e.tx == nil {
+		return scriptError("OP_CHECKSEQUENCEVERIFYが失敗しました")
+	}
+	sequence := e.tx.Vin[e.inputIndex].Sequence
+	if sequence&sequenceLockTimeDisableFlag != 0 {
+		return scriptError("入力の相対ロックタイムが無効になっています")
+	}
+	if blocks&sequenceLockTimeMask > int64(sequence&sequenceLockTimeMask) {
+		return scriptError("相対ロックタイム %d ブロックに達していません", blocks&sequenceLockTimeMask)
+	}
+	return nil
+}
+
+// 署名の検証
+func (e *scriptEngine) checkSig(sig, pubKey, script []byte) bool {
+	if e.tx == nil {
+		return false
+	}
+	return verifySignature(pubKey, e.tx.SignatureHash(e.inputIndex, script), sig)
+}
+
+// M-of-Nマルチシグの検証
+// スタックは ダミー 署名1..署名M M 公開鍵1..公開鍵N N の順
+// ビットコインと同じく先頭に余分なダミー要素（空であること）を必要とする
+func (e *scriptEngine) checkMultisig(script []byte) (bool, error) {
+	n, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return false, scriptError("公開鍵の数 %d が正しくありません", n)
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		pubKeys[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+	m, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, scriptError("必要な署名の数 %d が正しくありません", m)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		sigs[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+	dummy, err := e.pop()
+	if err != nil {
+		return false, err
+	}
+	if len(dummy) != 0 {
+		return false, scriptError("OP_CHECKMULTISIGのダミー要素が空ではありません")
+	}
+
+	// 署名は公開鍵と同じ順に並んでいなければならない
+	k := 0
+	for _, sig := range sigs {
+		for k < len(pubKeys) && !e.checkSig(sig, pubKeys[k], script) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// 入力のScriptSigと参照先のScriptPubKeyを ScriptSig || ScriptPubKey の順に評価する
+// ScriptPubKeyがP2SHの場合は、ScriptSigの最後にプッシュされた
+// redeemスクリプトをさらに評価する
+func VerifyScript(scriptSig, scriptPubKey []byte, tx *Transaction, inputIndex int) error {
+	if !isPushOnly(scriptSig) {
+		return scriptError("ScriptSigはデータのプッシュのみで構成してください")
+	}
+	e := &scriptEngine{tx: tx, inputIndex: inputIndex}
+	err := e.execute(scriptSig)
+	if err != nil {
+		return err
+	}
+	sigStack := append([][]byte{}, e.stack...)
+
+	err = e.execute(scriptPubKey)
+	if err != nil {
+		return err
+	}
+	if ok, err := e.popBool(); err != nil || !ok {
+		return scriptError("ScriptPubKeyの評価結果が偽です")
+	}
+
+	if ClassifyScript(scriptPubKey) != ScriptScriptHash {
+		return nil
+	}
+	if len(sigStack) == 0 {
+		return scriptError("redeemスクリプトがありません")
+	}
+	redeemScript := sigStack[len(sigStack)-1]
+	e.stack = sigStack[:len(sigStack)-1]
+	err = e.execute(redeemScript)
+	if err != nil {
+		return err
+	}
+	if ok, err := e.popBool(); err != nil || !ok {
+		return scriptError("redeemスクリプトの評価結果が偽です")
+	}
+	return nil
+}
+
+// P2PKH: OP_DUP OP_HASH160 <公開鍵ハッシュ> OP_EQUALVERIFY OP_CHECKSIG
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = append(script, pushData(pubKeyHash)...)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// P2SH: OP_HASH160 <スクリプトハッシュ> OP_EQUAL
+func NewP2SHScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = append(script, pushData(scriptHash)...)
+	return append(script, OP_EQUAL)
+}
+
+// M-of-Nマルチシグ: M <公開鍵1> ... <公開鍵N> N OP_CHECKMULTISIG
+func NewMultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > 16 || m < 1 || m > n {
+		return nil, fmt.Errorf("%d-of-%dのマルチシグは作成できません", m, n)
+	}
+	script := pushInt(int64(m))
+	for _, pubKey := range pubKeys {
+		script = append(script, pushData(pubKey)...)
+	}
+	script = append(script, pushInt(int64(n))...)
+	return append(script, OP_CHECKMULTISIG), nil
+}
+
+// データ出力: OP_RETURN <データ>
+// 使用できない出力にデータを埋め込む
+func NewNullDataScript(data []byte) ([]byte, error) {
+	if len(data) > maxDataCarrierSize {
+		return nil, fmt.Errorf("埋め込めるデータは%dバイトまでです", maxDataCarrierSize)
+	}
+	return append([]byte{OP_RETURN}, pushData(data)...), nil
+}
+
+// アドレスに支払うScriptPubKeyの生成
+// アドレスのバージョンによりP2PKHまたはP2SHとなる
+func PayToAddrScript(address string) ([]byte, error) {
+	if !ValidateAddress(address) {
+		return nil, fmt.Errorf("アドレス'%s'が正しくありません", address)
+	}
+	hash := AddressToPubKeyHash([]byte(address))
+	if Base58Decode([]byte(address))[0] == scriptHashVersion {
+		return NewP2SHScript(hash), nil
+	}
+	return NewP2PKHScript(hash), nil
+}
+
+// スクリプトの種類を判定
+func ClassifyScript(script []byte) string {
+	switch {
+	case ExtractPubKeyHash(script) != nil:
+		return ScriptPubKeyHash
+	case ExtractScriptHash(script) != nil:
+		return ScriptScriptHash
+	}
+	if _, ok := ExtractNullData(script); ok {
+		return ScriptNullData
+	}
+	if _, _, ok := ExtractMultisig(script); ok {
+		return ScriptMultisig
+	}
+	return ScriptNonStandard
+}
+
+// データ出力のスクリプトから埋め込まれたデータを取り出す
+func ExtractNullData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil, false
+	}
+	ops, err := parseScript(script[1:])
+	if err != nil || len(ops) != 1 || !ops[0].isPushData() || len(ops[0].data) > maxDataCarrierSize {
+		return nil, false
+	}
+	return ops[0].data, true
+}
+
+// P2PKHスクリプトから公開鍵ハッシュを取り出す（P2PKHでない場合はnil）
+func ExtractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 &&
+		script[2] == 20 && script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+	return nil
+}
+
+// P2SHスクリプトからスクリプトハッシュを取り出す（P2SHでない場合はnil）
+func ExtractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OP_HASH160 &&
+		script[1] == 20 && script[22] == OP_EQUAL {
+		return script[2:22]
+	}
+	return nil
+}
+
+// マルチシグのスクリプトから必要な署名数と公開鍵を取り出す
+func ExtractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	smallInt := func(op scriptOp) int {
+		if op.opcode >= OP_1 && op.opcode <= OP_16 {
+			return int(op.opcode-OP_1) + 1
+		}
+		return 0
+	}
+	m := smallInt(ops[0])
+	n := smallInt(ops[len(ops)-2])
+	keyOps := ops[1 : len(ops)-2]
+	if m == 0 || n == 0 || m > n || len(keyOps) != n {
+		return 0, nil, false
+	}
+	var pubKeys [][]byte
+	for _, op := range keyOps {
+		if !op.isPushData() || len(op.data) != 64 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+// スクリプトに対応するアドレス
+// マルチシグの場合は各公開鍵のアドレスを返す
+func ScriptAddresses(script []byte) []string {
+	if hash := ExtractPubKeyHash(script); hash != nil {
+		return []string{string(encodeAddress(version, hash))}
+	}
+	if hash := ExtractScriptHash(script); hash != nil {
+		return []string{string(encodeAddress(scriptHashVersion, hash))}
+	}
+	var addresses []string
+	if _, pubKeys, ok := ExtractMultisig(script); ok {
+		for _, pubKey := range pubKeys {
+			addresses = append(addresses, string(encodeAddress(version, HashPubKey(pubKey))))
+		}
+	}
+	return addresses
+}
+
+// redeemスクリプトに支払うP2SHアドレス
+func ScriptHashAddress(script []byte) string {
+	return string(encodeAddress(scriptHashVersion, HashPubKey(script)))
+}
+
+// スクリプトを人が読める形式に変換
+// データは16進数、1〜16の数値はそのまま表示する
+func DisassembleScript(script []byte) string {
+	ops, err := parseScript(script)
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.opcode == OP_0:
+			words = append(words, "0")
+		case op.isPushData():
+			words = append(words, hex.EncodeToString(op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			words = append(words, fmt.Sprint(op.opcode-OP_1+1))
+		default:
+			name, ok := opcodeNames[op.opcode]
+			if !ok {
+				name = fmt.Sprintf("OP_UNKNOWN_0x%02x", op.opcode)
+			}
+			words = append(words, name)
+		}
+	}
+	if err != nil {
+		words = append(words, "[error]")
+	}
+	return strings.Join(words, " ")
+}
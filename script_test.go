@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// 1入力1出力の署名対象トランザクション
+func newScriptTestTx() *Transaction {
+	tx := &Transaction{
+		Vin:  []TXInput{{[]byte{1, 2, 3}, 0, nil, sequenceFinal}},
+		Vout: []TXOutput{{5, NewP2PKHScript(make([]byte, 20))}},
+	}
+	return tx
+}
+
+// 数値の表現
+func TestScriptNum(t *testing.T) {
+	tests := []struct {
+		n       int64
+		encoded []byte
+	}{
+		{0, []byte{}},
+		{1, []byte{0x01}},
+		{-1, []byte{0x81}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x00}},
+		{-128, []byte{0x80, 0x80}},
+		{255, []byte{0xff, 0x00}},
+		{256, []byte{0x00, 0x01}},
+	}
+	for _, test := range tests {
+		encoded := encodeScriptNum(test.n)
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("encodeScriptNum(%d) = %x, want %x", test.n, encoded, test.encoded)
+		}
+		n, err := decodeScriptNum(encoded)
+		if err != nil || n != test.n {
+			t.Errorf("decodeScriptNum(%x) = %d, %v", encoded, n, err)
+		}
+	}
+}
+
+// 署名を使わないスクリプトの評価
+func TestVerifyScriptArithmetic(t *testing.T) {
+	tests := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		ok           bool
+	}{
+		{"add", pushInt(2), joinScript(pushInt(3), []byte{OP_ADD}, pushInt(5), []byte{OP_EQUAL}), true},
+		{"add wrong", pushInt(2), joinScript(pushInt(2), []byte{OP_ADD}, pushInt(5), []byte{OP_EQUAL}), false},
+		{"if", pushInt(1), []byte{OP_IF, OP_1, OP_ELSE, OP_0, OP_ENDIF}, true},
+		{"else", pushInt(0), []byte{OP_IF, OP_1, OP_ELSE, OP_0, OP_ENDIF}, false},
+		{"within", pushInt(5), joinScript(pushInt(1), pushInt(10), []byte{OP_WITHIN}), true},
+		{"return", nil, []byte{OP_1, OP_RETURN}, false},
+		{"unbalanced if", pushInt(1), []byte{OP_IF, OP_1}, false},
+		{"not push only", []byte{OP_1, OP_DUP}, []byte{OP_EQUAL}, false},
+	}
+	for _, test := range tests {
+		err := VerifyScript(test.scriptSig, test.scriptPubKey, nil, 0)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: VerifyScript() = %v, want ok=%v", test.name, err, test.ok)
+		}
+		if err != nil && !errors.Is(err, ErrScriptFailed) {
+			t.Errorf("%s: error %v is not ErrScriptFailed", test.name, err)
+		}
+	}
+}
+
+// スクリプトの断片を連結
+func joinScript(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// P2PKHの署名と検証
+func TestVerifyScriptP2PKH(t *testing.T) {
+	wallet := NewWallet()
+	other := NewWallet()
+	scriptPubKey := NewP2PKHScript(HashPubKey(wallet.PublicKey))
+	if ClassifyScript(scriptPubKey) != ScriptPubKeyHash {
+		t.Fatalf("ClassifyScript() = %s", ClassifyScript(scriptPubKey))
+	}
+
+	tx := newScriptTestTx()
+	sig := signHash(wallet.PrivateKey, tx.SignatureHash(0, scriptPubKey))
+	scriptSig := append(pushData(sig), pushData(wallet.PublicKey)...)
+	if err := VerifyScript(scriptSig, scriptPubKey, tx, 0); err != nil {
+		t.Errorf("VerifyScript() = %v", err)
+	}
+
+	// 別の鍵の公開鍵では公開鍵ハッシュが一致しない
+	badSig := append(pushData(sig), pushData(other.PublicKey)...)
+	if err := VerifyScript(badSig, scriptPubKey, tx, 0); err == nil {
+		t.Error("VerifyScript() succeeded with another public key")
+	}
+
+	// 署名後に出力を書き換えると検証に失敗する
+	tx.Vout[0].Value = 6
+	if err := VerifyScript(scriptSig, scriptPubKey, tx, 0); err == nil {
+		t.Error("VerifyScript() succeeded after modifying the transaction")
+	}
+}
+
+// P2SHでラップした2-of-3マルチシグ
+func TestVerifyScriptP2SHMultisig(t *testing.T) {
+	wallets := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	var pubKeys [][]byte
+	for _, w := range wallets {
+		pubKeys = append(pubKeys, w.PublicKey)
+	}
+	redeemScript, err := NewMultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, keys, ok := ExtractMultisig(redeemScript); !ok || m != 2 || len(keys) != 3 {
+		t.Fatalf("ExtractMultisig() = %d, %d keys, %v", m, len(keys), ok)
+	}
+	scriptPubKey := NewP2SHScript(HashPubKey(redeemScript))
+	if ClassifyScript(scriptPubKey) != ScriptScriptHash {
+		t.Fatalf("ClassifyScript() = %s", ClassifyScript(scriptPubKey))
+	}
+
+	tx := newScriptTestTx()
+	hash := tx.SignatureHash(0, redeemScript)
+	sigs := make([][]byte, 3)
+	for i, w := range wallets {
+		sigs[i] = signHash(w.PrivateKey, hash)
+	}
+	scriptSig := func(sigs ...[]byte) []byte {
+		script := []byte{OP_0} // OP_CHECKMULTISIGのダミー要素
+		for _, sig := range sigs {
+			script = append(script, pushData(sig)...)
+		}
+		return append(script, pushData(redeemScript)...)
+	}
+
+	tests := []struct {
+		name string
+		sigs [][]byte
+		ok   bool
+	}{
+		{"keys 0,1", [][]byte{sigs[0], sigs[1]}, true},
+		{"keys 0,2", [][]byte{sigs[0], sigs[2]}, true},
+		{"keys 1,2", [][]byte{sigs[1], sigs[2]}, true},
+		{"wrong order", [][]byte{sigs[2], sigs[0]}, false},
+		{"duplicate", [][]byte{sigs[1], sigs[1]}, false},
+		{"one signature", [][]byte{sigs[0]}, false},
+	}
+	for _, test := range tests {
+		err := VerifyScript(scriptSig(test.sigs...), scriptPubKey, tx, 0)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: VerifyScript() = %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+}
+
+// OP_CHECKLOCKTIMEVERIFYとOP_CHECKSEQUENCEVERIFY
+func TestVerifyScriptLocks(t *testing.T) {
+	cltv := joinScript(pushInt(100), []byte{OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_1})
+	csv := joinScript(pushInt(10), []byte{OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1})
+	tests := []struct {
+		name         string
+		scriptPubKey []byte
+		lockTime     uint32
+		sequence     uint32
+		ok           bool
+	}{
+		{"cltv reached", cltv, 100, 0, true},
+		{"cltv not reached", cltv, 99, 0, false},
+		{"cltv final sequence", cltv, 100, sequenceFinal, false},
+		{"cltv time lock", cltv, lockTimeThreshold, 0, false},
+		{"csv reached", csv, 0, 10, true},
+		{"csv not reached", csv, 0, 9, false},
+		{"csv disabled", csv, 0, sequenceLockTimeDisableFlag | 10, false},
+	}
+	for _, test := range tests {
+		tx := newScriptTestTx()
+		tx.LockTime = test.lockTime
+		tx.Vin[0].Sequence = test.sequence
+		err := VerifyScript(nil, test.scriptPubKey, tx, 0)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: VerifyScript() = %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+}
+
+// データ出力
+func TestNullDataScript(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, maxDataCarrierSize)
+	script, err := NewNullDataScript(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ClassifyScript(script) != ScriptNullData {
+		t.Errorf("ClassifyScript() = %s", ClassifyScript(script))
+	}
+	if embedded, ok := ExtractNullData(script); !ok || !bytes.Equal(embedded, data) {
+		t.Errorf("ExtractNullData() = %x, %v", embedded, ok)
+	}
+	out := TXOutput{0, script}
+	if !out.IsUnspendable() {
+		t.Error("IsUnspendable() = false")
+	}
+	if err := VerifyScript(nil, script, newScriptTestTx(), 0); err == nil {
+		t.Error("VerifyScript() succeeded for a data output")
+	}
+	if _, err := NewNullDataScript(append(data, 0)); err == nil {
+		t.Error("NewNullDataScript() accepted too much data")
+	}
+}
+
+// 逆アセンブル
+func TestDisassembleScript(t *testing.T) {
+	script := NewP2PKHScript(bytes.Repeat([]byte{0xab}, 20))
+	want := "OP_DUP OP_HASH160 abababababababababababababababababababab OP_EQUALVERIFY OP_CHECKSIG"
+	if got := DisassembleScript(script); got != want {
+		t.Errorf("DisassembleScript() = %s, want %s", got, want)
+	}
+	if got := DisassembleScript(append(pushInt(2), 0x05, 0x01)); got != "2 [error]" {
+		t.Errorf("DisassembleScript() = %s", got)
+	}
+}
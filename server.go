@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ネットワークを識別するマジック値（メッセージの先頭に付ける）
+var networkMagic = []byte{0x6d, 0x79, 0x62, 0x63}
+
+const (
+	protocolVersion = 2                // プロトコルのバージョン（2からヘッダーを先に同期する）
+	commandLength   = 12               // コマンド名のバイト数（末尾は0で埋める）
+	headerLength    = 4 + 12 + 4 + 4   // マジック値、コマンド名、長さ、チェックサム
+	maxMessageSize  = 32 * 1024 * 1024 // ペイロードの上限
+	maxInvSize      = 500              // 1つのinvとgetdataで扱う項目数の上限
+	maxHeadersSize  = 2000             // 1つのheadersで送るヘッダー数の上限
+	writeTimeout    = 30 * time.Second // 送信のタイムアウト
+	dialTimeout     = 10 * time.Second // 接続のタイムアウト
+	sendQueueSize   = 2 * maxInvSize   // 1つのノードへの送信待ちのメッセージ数の上限
+)
+
+// ブロック本体のダウンロード
+const (
+	downloadWindow       = 128              // ダウンロードの予定の先頭から何個先までのブロックを要求するか
+	maxBlocksInFlight    = 16               // 1つのノードに同時に要求するブロック数の上限
+	blockDownloadTimeout = 20 * time.Second // 要求したブロックが届くまでの待ち時間
+	downloadCheckPeriod  = time.Second      // 待ち時間を過ぎた要求を確認する間隔
+	syncProgressInterval = 100              // 同期中に進捗を表示する間隔（ブロック数）
+)
+
+// invとgetdataで扱うデータの種類
+const (
+	invTypeBlock = "block"
+	invTypeTx    = "tx"
+)
+
+// メッセージの受信で発生するエラー
+var (
+	ErrBadMagic       = errors.New("ネットワークのマジック値が一致しません")
+	ErrBadChecksum    = errors.New("メッセージのチェックサムが一致しません")
+	ErrMessageTooLong = errors.New("メッセージが大きすぎます")
+)
+
+// 各メッセージのペイロード
+type versionPayload struct {
+	Version    int    // プロトコルのバージョン
+	BestHeight int    // 最終ブロックの高さ（ブロックがない場合は-1）
+	AddrFrom   string // 送信元の待ち受けアドレス
+}
+
+type getheadersPayload struct {
+	Locator [][]byte // 持っているヘッダーのハッシュ値（新しい順）
+}
+
+type headersPayload struct {
+	Headers []*BlockHeader // 古い順
+}
+
+type invPayload struct {
+	Type  string
+	Items [][]byte
+}
+
+type getdataPayload struct {
+	Type  string
+	Items [][]byte
+}
+
+type blockPayload struct {
+	Block *Block
+}
+
+type txPayload struct {
+	Transaction *Transaction
+}
+
+// 同期状況（getstatusへの応答）
+type syncStatusPayload struct {
+	BlockHeight  int          // 最終ブロックの高さ
+	HeaderHeight int          // 最も仕事量の多いヘッダーの高さ
+	InFlight     int          // 要求中のブロック数
+	Pending      int          // 受信済みで前のブロックを待っているブロック数
+	Peers        []peerStatus // 接続中のノード
+}
+
+type peerStatus struct {
+	Addr       string
+	BestHeight int // 相手が持っているとわかっている高さ
+	InFlight   int // 相手に要求中のブロック数
+}
+
+// メモリプールの内容（getmempoolへの応答）
+type mempoolPayload struct {
+	Info         MempoolInfo
+	Transactions []MempoolTxInfo // 受け付けた順
+}
+
+// ペイロードのチェックサム（ダブルSHA-256の先頭4バイト）
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// メッセージの書き込み
+// マジック値 | コマンド名 | ペイロードの長さ（リトルエンディアン） | チェックサム | ペイロード
+// ペイロードはgobでエンコードする（nilの場合は空）
+func writeMessage(w io.Writer, command string, payload interface{}) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("コマンド名が長すぎます: %s", command)
+	}
+	var data []byte
+	if payload != nil {
+		var buff bytes.Buffer
+		if err := gob.NewEncoder(&buff).Encode(payload); err != nil {
+			return err
+		}
+		data = buff.Bytes()
+	}
+	header := make([]byte, headerLength)
+	copy(header, networkMagic)
+	copy(header[4:], command)
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	copy(header[20:], messageChecksum(data))
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+// メッセージの読み込み
+// コマンド名とデコード前のペイロードを返す
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(header[:4], networkMagic) {
+		return "", nil, ErrBadMagic
+	}
+	command := string(bytes.TrimRight(header[4:16], "\x00"))
+	length := binary.LittleEndian.Uint32(header[16:])
+	if length > maxMessageSize {
+		return "", nil, ErrMessageTooLong
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(header[20:], messageChecksum(payload)) {
+		return "", nil, ErrBadChecksum
+	}
+	return command, payload, nil
+}
+
+// ペイロードのデコード
+func decodePayload(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// 接続中のノード
+type peer struct {
+	conn       net.Conn
+	addr       string          // 相手の待ち受けアドレス（versionで通知される）
+	outbound   bool            // こちらから接続した
+	version    *versionPayload // 受信したversion（ハンドシェイク前はnil）
+	bestHeight int             // 相手が持っているとわかっている高さ
+	inFlight   int             // 相手に要求中のブロック数
+
+	queue  chan outMessage // 送信待ちのメッセージ
+	closed chan struct{}   // 接続を終了すると閉じる
+}
+
+// 送信待ちのメッセージ
+type outMessage struct {
+	command string
+	payload interface{}
+}
+
+// ノードの生成
+func newPeer(conn net.Conn, addr string, outbound bool) *peer {
+	return &peer{
+		conn:       conn,
+		addr:       addr,
+		outbound:   outbound,
+		bestHeight: -1,
+		queue:      make(chan outMessage, sendQueueSize),
+		closed:     make(chan struct{}),
+	}
+}
+
+// メッセージを送信待ちに加える
+// 送信はノードごとのgoroutine（writeLoop）が行うため、ロック中に呼んでも待たされない
+// 送信待ちがあふれた（相手が受信しない）場合は切断する
+func (p *peer) send(command string, payload interface{}) error {
+	select {
+	case p.queue <- outMessage{command, payload}:
+		return nil
+	case <-p.closed:
+		return net.ErrClosed
+	default:
+		p.conn.Close()
+		return errors.New("送信待ちのメッセージが多すぎます")
+	}
+}
+
+// 送信待ちのメッセージを順に送信する
+// 送信に失敗した場合は接続を閉じ、受信側で切断の処理を行う
+func (p *peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.queue:
+			if err := p.write(msg.command, msg.payload); err != nil {
+				p.conn.Close()
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// メッセージをすぐに送信する
+// 送信用のgoroutineを持たない一時的な接続で使う
+func (p *peer) write(command string, payload interface{}) error {
+	p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(p.conn, command, payload)
+}
+
+// commandのメッセージを受信するまで待ち、ペイロードをvにデコードする（vがnilの場合は捨てる）
+func (p *peer) waitFor(command string, v interface{}) error {
+	p.conn.SetReadDeadline(time.Now().Add(writeTimeout))
+	for {
+		received, payload, err := readMessage(p.conn)
+		if err != nil {
+			return err
+		}
+		if received != command {
+			continue
+		}
+		if v == nil {
+			return nil
+		}
+		return decodePayload(payload, v)
+	}
+}
+
+// 要求中のブロック
+type blockRequest struct {
+	peer     *peer
+	deadline time.Time
+}
+
+// 受信済みで前のブロックの追加を待っているブロック
+type pendingBlock struct {
+	block *Block
+	from  *peer
+}
+
+// P2Pノード
+// ブロックチェーン、メモリプール、接続中のノード、ダウンロードの状態はmuで保護する
+type Server struct {
+	address string // 待ち受けアドレス
+	miner   string // 採掘報酬を受け取るアドレス（空の場合は採掘しない）
+	bc      *Blockchain
+
+	mu            sync.Mutex
+	peers         map[*peer]bool
+	mempool       *Mempool                 // 未承認のトランザクション
+	cancelMining  context.CancelFunc       // 採掘中の場合は中断用の関数
+	downloadQueue []*BlockHeader           // 本体を持っていないブロックのヘッダー（古い順）
+	inFlight      map[string]*blockRequest // 要求中のブロック（キーはハッシュ値）
+	pending       map[string]*pendingBlock // 受信済みで未追加のブロック（キーはハッシュ値）
+}
+
+// P2Pノードの生成
+// 前回停止したときのメモリプールを読み込む
+func NewServer(address, miner string, bc *Blockchain) *Server {
+	return &Server{
+		address:  address,
+		miner:    miner,
+		bc:       bc,
+		peers:    make(map[*peer]bool),
+		mempool:  LoadMempool(bc),
+		inFlight: make(map[string]*blockRequest),
+		pending:  make(map[string]*pendingBlock),
+	}
+}
+
+// ノードの起動
+// seedsの各ノードに接続してブロックチェーンを同期する
+// ctxが終了するまで他のノードからの接続を待ち受ける
+func (s *Server) Run(ctx context.Context, seeds []string) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ノードを起動しました: %s 高さ %d\n", s.address, s.bestHeight())
+	if s.miner != "" {
+		fmt.Printf("採掘報酬の受取先: %s\n", s.miner)
+	}
+	if info := s.mempool.Info(); info.Count > 0 {
+		fmt.Printf("メモリプールを読み込みました: %d 件\n", info.Count)
+	}
+	for _, seed := range seeds {
+		if err := s.Connect(seed); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	// ブロックが届かないノードを定期的に確認する
+	go func() {
+		ticker := time.NewTicker(downloadCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkDownloads()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		go s.handlePeer(newPeer(conn, conn.RemoteAddr().String(), false))
+	}
+
+	// 採掘と全ての接続を終了し、メモリプールを保存する
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelMining != nil {
+		s.cancelMining()
+	}
+	for p := range s.peers {
+		p.conn.Close()
+	}
+	s.mempool.Save()
+	return nil
+}
+
+// 他のノードに接続し、versionを送信する
+func (s *Server) Connect(address string) error {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	p := newPeer(conn, address, true)
+	fmt.Printf("%s に接続しました\n", address)
+	p.send("version", s.versionPayload())
+	go s.handlePeer(p)
+	return nil
+}
+
+// 最終ブロックの高さ
+func (s *Server) bestHeight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bc.GetBestHeight()
+}
+
+func (s *Server) versionPayload() versionPayload {
+	return versionPayload{protocolVersion, s.bestHeight(), s.address}
+}
+
+// 接続が切れるまでメッセージを受信して処理する
+func (s *Server) handlePeer(p *peer) {
+	s.mu.Lock()
+	s.peers[p] = true
+	s.mu.Unlock()
+	go p.writeLoop()
+	defer func() {
+		// 要求中だったブロックは他のノードに要求し直す
+		s.mu.Lock()
+		delete(s.peers, p)
+		s.releaseDownloads(p)
+		s.requestBlocks()
+		s.mu.Unlock()
+		p.conn.Close()
+		close(p.closed)
+	}()
+
+	for {
+		command, payload, err := readMessage(p.conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("%s との接続を切断します: %v\n", p.addr, err)
+			}
+			return
+		}
+		if err := s.handleMessage(p, command, payload); err != nil {
+			fmt.Printf("%s との接続を切断します: %s %v\n", p.addr, command, err)
+			return
+		}
+	}
+}
+
+// 受信したメッセージの処理
+// エラーを返した場合は接続を切断する
+func (s *Server) handleMessage(p *peer, command string, payload []byte) error {
+	if command == "version" {
+		var msg versionPayload
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		return s.handleVersion(p, &msg)
+	}
+	// versionを受信するまでは他のメッセージを受け付けない
+	if p.version == nil {
+		return errors.New("versionを受信していません")
+	}
+
+	switch command {
+	case "verack":
+		return nil
+	case "getheaders":
+		var msg getheadersPayload
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		return s.handleGetHeaders(p, &msg)
+	case "headers":
+		var msg headersPayload
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		return s.handleHeaders(p, msg.Headers)
+	case "inv":
+		var msg invPayload
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		return s.handleInv(p, &msg)
+	case "getdata":
+		var msg getdataPayload
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		return s.handleGetData(p, &msg)
+	case "block":
+		var msg blockPayload
+		if err := decodePayload(payload, &msg); err != nil || msg.Block == nil {
+			return errors.New("ブロックを復元できません")
+		}
+		return s.handleBlock(p, msg.Block)
+	case "tx":
+		var msg txPayload
+		if err := decodePayload(payload, &msg); err != nil || msg.Transaction == nil {
+			return errors.New("トランザクションを復元できません")
+		}
+		return s.handleTx(p, msg.Transaction)
+	case "getstatus":
+		return p.send("status", s.syncStatus())
+	case "getmempool":
+		return p.send("mempool", s.mempoolStatus())
+	default:
+		// 知らないコマンドは無視する
+		fmt.Printf("%s から未知のコマンド %q を受信しました\n", p.addr, command)
+		return nil
+	}
+}
+
+// version: 応答を返し、相手の方が長いブロックチェーンを持っていればヘッダーを要求する
+func (s *Server) handleVersion(p *peer, msg *versionPayload) error {
+	if p.version != nil {
+		return errors.New("versionを重複して受信しました")
+	}
+	if msg.Version != protocolVersion {
+		return fmt.Errorf("対応していないバージョン %d です", msg.Version)
+	}
+	if msg.AddrFrom != "" {
+		p.addr = msg.AddrFrom
+	}
+	fmt.Printf("%s と接続しました 高さ %d\n", p.addr, msg.BestHeight)
+	// 接続を受けた側もversionを返す
+	if !p.outbound {
+		if err := p.send("version", s.versionPayload()); err != nil {
+			return err
+		}
+	}
+	if err := p.send("verack", nil); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.version = msg
+	p.bestHeight = msg.BestHeight
+	// 待ち受けているノードにはメモリプールのトランザクションを通知する
+	if msg.AddrFrom != "" {
+		if err := s.announceMempool(p); err != nil {
+			return err
+		}
+	}
+	if msg.BestHeight > s.headerHeight() {
+		return p.send("getheaders", getheadersPayload{s.bc.headerLocator()})
+	}
+	// ヘッダーを既に持っている場合は本体の要求先に加える
+	s.requestBlocks()
+	return nil
+}
+
+// メモリプールの全てのトランザクションをinvで通知する
+func (s *Server) announceMempool(p *peer) error {
+	var ids [][]byte
+	for _, tx := range s.mempool.Transactions() {
+		ids = append(ids, tx.ID)
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxInvSize {
+			n = maxInvSize
+		}
+		if err := p.send("inv", invPayload{invTypeTx, ids[:n]}); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// 最も仕事量の多いヘッダーの高さ（ヘッダーがない場合は-1）
+func (s *Server) headerHeight() int {
+	if best := s.bc.BestHeader(); best != nil {
+		return best.Height
+	}
+	return -1
+}
+
+// 初期ブロックダウンロード中（最も仕事量の多いヘッダーの高さまでブロックの本体がそろっていない）か
+func (s *Server) isInitialBlockDownload() bool {
+	return s.headerHeight() > s.bc.GetBestHeight()
+}
+
+// getheaders: ロケーターの中で最初に見つかったブロックより後のヘッダーを送る
+func (s *Server) handleGetHeaders(p *peer, msg *getheadersPayload) error {
+	s.mu.Lock()
+	headers := s.bc.headersAfter(msg.Locator, maxHeadersSize)
+	s.mu.Unlock()
+	// 空の場合も送り、続きがないことを知らせる
+	return p.send("headers", headersPayload{headers})
+}
+
+// headers: ヘッダーを検証して保存し、続きのヘッダーとブロックの本体を要求する
+func (s *Server) handleHeaders(p *peer, headers []*BlockHeader) error {
+	if len(headers) > maxHeadersSize {
+		return fmt.Errorf("ヘッダーが多すぎます: %d", len(headers))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := 0
+	for _, header := range headers {
+		// ロケーターには初期ブロックを含めているので、つながらないヘッダーは不正
+		if !s.bc.HasHeader(header.Hash) {
+			if err := s.bc.AddHeader(header); err != nil {
+				return err
+			}
+			added++
+		}
+		if header.Height > p.bestHeight {
+			p.bestHeight = header.Height
+		}
+	}
+	if added > 0 {
+		fmt.Printf("ヘッダーを受信しました: %d個 高さ %d まで\n", added, s.headerHeight())
+		s.downloadQueue = s.bc.missingBlocks()
+	}
+	// 上限まで送られてきた場合は続きがある
+	if len(headers) == maxHeadersSize {
+		if err := p.send("getheaders", getheadersPayload{s.bc.headerLocator()}); err != nil {
+			return err
+		}
+	}
+	s.requestBlocks()
+	return nil
+}
+
+// inv: 知らないブロックはヘッダーを、持っていないトランザクションは本体を要求する
+func (s *Server) handleInv(p *peer, msg *invPayload) error {
+	if len(msg.Items) > maxInvSize {
+		return fmt.Errorf("invの項目が多すぎます: %d", len(msg.Items))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch msg.Type {
+	case invTypeBlock:
+		for _, hash := range msg.Items {
+			header, err := s.bc.GetHeader(hash)
+			if err != nil {
+				return p.send("getheaders", getheadersPayload{s.bc.headerLocator()})
+			}
+			if header.Height > p.bestHeight {
+				p.bestHeight = header.Height
+			}
+		}
+		s.requestBlocks()
+		return nil
+	case invTypeTx:
+		var items [][]byte
+		for _, id := range msg.Items {
+			if !s.mempool.Has(id) {
+				items = append(items, id)
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return p.send("getdata", getdataPayload{invTypeTx, items})
+	default:
+		return fmt.Errorf("未知の種類 %q", msg.Type)
+	}
+}
+
+// 本体を持っていないブロックを要求する
+// ダウンロードの予定の先頭からdownloadWindow個先までのブロックを、そのブロックを持っていて
+// 要求中の数が最も少ないノードに割り振り、ノードごとにまとめて要求する
+func (s *Server) requestBlocks() {
+	// 追加済みのブロックを除く
+	for len(s.downloadQueue) > 0 && s.bc.HasBlock(s.downloadQueue[0].Hash) {
+		s.downloadQueue = s.downloadQueue[1:]
+	}
+	requests := make(map[*peer][][]byte)
+	for i, header := range s.downloadQueue {
+		if i >= downloadWindow {
+			break
+		}
+		hash := header.Hash
+		if s.inFlight[string(hash)] != nil || s.pending[string(hash)] != nil {
+			continue
+		}
+		var selected *peer
+		for p := range s.peers {
+			if p.version == nil || p.bestHeight < header.Height || p.inFlight >= maxBlocksInFlight {
+				continue
+			}
+			if selected == nil || p.inFlight < selected.inFlight {
+				selected = p
+			}
+		}
+		if selected == nil {
+			continue
+		}
+		selected.inFlight++
+		s.inFlight[string(hash)] = &blockRequest{selected, time.Now().Add(blockDownloadTimeout)}
+		requests[selected] = append(requests[selected], hash)
+	}
+	for p, hashes := range requests {
+		// 送信に失敗した接続は受信側で切断され、他のノードに要求し直す
+		p.send("getdata", getdataPayload{invTypeBlock, hashes})
+	}
+}
+
+// ノードに要求中のブロックを取り消す
+func (s *Server) releaseDownloads(p *peer) {
+	for hash, request := range s.inFlight {
+		if request.peer == p {
+			delete(s.inFlight, hash)
+		}
+	}
+	p.inFlight = 0
+}
+
+// 待ち時間までにブロックを送らなかったノードを切断し、他のノードに要求し直す
+func (s *Server) checkDownloads() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	stalled := make(map[*peer]bool)
+	for _, request := range s.inFlight {
+		if now.After(request.deadline) {
+			stalled[request.peer] = true
+		}
+	}
+	for p := range stalled {
+		fmt.Printf("%s からブロックが届かないため切断します\n", p.addr)
+		// 受信側の切断の処理を待たずに要求先から外し、同じノードに要求し直さないようにする
+		delete(s.peers, p)
+		s.releaseDownloads(p)
+		p.conn.Close()
+	}
+	if len(stalled) > 0 {
+		s.requestBlocks()
+	}
+}
+
+// getdata: 要求されたブロックまたはトランザクションを送る
+// 持っていないものは送らない
+func (s *Server) handleGetData(p *peer, msg *getdataPayload) error {
+	if len(msg.Items) > maxInvSize {
+		return fmt.Errorf("getdataの項目が多すぎます: %d", len(msg.Items))
+	}
+	if msg.Type != invTypeBlock && msg.Type != invTypeTx {
+		return fmt.Errorf("未知の種類 %q", msg.Type)
+	}
+	for _, id := range msg.Items {
+		var command string
+		var payload interface{}
+		s.mu.Lock()
+		if msg.Type == invTypeBlock {
+			if block, err := s.bc.GetBlock(id); err == nil {
+				command, payload = "block", blockPayload{block}
+			}
+		} else if tx := s.mempool.Get(id); tx != nil {
+			command, payload = "tx", txPayload{tx}
+		}
+		s.mu.Unlock()
+		if payload == nil {
+			continue
+		}
+		if err := p.send(command, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// block: ヘッダーを検証して受け取り、前のブロックから順に追加する
+func (s *Server) handleBlock(p *peer, block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(block.Hash)
+	if request := s.inFlight[key]; request != nil {
+		request.peer.inFlight--
+		delete(s.inFlight, key)
+	}
+	if s.bc.HasBlock(block.Hash) || s.pending[key] != nil {
+		s.requestBlocks()
+		return nil
+	}
+
+	// 要求せずに届いた新しいブロックは、先にヘッダーを検証して保存する
+	if !s.bc.HasHeader(block.Hash) {
+		err := s.bc.AddHeader(&block.BlockHeader)
+		if errors.Is(err, ErrUnknownParent) {
+			// 間のヘッダーが足りない場合は続きを要求する
+			return p.send("getheaders", getheadersPayload{s.bc.headerLocator()})
+		} else if err != nil {
+			return err
+		}
+		s.downloadQueue = s.bc.missingBlocks()
+	}
+	if block.Height > p.bestHeight {
+		p.bestHeight = block.Height
+	}
+	// ヘッダーと本体が一致しないブロックは受け取らない
+	if err := checkMerkleRoot(block); err != nil {
+		return err
+	}
+	s.pending[key] = &pendingBlock{block, p}
+	s.connectBlocks()
+	s.requestBlocks()
+	return nil
+}
+
+// 受信済みのブロックをダウンロードの予定の順に追加する
+// 不正なブロックを送ったノードは切断する
+func (s *Server) connectBlocks() {
+	for {
+		for len(s.downloadQueue) > 0 && s.bc.HasBlock(s.downloadQueue[0].Hash) {
+			s.downloadQueue = s.downloadQueue[1:]
+		}
+		if len(s.downloadQueue) == 0 {
+			break
+		}
+		next := s.pending[string(s.downloadQueue[0].Hash)]
+		if next == nil {
+			break
+		}
+		delete(s.pending, string(next.block.Hash))
+		event, err := s.bc.AddBlock(next.block)
+		var invalid *BlockValidationError
+		if errors.As(err, &invalid) {
+			fmt.Printf("%s から受信したブロックを拒否しました: %v\n", next.from.addr, err)
+			next.from.conn.Close()
+			// 不正なブロックに続くヘッダーは選ばれなくなる
+			s.downloadQueue = s.bc.missingBlocks()
+			break
+		} else if err != nil {
+			log.Panic(err)
+		}
+		if event != nil {
+			s.chainReorganized(event)
+		} else if !bytes.Equal(s.bc.tip, next.block.Hash) {
+			// 仕事量が有効なチェーンを上回るまでは接続しない
+			fmt.Printf("分岐したチェーンのブロックを保存しました: 高さ %d %x\n", next.block.Height, next.block.Hash)
+			continue
+		}
+		s.blockConnected(next.block)
+		if s.isInitialBlockDownload() {
+			if next.block.Height%syncProgressInterval == 0 {
+				fmt.Printf("同期中: 高さ %d / %d\n", next.block.Height, s.headerHeight())
+			}
+			continue
+		}
+		fmt.Printf("ブロックを追加しました: 高さ %d %x\n", next.block.Height, next.block.Hash)
+		s.relay(next.from, invTypeBlock, next.block.Hash)
+	}
+	// 追加する予定のないブロックは捨てる
+	if len(s.downloadQueue) == 0 {
+		for key := range s.pending {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// チェーンが再編成された後の処理
+// 切り離したブロックのトランザクションをメモリプールに戻す
+// 新しいチェーンで使用済みになったものなどは検証し直す際に取り除かれる
+func (s *Server) chainReorganized(event *ReorgEvent) {
+	fmt.Printf("チェーンを再編成しました: %v\n", event)
+	s.mempool.Update(event.OrphanedTransactions())
+}
+
+// 新しいブロックが追加された後の処理
+// 採掘中のブロックは古くなるので中断し、メモリプールを更新して採掘をやり直す
+func (s *Server) blockConnected(block *Block) {
+	if s.cancelMining != nil {
+		s.cancelMining()
+		s.cancelMining = nil
+	}
+	s.mempool.Expire(time.Now())
+	s.mempool.Update(nil)
+	s.startMining()
+}
+
+// tx: 検証してメモリプールに追加し、他のノードに通知する
+func (s *Server) handleTx(p *peer, tx *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mempool.Has(tx.ID) {
+		return nil
+	}
+	if err := s.mempool.Add(tx); err != nil {
+		// 承認済みや二重使用のトランザクションは受け取ることがあるため切断はしない
+		fmt.Printf("トランザクション %x を拒否しました: %v\n", tx.ID, err)
+		return nil
+	}
+	fmt.Printf("トランザクションを受け付けました: %x\n", tx.ID)
+	s.relay(p, invTypeTx, tx.ID)
+	s.startMining()
+	return nil
+}
+
+// 送信元以外の全てのノードに通知する
+func (s *Server) relay(from *peer, invType string, hash []byte) {
+	for p := range s.peers {
+		if p == from || p.version == nil {
+			continue
+		}
+		// 送信に失敗した接続は受信側で切断される
+		p.send("inv", invPayload{invType, [][]byte{hash}})
+	}
+}
+
+// メモリプールのトランザクションを含むブロックの採掘を始める
+// 初期ブロックダウンロード中は古いブロックに続けて採掘することになるため行わない
+// 採掘はロックを外して行い、見つかったブロックは最終ブロックが変わっていなければ追加する
+func (s *Server) startMining() {
+	if s.miner == "" || s.cancelMining != nil || s.mempool.Info().Count == 0 || s.isInitialBlockDownload() {
+		return
+	}
+	lastBlock, err := s.bc.GetBlock(s.bc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	transactions := s.mempool.BlockTransactions(s.miner)
+	bits := s.bc.nextBits(lastBlock.Hash)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelMining = cancel
+	go func() {
+		block, err := NewBlock(ctx, transactions, lastBlock, bits)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ctx.Err() != nil {
+			return // 新しいブロックを受信したか、ノードを停止した
+		}
+		cancel()
+		s.cancelMining = nil
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if _, err := s.bc.AddBlock(block); err != nil {
+			fmt.Printf("採掘したブロックを追加できません: %v\n", err)
+			s.startMining()
+			return
+		}
+		fmt.Printf("ブロックを採掘しました: 高さ %d %x\n", block.Height, block.Hash)
+		s.blockConnected(block)
+		s.relay(nil, invTypeBlock, block.Hash)
+	}()
+}
+
+// 同期状況
+func (s *Server) syncStatus() syncStatusPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := syncStatusPayload{
+		BlockHeight:  s.bc.GetBestHeight(),
+		HeaderHeight: s.headerHeight(),
+		InFlight:     len(s.inFlight),
+		Pending:      len(s.pending),
+	}
+	for p := range s.peers {
+		// 待ち受けアドレスを通知しない一時的な接続は除く
+		if p.version == nil || p.version.AddrFrom == "" {
+			continue
+		}
+		status.Peers = append(status.Peers, peerStatus{p.addr, p.bestHeight, p.inFlight})
+	}
+	return status
+}
+
+// メモリプールの内容
+func (s *Server) mempoolStatus() mempoolPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mempoolPayload{s.mempool.Info(), s.mempool.TxInfos()}
+}
+
+// ノードに接続し、ハンドシェイクを済ませる
+// 待ち受けアドレスと高さを通知しないため、ブロックの要求先にはならない
+func dialNode(address string) (*peer, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{conn: conn, addr: address, outbound: true}
+	if err := p.write("version", versionPayload{protocolVersion, -1, ""}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := p.waitFor("verack", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// トランザクションをノードに送信する
+// ハンドシェイクの後にtxを送り、接続を閉じる
+func SendTransaction(address string, tx *Transaction) error {
+	p, err := dialNode(address)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+	if err := p.write("tx", txPayload{tx}); err != nil {
+		return err
+	}
+	// 相手が処理する前に切断しないよう、相手が閉じるか少し待つ
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, p.conn)
+	return nil
+}
+
+// ノードに同期状況を問い合わせる
+func QuerySyncStatus(address string) (*syncStatusPayload, error) {
+	p, err := dialNode(address)
+	if err != nil {
+		return nil, err
+	}
+	defer p.conn.Close()
+	if err := p.write("getstatus", nil); err != nil {
+		return nil, err
+	}
+	var status syncStatusPayload
+	if err := p.waitFor("status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ノードにメモリプールの内容を問い合わせる
+func QueryMempool(address string) (*mempoolPayload, error) {
+	p, err := dialNode(address)
+	if err != nil {
+		return nil, err
+	}
+	defer p.conn.Close()
+	if err := p.write("getmempool", nil); err != nil {
+		return nil, err
+	}
+	var pool mempoolPayload
+	if err := p.waitFor("mempool", &pool); err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
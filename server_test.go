@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// メッセージの書き込みと読み込み
+func TestMessageFraming(t *testing.T) {
+	var buff bytes.Buffer
+	sent := invPayload{invTypeBlock, [][]byte{{1, 2, 3}, {4, 5, 6}}}
+	if err := writeMessage(&buff, "inv", sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(&buff, "verack", nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := append([]byte{}, buff.Bytes()...)
+
+	command, payload, err := readMessage(&buff)
+	if err != nil || command != "inv" {
+		t.Fatalf("readMessage() = %q, %v", command, err)
+	}
+	var received invPayload
+	if err := decodePayload(payload, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Type != sent.Type || len(received.Items) != 2 || !bytes.Equal(received.Items[1], sent.Items[1]) {
+		t.Errorf("decodePayload() = %v, want %v", received, sent)
+	}
+	command, payload, err = readMessage(&buff)
+	if err != nil || command != "verack" || len(payload) != 0 {
+		t.Fatalf("readMessage() = %q, %x, %v", command, payload, err)
+	}
+
+	// マジック値やペイロードを書き換えたメッセージは読み込まない
+	tests := []struct {
+		offset int
+		err    error
+	}{
+		{0, ErrBadMagic},
+		{headerLength, ErrBadChecksum},
+	}
+	for _, test := range tests {
+		modified := append([]byte{}, encoded...)
+		modified[test.offset] ^= 0xff
+		if _, _, err := readMessage(bytes.NewReader(modified)); err != test.err {
+			t.Errorf("readMessage() with byte %d modified = %v, want %v", test.offset, err, test.err)
+		}
+	}
+}
+
+// 相手が受信しなくても送信は待たされず、送信待ちがあふれると切断するか
+func TestPeerSendQueue(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newPeer(conn, "remote", true)
+	go p.writeLoop()
+	defer close(p.closed)
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		// 書き込み中の1件とキューの分までは受け付ける
+		for i := 0; i <= sendQueueSize+1 && err == nil; i++ {
+			err = p.send("inv", invPayload{invTypeBlock, [][]byte{{byte(i)}}})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("send() beyond the queue size = nil, want error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send() blocked while the peer was not reading")
+	}
+	// 接続は閉じられている
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("connection is still open after the queue overflowed")
+	}
+}
+
+// condが真になるまで待つ
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 使われていないポートの待ち受けアドレス
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// ブロックチェーンを持たないノードが同期し、トランザクションとブロックを中継するか
+// minerはトランザクションを受け取ると採掘し、ブロックをnodeに送る
+func TestServerSyncAndRelay(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestBlocks(t, bc, wallet, chainParams.CoinbaseMaturity+1)
+	height := bc.GetBestHeight()
+	// 同じプロセスでは別のディレクトリに2つ目のデータベースを作る
+	chdirTemp(t)
+	empty := OpenBlockchain()
+	t.Cleanup(func() { empty.db.Close() })
+
+	minerAddr, nodeAddr := freeAddress(t), freeAddress(t)
+	miner := NewServer(minerAddr, string(wallet.GetAddress()), bc)
+	node := NewServer(nodeAddr, "", empty)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	run := func(s *Server, seeds []string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Run(ctx, seeds); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+		// 切断の処理が終わるまで待ち、データベースを閉じる前に全ての接続を終える
+		for _, s := range []*Server{miner, node} {
+			waitUntil(t, "peers to disconnect", func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return len(s.peers) == 0
+			})
+		}
+	}()
+
+	run(miner, nil)
+	waitUntil(t, "miner to listen", func() bool {
+		_, err := QuerySyncStatus(minerAddr)
+		return err == nil
+	})
+	run(node, []string{minerAddr})
+	waitUntil(t, "node to sync", func() bool { return node.bestHeight() == height })
+
+	// nodeに送ったトランザクションがminerに中継されて採掘され、ブロックがnodeに届く
+	tx := newTestSpend(t, wallet, genesis.Transactions[0], 0, genesis.Transactions[0].Vout[0].Value-1, nil)
+	if err := SendTransaction(nodeAddr, tx); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "block to be relayed", func() bool {
+		return node.bestHeight() == height+1 && node.mempoolStatus().Info.Count == 0
+	})
+	node.mu.Lock()
+	block, err := node.bc.GetBlock(node.bc.tip)
+	node.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || !bytes.Equal(block.Transactions[1].ID, tx.ID) {
+		t.Errorf("relayed block does not contain transaction %x", tx.ID)
+	}
+}
+
+// ブロックが届かないノードを切断し、要求中のブロックを他のノードに割り振り直すか
+func TestCheckDownloadsReassign(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	block := newTestBlock(t, bc, nil, []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 1, 0)}, nil)
+	if err := bc.AddHeader(&block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("localhost:0", "", bc)
+	addPeer := func(name string) (*peer, net.Conn) {
+		conn, remote := net.Pipe()
+		t.Cleanup(func() { conn.Close(); remote.Close() })
+		p := newPeer(conn, name, true)
+		p.version = &versionPayload{protocolVersion, 1, name}
+		p.bestHeight = 1
+		s.mu.Lock()
+		s.peers[p] = true
+		s.mu.Unlock()
+		return p, remote
+	}
+	key := string(block.Hash)
+
+	slow, slowRemote := addPeer("slow")
+	s.mu.Lock()
+	s.downloadQueue = bc.missingBlocks()
+	s.requestBlocks()
+	s.mu.Unlock()
+	request := s.inFlight[key]
+	if request == nil || request.peer != slow {
+		t.Fatalf("requestBlocks() did not request the block from the only peer")
+	}
+	other, _ := addPeer("other")
+
+	// 期限前は割り振り直さない
+	s.checkDownloads()
+	if s.inFlight[key].peer != slow {
+		t.Fatal("checkDownloads() reassigned a request before the deadline")
+	}
+
+	request.deadline = time.Now().Add(-time.Second)
+	s.checkDownloads()
+	if request := s.inFlight[key]; request == nil || request.peer != other {
+		t.Fatal("checkDownloads() did not reassign the stalled request")
+	}
+	if slow.inFlight != 0 || other.inFlight != 1 {
+		t.Errorf("inFlight = %d and %d, want 0 and 1", slow.inFlight, other.inFlight)
+	}
+	if _, err := slowRemote.Read(make([]byte, 1)); err == nil {
+		t.Error("stalled peer was not disconnected")
+	}
+	// 2つ目のノードにはgetdataを送る
+	for _, p := range []*peer{slow, other} {
+		select {
+		case msg := <-p.queue:
+			if p == other && msg.command != "getdata" {
+				t.Errorf("queued %q, want getdata", msg.command)
+			}
+		default:
+			t.Errorf("no message queued for %s", p.addr)
+		}
+	}
+}
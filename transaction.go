@@ -2,25 +2,31 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 )
 
 type Transaction struct {
-	ID   []byte     // トランザクションのID
-	Vin  []TXInput  // トランザクション入力
-	Vout []TXOutput // トランザクション出力
+	ID       []byte     // トランザクションのID
+	Vin      []TXInput  // トランザクション入力
+	Vout     []TXOutput // トランザクション出力
+	LockTime uint32     // この高さまたは時刻より後のブロックにのみ含められる（0の場合は制限なし）
 }
 
 // トランザクション出力
 type TXOutput struct {
 	// 値（通貨量、ビットコインの場合satoshi数）
 	Value int
-	//公開鍵Script
-	ScriptPubKey string
+	// 出力を使用するための条件を表すスクリプト
+	ScriptPubKey []byte
 }
 
 // トランザクション入力
@@ -29,48 +35,284 @@ type TXInput struct {
 	Txid []byte
 	// トランザクション出力のインデックス
 	Vout int
-	// 署名Script
-	ScriptSig string
+	// ScriptPubKeyの条件を満たすデータ（署名など）をプッシュするスクリプト
+	// コインベースの場合は任意データ
+	ScriptSig []byte
+	// 相対ロックタイム（参照先の出力が承認されてから必要なブロック数）
+	// sequenceFinalの場合はLockTimeも無効になる
+	Sequence uint32
 }
 
+// LockTimeがこの値未満の場合はブロックの高さ、以上の場合はUnixタイムとして扱う
+const lockTimeThreshold = 500000000
+
+// Sequenceの値
+const (
+	sequenceFinal               = 0xffffffff // ロックタイムを使わない入力
+	sequenceLockTimeDisableFlag = 1 << 31    // 相対ロックタイムを無効にするフラグ
+	sequenceLockTimeMask        = 0x0000ffff // 相対ロックタイムのブロック数
+)
+
 // トランザクションのIDとしてハッシュ値を代入
-// 	"bytes" "crypto/sha256" "encoding/gob" "log" をimportに追加
+// IDは署名を含めた内容のハッシュ値のため、署名や内容を変更した後に呼び出す
 func (tx *Transaction) SetID() {
+	tx.ID = tx.Hash()
+}
+
+// トランザクションのシリアライゼーション
+func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
-	var hash [32]byte
 	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx) // Transactionをバイト配列化
+	err := enc.Encode(tx)
 	if err != nil {
 		log.Panic(err)
 	}
-	// SHA256でハッシュ値を求める
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hash[:]
+	return encoded.Bytes()
+}
+
+// ID以外の内容のハッシュ値
+func (tx *Transaction) Hash() []byte {
+	hash := sha256.Sum256(tx.prepareData())
+	return hash[:]
+}
+
+// ハッシュ値を求める元データ
+// ID以外のフィールドを決まった順に連結し、可変長のデータには長さを付ける
+// gobの出力はプロセス内で型が使われた順に左右されるため使わない
+func (tx *Transaction) prepareData() []byte {
+	var data bytes.Buffer
+	// 長さとデータを連結
+	writeBytes := func(b []byte) {
+		data.Write(IntToHex(int64(len(b))))
+		data.Write(b)
+	}
+	data.Write(IntToHex(int64(len(tx.Vin))))
+	for _, vin := range tx.Vin {
+		writeBytes(vin.Txid)
+		data.Write(IntToHex(int64(vin.Vout)))
+		writeBytes(vin.ScriptSig)
+		data.Write(IntToHex(int64(vin.Sequence)))
+	}
+	data.Write(IntToHex(int64(len(tx.Vout))))
+	for _, out := range tx.Vout {
+		data.Write(IntToHex(int64(out.Value)))
+		writeBytes(out.ScriptPubKey)
+	}
+	data.Write(IntToHex(int64(tx.LockTime)))
+	return data.Bytes()
+}
+
+// 署名対象となるトランザクションのコピー
+// 入力のScriptSigを空にしたもの
+func (tx *Transaction) TrimmedCopy() Transaction {
+	var inputs []TXInput
+	var outputs []TXOutput
+	for _, vin := range tx.Vin {
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
+	}
+	for _, vout := range tx.Vout {
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey})
+	}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
+	return txCopy
+}
+
+// 入力inIDの署名対象となるハッシュ値
+// 署名する入力だけに、参照先の出力のスクリプトsubscript（P2SHの場合はredeemスクリプト）を入れる
+func (tx *Transaction) SignatureHash(inID int, subscript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].ScriptSig = subscript
+	return txCopy.Hash()
+}
+
+// ハッシュ値への署名
+// r, sをそれぞれ32バイトの固定長で連結する
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+// 公開鍵（X, Yの連結）による署名（r, sの連結）の検証
+func verifySignature(pubKey, hash, signature []byte) bool {
+	if len(signature) != 64 || len(pubKey) != 64 {
+		return false
+	}
+	// 署名からr, sを、公開鍵からX, Yを復元
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	x := new(big.Int).SetBytes(pubKey[:32])
+	y := new(big.Int).SetBytes(pubKey[32:])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
+
+// トランザクションの各入力への署名
+// prevTXsは入力が参照するトランザクション（キーはIDの16進数文字列）
+// 参照先はprivKeyの公開鍵ハッシュに支払うP2PKHの出力でなければならない
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() { // コインベースには署名しない
+		return nil
+	}
+	// 参照先の出力が揃っているか確認
+	prevOuts, err := tx.prevOutputs(prevTXs)
+	if err != nil {
+		return err
+	}
+
+	pubKey := pubKeyBytes(&privKey.PublicKey)
+	for inID := range tx.Vin {
+		scriptPubKey := prevOuts[inID].ScriptPubKey
+		if !bytes.Equal(ExtractPubKeyHash(scriptPubKey), HashPubKey(pubKey)) {
+			return fmt.Errorf("入力%d: この鍵では署名できない出力です", inID)
+		}
+		signature := signHash(privKey, tx.SignatureHash(inID, scriptPubKey))
+		// ScriptSig: <署名> <公開鍵>
+		tx.Vin[inID].ScriptSig = append(pushData(signature), pushData(pubKey)...)
+	}
+	return nil
+}
+
+// 各入力が使用する出力をprevTXsから集める（入力の順）
+// 参照先のトランザクションまたは出力がない場合はエラーを返す
+func (tx *Transaction) prevOutputs(prevTXs map[string]Transaction) ([]TXOutput, error) {
+	var prevOuts []TXOutput
+	for inID, vin := range tx.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || prevTx.ID == nil {
+			return nil, fmt.Errorf("入力%d: 参照先のトランザクションが見つかりません", inID)
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return nil, fmt.Errorf("入力%d: 存在しない出力を参照しています", inID)
+		}
+		prevOuts = append(prevOuts, prevTx.Vout[vin.Vout])
+	}
+	return prevOuts, nil
+}
+
+// トランザクションの各入力の署名を検証
+// 参照先の出力が見つからない場合もfalseを返す
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+	prevOuts, err := tx.prevOutputs(prevTXs)
+	if err != nil {
+		return false
+	}
+	return tx.VerifyScripts(prevOuts) == nil
+}
+
+// 各入力について ScriptSig || 参照先のScriptPubKey を評価する
+// prevOutsは各入力が使用する出力（入力の順）
+// 失敗した場合は入力のインデックスと原因をエラーとして返す
+func (tx *Transaction) VerifyScripts(prevOuts []TXOutput) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+	if len(prevOuts) != len(tx.Vin) {
+		return fmt.Errorf("入力が%d個に対し参照先の出力が%d個です", len(tx.Vin), len(prevOuts))
+	}
+	for inID, vin := range tx.Vin {
+		err := VerifyScript(vin.ScriptSig, prevOuts[inID].ScriptPubKey, tx, inID)
+		if err != nil {
+			return fmt.Errorf("入力%d: %w", inID, err)
+		}
+	}
+	return nil
+}
+
+// 最初の採掘報酬額
+const initialSubsidy = 10
+
+// 高さheightのブロックの採掘報酬額
+// chainParams.SubsidyHalvingIntervalブロックごとに半減し、最終的に0になる
+func GetBlockSubsidy(height int) int {
+	halvings := height / chainParams.SubsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return initialSubsidy >> uint(halvings)
+}
+
+// 採掘報酬の総額（最大供給量）
+func MaxSupply() int {
+	total := 0
+	for s := initialSubsidy; s > 0; s >>= 1 {
+		total += s * chainParams.SubsidyHalvingInterval
+	}
+	return total
+}
+
+// 金額valueが0以上かつ最大供給量以下であるか
+// 出力の金額や合計をこの範囲に収めることで、加算がオーバーフローしないようにする
+func MoneyRange(value int) bool {
+	return value >= 0 && value <= MaxSupply()
 }
 
 // 最初のトランザクション
 // importに"fmt"を追加
-const subsidy = 10 // 報酬額
-func NewCoinbaseTX(to, data string) *Transaction {
-	if data == "" { // data = ""の時、最初のトランザクションとして扱う
-		data = fmt.Sprintf("'%s'に対する報酬", to)
+// 採掘者は高さheightの報酬額とブロックに含めたトランザクションの手数料feesを受け取る
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
+	if data == "" { // data = ""の時、採掘報酬として扱う
+		// 同じアドレスへの報酬でもIDが重複しないよう乱数を加える
+		randData := make([]byte, 20)
+		_, err := rand.Read(randData)
+		if err != nil {
+			log.Panic(err)
+		}
+		data = fmt.Sprintf("'%s'に対する報酬 %x", to, randData)
 	}
-	txin := TXInput{[]byte{}, -1, data} // トランザクション入力の生成
-	txout := TXOutput{subsidy, to}      // トランザクション出力の生成
+	txin := TXInput{[]byte{}, -1, []byte(data), sequenceFinal} // トランザクション入力の生成
+	txout := NewTXOutput(GetBlockSubsidy(height)+fees, to)     // トランザクション出力の生成
 	// トランザクションの生成
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{txout}}
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.SetID() // IDの割り当て
 	return &tx
 }
 
-// そのアドレスがトランザクションを作成したか否かをチェック
-func (in *TXInput) CanUnlockOutputWith(unlockingData string) bool {
-	return in.ScriptSig == unlockingData
+// 入力が指定の公開鍵ハッシュの鍵で作成されたか否かをチェック
+// P2PKHのScriptSig（<署名> <公開鍵>）の公開鍵から判定する
+func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
+	ops, err := parseScript(in.ScriptSig)
+	if err != nil || len(ops) != 2 {
+		return false
+	}
+	lockingHash := HashPubKey(ops[1].data)
+	return bytes.Equal(lockingHash, pubKeyHash)
+}
+
+// アドレスに支払うスクリプトで出力をロックする
+func (out *TXOutput) Lock(address []byte) {
+	script, err := PayToAddrScript(string(address))
+	if err != nil {
+		log.Panic(err)
+	}
+	out.ScriptPubKey = script
+}
+
+// 出力がOP_RETURNで始まり、使用できないことが明らかか
+// このような出力はUTXOセットに含めない
+func (out *TXOutput) IsUnspendable() bool {
+	return len(out.ScriptPubKey) > 0 && out.ScriptPubKey[0] == OP_RETURN
 }
 
-// 出力が提供データによってアンロックすることができたかをチェック
-func (out *TXOutput) CanBeUnlockedWith(unlockingData string) bool {
-	return out.ScriptPubKey == unlockingData
+// 出力が指定の公開鍵ハッシュに支払うP2PKHかをチェック
+func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	return bytes.Equal(ExtractPubKeyHash(out.ScriptPubKey), pubKeyHash)
+}
+
+// 指定アドレスにロックされた新しいトランザクション出力の生成
+func NewTXOutput(value int, address string) *TXOutput {
+	txo := &TXOutput{value, nil}
+	txo.Lock([]byte(address))
+	return txo
 }
 
 // Coinbaseを判定
@@ -80,19 +322,113 @@ func (tx Transaction) IsCoinbase() bool {
 		tx.Vin[0].Vout == -1 // 入力のリンク元出力が-1である
 }
 
+// 高さheight、時刻blockTimeのブロックに含められるか（絶対ロックタイム）
+// 全ての入力のSequenceがsequenceFinalの場合はLockTimeを無視する
+func (tx Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	cutoff := int64(height)
+	if tx.LockTime >= lockTimeThreshold {
+		cutoff = blockTime
+	}
+	if int64(tx.LockTime) < cutoff {
+		return true
+	}
+	for _, vin := range tx.Vin {
+		if vin.Sequence != sequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+// 入力の相対ロックタイム
+// 参照先の出力が承認されたブロックから、このブロック数が経過するまで使用できない
+func (in TXInput) RelativeLockBlocks() int {
+	if in.Sequence&sequenceLockTimeDisableFlag != 0 {
+		return 0
+	}
+	return int(in.Sequence & sequenceLockTimeMask)
+}
+
+// ロックタイムを設定する
+// LockTimeを有効にするため、入力のSequenceをsequenceFinal以外にする
+func (tx *Transaction) SetLockTime(lockTime uint32) {
+	tx.LockTime = lockTime
+	if lockTime == 0 {
+		return
+	}
+	for i := range tx.Vin {
+		if tx.Vin[i].Sequence == sequenceFinal {
+			tx.Vin[i].Sequence = sequenceFinal - 1
+		}
+	}
+}
+
 // 送金処理のトランザクションの生成
 // encoding/hexをimportに追加
-func NewUTXOTransaction(
-	from, to string, amount int, bc *Blockchain) *Transaction {
+// おつりはchangeのアドレスに送る
+// 入力の合計と出力の合計の差額feeが採掘者への手数料となる
+// lockTimeが0以外の場合はその高さまたは時刻を過ぎるまでブロックに含められない
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int,
+	change string, lockTime uint32, UTXOSet *UTXOSet) *Transaction {
+	// 送金元のアドレスはウォレットの公開鍵から求める
+	from := string(wallet.GetAddress())
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, change, lockTime, UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	// 送金元の秘密鍵で署名
+	if err := UTXOSet.Blockchain.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		log.Panic(err)
+	}
+	tx.SetID()
+	return tx
+}
+
+// 支払いに使う未使用出力の探索
+// UTXOSetは承認済みの出力のみを、Mempoolは未承認のトランザクションも反映した出力を返す
+type SpendableOutputFinder interface {
+	FindSpendableOutputs(scriptPubKey []byte, amount int) (int, map[string][]int)
+}
+
+// 署名前の送金トランザクションの生成
+// fromのアドレス（P2PKHまたはP2SH）に支払われた未使用出力を入力とする
+func NewUnsignedTransaction(from, to string, amount, fee int,
+	change string, lockTime uint32, finder SpendableOutputFinder) (*Transaction, error) {
+	outputs := []TXOutput{*NewTXOutput(amount, to)}
+	return newSpendTransaction(from, outputs, fee, change, lockTime, finder)
+}
+
+// fromの未使用出力から、出力outputsと手数料feeを支払う署名前のトランザクションを生成
+// 差額はchangeのアドレスへのおつりとする
+func newSpendTransaction(from string, outputs []TXOutput, fee int,
+	change string, lockTime uint32, finder SpendableOutputFinder) (*Transaction, error) {
 	var inputs []TXInput
-	var outputs []TXOutput
+
+	// 送金元のアドレスに支払うスクリプト
+	scriptPubKey, err := PayToAddrScript(from)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := 0
+	for _, out := range outputs {
+		amount += out.Value
+	}
+	// 入力は少なくとも1つ必要なので、支払いがなくても1以上を集める
+	target := amount + fee
+	if target < 1 {
+		target = 1
+	}
 
 	// 送金可能な金額を算出
-	acc, validOutputs := bc.FindSpendableOutputs(from, amount)
+	acc, validOutputs := finder.FindSpendableOutputs(scriptPubKey, target)
 	// 送金可能額accが送金しようとしている
-	// 金額amountよりも小さい場合、例外発生
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	// 金額amountと手数料feeの合計よりも小さい場合はエラー
+	if acc < target {
+		return nil, errors.New("ERROR: Not enough funds")
 	}
 
 	// トランザクション入力リストの生成
@@ -106,19 +442,27 @@ func NewUTXOTransaction(
 		for _, out := range outs {
 			// トランザクション入力構造体を生成
 			// 出力と入力の間のリンクをはるリンク
-			input := TXInput{txID, out, from}
+			input := TXInput{txID, out, nil, sequenceFinal}
 			//
 			inputs = append(inputs, input)
 		}
 	}
 	//出力リストの作成
-	outputs = append(outputs, TXOutput{amount, to})
-	if acc > amount {
-		// ぴったりの金額出ない場合、最後の出力は差分値を代入
-		outputs = append(outputs, TXOutput{acc - amount, from}) // 変更
+	if acc > amount+fee {
+		// ぴったりの金額出ない場合、最後の出力は手数料を除いた差分値を代入
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, change)) // 変更
 	}
 	// トランザクションの生成
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.SetLockTime(lockTime)
 	tx.SetID()
-	return &tx
+	return &tx, nil
+}
+
+// トランザクションのデシリアライゼーション
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	var tx Transaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&tx)
+	return tx, err
 }
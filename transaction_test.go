@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// 採掘報酬の半減
+func TestGetBlockSubsidy(t *testing.T) {
+	defer func(params ChainParams) { chainParams = params }(chainParams)
+	chainParams.SubsidyHalvingInterval = 4
+
+	tests := []struct {
+		height  int
+		subsidy int
+	}{
+		{0, 10}, {3, 10}, {4, 5}, {8, 2}, {12, 1}, {15, 1}, {16, 0}, {1 << 20, 0},
+	}
+	for _, test := range tests {
+		if got := GetBlockSubsidy(test.height); got != test.subsidy {
+			t.Errorf("GetBlockSubsidy(%d) = %d, want %d", test.height, got, test.subsidy)
+		}
+	}
+
+	// 最大供給量は全ての高さの報酬の合計と一致する
+	total := 0
+	for height := 0; GetBlockSubsidy(height) > 0; height++ {
+		total += GetBlockSubsidy(height)
+	}
+	if total != MaxSupply() {
+		t.Errorf("MaxSupply() = %d, want %d", MaxSupply(), total)
+	}
+}
+
+// 絶対ロックタイム
+func TestIsFinal(t *testing.T) {
+	const now = 1700000000
+	tests := []struct {
+		lockTime uint32
+		sequence uint32
+		final    bool
+	}{
+		{0, 0, true},
+		{99, 0, true},
+		{100, 0, false},
+		{100, sequenceFinal, true}, // Sequenceにより無効
+		{now - 1, 0, true},
+		{now, 0, false},
+	}
+	for _, test := range tests {
+		tx := Transaction{nil, []TXInput{{[]byte{1}, 0, nil, test.sequence}}, nil, test.lockTime}
+		if got := tx.IsFinal(100, now); got != test.final {
+			t.Errorf("IsFinal() with lockTime %d, sequence %x = %v, want %v",
+				test.lockTime, test.sequence, got, test.final)
+		}
+	}
+
+	// SetLockTimeはLockTimeが有効になるようSequenceを変更する
+	tx := Transaction{nil, []TXInput{{[]byte{1}, 0, nil, sequenceFinal}}, nil, 0}
+	tx.SetLockTime(200)
+	if tx.IsFinal(200, now) || !tx.IsFinal(201, now) {
+		t.Error("SetLockTime() did not enable the lock time")
+	}
+	if blocks := tx.Vin[0].RelativeLockBlocks(); blocks != 0 {
+		t.Errorf("RelativeLockBlocks() = %d, want 0", blocks)
+	}
+}
+
+// 署名したトランザクションが検証を通り、改ざんすると検証に失敗するか
+func TestSignVerify(t *testing.T) {
+	wallet := NewWallet()
+	address := string(wallet.GetAddress())
+	prevTx := Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(10, address)}, 0}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+	newTx := func() *Transaction {
+		return &Transaction{nil, []TXInput{{prevTx.ID, 0, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(9, address)}, 0}
+	}
+
+	tx := newTx()
+	if err := tx.Sign(wallet.PrivateKey, prevTXs); err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Verify(prevTXs) {
+		t.Fatal("Verify() = false for a signed transaction")
+	}
+
+	tampered := []struct {
+		name   string
+		modify func(tx *Transaction)
+	}{
+		{"output value", func(tx *Transaction) { tx.Vout[0].Value = 10 }},
+		{"output script", func(tx *Transaction) { tx.Vout[0] = *NewTXOutput(9, string(NewWallet().GetAddress())) }},
+		{"lock time", func(tx *Transaction) { tx.LockTime = 1 }},
+		{"signature", func(tx *Transaction) { tx.Vin[0].ScriptSig[1] ^= 1 }},
+	}
+	for _, test := range tampered {
+		copied := newTx()
+		copied.Vin[0].ScriptSig = append([]byte{}, tx.Vin[0].ScriptSig...)
+		test.modify(copied)
+		if copied.Verify(prevTXs) {
+			t.Errorf("Verify() = true after tampering with the %s", test.name)
+		}
+	}
+
+	// 他人の鍵では署名できない
+	if err := newTx().Sign(NewWallet().PrivateKey, prevTXs); err == nil {
+		t.Error("Sign() with another key succeeded")
+	}
+}
+
+// 参照先の出力が見つからない場合はパニックせずエラーになるか
+func TestVerifyMissingPrevTx(t *testing.T) {
+	wallet := NewWallet()
+	prevTx := Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(10, string(wallet.GetAddress()))}, 0}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+
+	for _, vin := range []TXInput{{[]byte{2}, 0, nil, sequenceFinal}, {prevTx.ID, 1, nil, sequenceFinal}} {
+		tx := &Transaction{nil, []TXInput{vin}, []TXOutput{{9, nil}}, 0}
+		if _, err := tx.prevOutputs(prevTXs); err == nil {
+			t.Errorf("prevOutputs() with input %x:%d = nil, want error", vin.Txid, vin.Vout)
+		}
+		if tx.Verify(prevTXs) {
+			t.Errorf("Verify() with input %x:%d = true", vin.Txid, vin.Vout)
+		}
+		if err := tx.Sign(wallet.PrivateKey, prevTXs); err == nil {
+			t.Errorf("Sign() with input %x:%d = nil, want error", vin.Txid, vin.Vout)
+		}
+		// 入力と参照先の出力の数が合わない
+		if err := tx.VerifyScripts(nil); err == nil {
+			t.Errorf("VerifyScripts(nil) with input %x:%d = nil, want error", vin.Txid, vin.Vout)
+		}
+	}
+}
+
+// ハッシュ値はIDに依存せず、各フィールドの変更と区切りの違いを区別するか
+func TestTransactionHash(t *testing.T) {
+	newTx := func() *Transaction {
+		return &Transaction{nil, []TXInput{{[]byte{1, 2}, 0, nil, sequenceFinal}}, []TXOutput{{5, []byte{3}}}, 0}
+	}
+	hash := newTx().Hash()
+
+	withID := newTx()
+	withID.ID = []byte{9}
+	if !bytes.Equal(withID.Hash(), hash) {
+		t.Error("Hash() depends on ID")
+	}
+	decoded, err := DeserializeTransaction(newTx().Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Hash(), hash) {
+		t.Error("Hash() changed after Serialize() and DeserializeTransaction()")
+	}
+
+	modified := []func(tx *Transaction){
+		func(tx *Transaction) { tx.Vin[0].Txid = []byte{1, 3} },
+		func(tx *Transaction) { tx.Vin[0].Vout = 1 },
+		func(tx *Transaction) { tx.Vin[0].Sequence = 0 },
+		func(tx *Transaction) { tx.Vout[0].Value = 6 },
+		func(tx *Transaction) { tx.LockTime = 1 },
+		// 連結すると同じバイト列になる区切り方
+		func(tx *Transaction) { tx.Vin[0].Txid = []byte{1}; tx.Vin[0].ScriptSig = []byte{2} },
+		func(tx *Transaction) { tx.Vout = append(tx.Vout, TXOutput{0, nil}) },
+	}
+	for i, modify := range modified {
+		tx := newTx()
+		modify(tx)
+		if bytes.Equal(tx.Hash(), hash) {
+			t.Errorf("modification %d did not change Hash()", i)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// ブロックの取り消しデータを格納するバケット（キーはブロックのハッシュ値）
+// ブロックを切り離す際に、そのブロックが使用した出力をUTXOセットに戻すために使う
+const undoBucket = "undo"
+
+// ブロックの入力が使用した出力
+type spentOutput struct {
+	Txid     []byte   // 出力を作ったトランザクションのID
+	Vout     int      // 出力のインデックス
+	Output   TXOutput // 使用された出力
+	Height   int      // 出力を作ったトランザクションを含むブロックの高さ
+	Coinbase bool     // コインベースの出力か
+}
+
+// ブロックの取り消しデータ
+// 同じブロックの中で作られて使用された出力は含めない
+type blockUndo struct {
+	Spent []spentOutput // ブロックの入力が使用した出力（入力の順）
+}
+
+// 取り消しデータのシリアライズ
+func (undo *blockUndo) Serialize() []byte {
+	var result bytes.Buffer
+	if err := gob.NewEncoder(&result).Encode(undo); err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+// 取り消しデータの取得（ない場合はnil）
+func getBlockUndo(tx *bolt.Tx, hash []byte) *blockUndo {
+	encoded := tx.Bucket([]byte(undoBucket)).Get(hash)
+	if encoded == nil || len(hash) == 0 {
+		return nil
+	}
+	var undo blockUndo
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&undo); err != nil {
+		log.Panic(err)
+	}
+	return &undo
+}
+
+// 取り消しデータの保存
+func putBlockUndo(tx *bolt.Tx, hash []byte, undo *blockUndo) error {
+	return tx.Bucket([]byte(undoBucket)).Put(hash, undo.Serialize())
+}
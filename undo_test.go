@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// 取り消しデータを使ってブロックを切り離すと、UTXOセットが接続前の状態に戻るか
+func TestDisconnectTipRestoresUTXO(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), dbFile), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	prev := &Block{BlockHeader: BlockHeader{Hash: []byte{1}, Height: 1}}
+	funding := TXOutputs{map[int]TXOutput{0: {5, []byte{1}}, 1: {7, []byte{2}}}, 1, true}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{blocksBucket, utxoBucket, undoBucket} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket([]byte(blocksBucket)).Put(prev.Hash, prev.Serialize()); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(utxoBucket)).Put([]byte{9}, funding.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() map[string][]byte {
+		utxo := make(map[string][]byte)
+		db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+				utxo[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+		})
+		return utxo
+	}
+	before := snapshot()
+
+	// 前のブロックの出力を使用するトランザクションと、同じブロックの中でその出力を使用するトランザクション
+	coinbase := &Transaction{[]byte{20}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{{10, []byte{3}}}, 0}
+	spend := &Transaction{[]byte{21}, []TXInput{{[]byte{9}, 1, nil, sequenceFinal}}, []TXOutput{{7, []byte{4}}}, 0}
+	chained := &Transaction{[]byte{22}, []TXInput{{[]byte{21}, 0, nil, sequenceFinal}}, []TXOutput{{7, []byte{5}}}, 0}
+	block := &Block{
+		BlockHeader:  BlockHeader{Hash: []byte{2}, PrevBlockHash: prev.Hash, Height: 2},
+		Transactions: []*Transaction{coinbase, spend, chained},
+	}
+	bc := &Blockchain{prev.Hash, db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		return bc.connectBlock(tx, block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じブロックの中で作られて使用された出力は取り消しデータに含めない
+	var undo *blockUndo
+	db.View(func(tx *bolt.Tx) error {
+		undo = getBlockUndo(tx, block.Hash)
+		return nil
+	})
+	if undo == nil || len(undo.Spent) != 1 {
+		t.Fatalf("undo data = %+v, want 1 spent output", undo)
+	}
+	if s := undo.Spent[0]; !bytes.Equal(s.Txid, []byte{9}) || s.Vout != 1 || s.Output.Value != 7 || s.Height != 1 || !s.Coinbase {
+		t.Errorf("undo.Spent[0] = %+v", s)
+	}
+
+	disconnected, err := bc.DisconnectTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(disconnected.Hash, block.Hash) || !bytes.Equal(bc.tip, prev.Hash) {
+		t.Errorf("DisconnectTip() = %x, tip %x", disconnected.Hash, bc.tip)
+	}
+	after := snapshot()
+	if len(after) != len(before) {
+		t.Fatalf("UTXO set has %d transactions after disconnect, want %d", len(after), len(before))
+	}
+	for k, v := range before {
+		restored := DeserializeOutputs(after[k])
+		original := DeserializeOutputs(v)
+		if len(restored.Outputs) != len(original.Outputs) || restored.Height != original.Height || restored.Coinbase != original.Coinbase {
+			t.Errorf("restored outputs of %x = %+v, want %+v", k, restored, original)
+		}
+	}
+}
@@ -16,3 +16,10 @@ func IntToHex(num int64) []byte {
 	}
 	return buff.Bytes() // バッファーをバイト配列に変換し返す
 }
+
+// バイト配列の順番を反転
+func ReverseBytes(data []byte) {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+}
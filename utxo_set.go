@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// 未使用トランザクション出力を保存するバケット
+const utxoBucket = "chainstate"
+
+// トランザクションごとの未使用出力
+type TXOutputs struct {
+	// 出力のインデックスをキーとした未使用の出力
+	Outputs  map[int]TXOutput
+	Height   int  // トランザクションを含むブロックの高さ
+	Coinbase bool // コインベースの出力か
+}
+
+// 高さheightのブロックで使用できるか
+// コインベースの出力はchainParams.CoinbaseMaturityブロック後から使用できる
+func (outs TXOutputs) IsMature(height int) bool {
+	return !outs.Coinbase || height-outs.Height >= chainParams.CoinbaseMaturity
+}
+
+// 未使用出力のシリアライゼーション
+func (outs TXOutputs) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(outs)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+// 未使用出力のデシリアライゼーション
+func DeserializeOutputs(data []byte) TXOutputs {
+	var outputs TXOutputs
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&outputs)
+	if err != nil {
+		log.Panic(err)
+	}
+	return outputs
+}
+
+// 未使用トランザクション出力の集合（UTXOセット）
+// ブロックチェーン全体を走査せずに残高や支払い可能な出力を求める
+type UTXOSet struct {
+	Blockchain *Blockchain
+}
+
+// 支払可能なトランザクション出力の探索
+// ScriptPubKeyがscriptPubKeyと一致する出力のうち、支払い対象となるものを返す
+func (u UTXOSet) FindSpendableOutputs(
+	scriptPubKey []byte, amount int) (int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+	db := u.Blockchain.db
+	// 次のブロックで使用できる出力のみを対象とする
+	height := u.Blockchain.GetBestHeight() + 1
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			outs := DeserializeOutputs(v)
+			if !outs.IsMature(height) {
+				continue
+			}
+
+			for outIdx, out := range outs.Outputs {
+				if bytes.Equal(out.ScriptPubKey, scriptPubKey) && accumulated < amount {
+					accumulated += out.Value
+					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return accumulated, unspentOutputs
+}
+
+// 公開鍵ハッシュでロックされた未使用出力を全て返す
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+	var UTXOs []TXOutput
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					UTXOs = append(UTXOs, out)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return UTXOs
+}
+
+// トランザクションIDに対応する未使用出力
+// UTXOセットに存在しない場合はfalseを返す
+func (u UTXOSet) FindOutputs(txID []byte) (TXOutputs, bool) {
+	var outs TXOutputs
+	found := false
+	err := u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		v := b.Get(txID)
+		if v != nil {
+			outs = DeserializeOutputs(v)
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return outs, found
+}
+
+// ScriptPubKeyがscriptPubKeyと一致する未使用出力の合計
+// 次のブロックで使用できる金額と、未成熟のコインベースの金額を分けて返す
+func (u UTXOSet) Balance(scriptPubKey []byte) (spendable, immature int) {
+	height := u.Blockchain.GetBestHeight() + 1
+	err := u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				if !bytes.Equal(out.ScriptPubKey, scriptPubKey) {
+					continue
+				}
+				if outs.IsMature(height) {
+					spendable += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return spendable, immature
+}
+
+// UTXOセットに含まれるトランザクションの数
+func (u UTXOSet) CountTransactions() int {
+	db := u.Blockchain.db
+	counter := 0
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			counter++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return counter
+}
+
+// ブロックチェーン全体を走査してUTXOセットを作り直す
+func (u UTXOSet) Reindex() {
+	db := u.Blockchain.db
+	bucketName := []byte(utxoBucket)
+
+	UTXO := u.Blockchain.FindUTXO()
+
+	// 削除と再構築を同じトランザクションで行い、途中で失敗しても空のUTXOセットを残さない
+	err := db.Update(func(tx *bolt.Tx) error {
+		// 既存のバケットは削除して作り直す
+		err := tx.DeleteBucket(bucketName)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		for txID, outs := range UTXO {
+			key, err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
+			err = b.Put(key, outs.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 新しいブロックのトランザクションをUTXOセットに反映
+func (u UTXOSet) Update(block *Block) {
+	err := u.Blockchain.db.Update(func(tx *bolt.Tx) error {
+		_, err := u.update(tx, block)
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// ブロックの反映処理
+// ブロックの保存と同じbolt.Txの中で呼び出せるようにする
+// 切り離す際に使用した出力を戻せるよう、取り消しデータを返す
+func (u UTXOSet) update(tx *bolt.Tx, block *Block) (*blockUndo, error) {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := &blockUndo{}
+	created := make(map[string]bool) // このブロックで作られた出力のトランザクション
+
+	for _, t := range block.Transactions {
+		if t.IsCoinbase() == false {
+			// 入力が参照する出力を使用済みとして削除
+			for _, vin := range t.Vin {
+				// 参照先がない場合は検証済みのブロックと食い違っているので反映しない
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					return nil, fmt.Errorf("%w: %x:%d", ErrMissingInput, vin.Txid, vin.Vout)
+				}
+				outs := DeserializeOutputs(outsBytes)
+				out, ok := outs.Outputs[vin.Vout]
+				if !ok {
+					return nil, fmt.Errorf("%w: %x:%d", ErrMissingInput, vin.Txid, vin.Vout)
+				}
+				if !created[hex.EncodeToString(vin.Txid)] {
+					undo.Spent = append(undo.Spent, spentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Coinbase})
+				}
+				delete(outs.Outputs, vin.Vout)
+
+				// 全て使用済みになったトランザクションは削除
+				if len(outs.Outputs) == 0 {
+					err := b.Delete(vin.Txid)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					err := b.Put(vin.Txid, outs.Serialize())
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		created[hex.EncodeToString(t.ID)] = true
+
+		// 新しい出力を追加（使用できないデータ出力は除く）
+		newOutputs := TXOutputs{make(map[int]TXOutput), block.Height, t.IsCoinbase()}
+		for outIdx, out := range t.Vout {
+			if out.IsUnspendable() {
+				continue
+			}
+			newOutputs.Outputs[outIdx] = out
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+		err := b.Put(t.ID, newOutputs.Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return undo, nil
+}
+
+// UTXOセットの統計情報
+type UTXOSetInfo struct {
+	Transactions int    // 未使用出力を持つトランザクションの数
+	Outputs      int    // 未使用出力の数
+	TotalAmount  int    // 未使用出力の合計額（総供給量）
+	Hash         []byte // シリアライズしたUTXOセットのハッシュ値
+}
+
+// UTXOセットの統計情報を求める
+// ハッシュ値はトランザクションIDと出力インデックスの順に並べて算出するので
+// 同じUTXOセットを持つノード同士では一致する
+func (u UTXOSet) Info() UTXOSetInfo {
+	var info UTXOSetInfo
+	hasher := sha256.New()
+
+	err := u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		// boltのカーソルはキー（トランザクションID）の昇順
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			info.Transactions++
+			for _, outIdx := range outs.sortedIndexes() {
+				out := outs.Outputs[outIdx]
+				info.Outputs++
+				info.TotalAmount += out.Value
+				hasher.Write(serializeUTXO(k, outIdx, out, outs.Height, outs.Coinbase))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	info.Hash = hasher.Sum(nil)
+	return info
+}
+
+// UTXOセットの不一致の種類
+const (
+	UTXOMissing    = "missing"    // ブロックチェーン上は未使用だが保存されていない
+	UTXOExtra      = "extra"      // 保存されているがブロックチェーン上には存在しない
+	UTXOMismatched = "mismatched" // 保存されている内容が異なる
+)
+
+// 保存されたUTXOセットとブロックチェーンから求めたものとの差異
+type UTXOMismatch struct {
+	Kind     string     // 不一致の種類
+	TxID     string     // トランザクションID
+	Index    int        // 出力のインデックス
+	Height   int        // トランザクションを含むブロックの高さ（不明な場合は-1）
+	Expected *UTXOEntry // ブロックチェーンから求めた出力
+	Actual   *UTXOEntry // 保存されている出力
+}
+
+// 比較する出力と、それを含むトランザクションの高さ・コインベースかどうか
+type UTXOEntry struct {
+	TXOutput
+	Height   int  // トランザクションを含むブロックの高さ
+	Coinbase bool // コインベースの出力か
+}
+
+// outIdx番目の出力を、トランザクションの高さ・コインベースかどうかと合わせて取り出す
+func (outs TXOutputs) entry(outIdx int) *UTXOEntry {
+	return &UTXOEntry{outs.Outputs[outIdx], outs.Height, outs.Coinbase}
+}
+
+// 比較用の出力を文字列で表現
+func (e *UTXOEntry) String() string {
+	return fmt.Sprintf("%d %x 高さ %d コインベース %t", e.Value, e.ScriptPubKey, e.Height, e.Coinbase)
+}
+
+// 不一致の内容を文字列で表現
+func (m UTXOMismatch) String() string {
+	height := "不明"
+	if m.Height >= 0 {
+		height = strconv.Itoa(m.Height)
+	}
+	line := fmt.Sprintf("%s %s:%d (ブロック高 %s)", m.Kind, m.TxID, m.Index, height)
+	if m.Expected != nil {
+		line += fmt.Sprintf(" 期待値: %v", m.Expected)
+	}
+	if m.Actual != nil {
+		line += fmt.Sprintf(" 保存値: %v", m.Actual)
+	}
+	return line
+}
+
+// ブロックチェーンからUTXOセットを独立に求め、保存されたものと比較する
+func (u UTXOSet) Verify() []UTXOMismatch {
+	var mismatches []UTXOMismatch
+	expected := u.Blockchain.FindUTXO()
+	heights := u.Blockchain.txHeights()
+
+	height := func(txID string) int {
+		if h, ok := heights[txID]; ok {
+			return h
+		}
+		return -1
+	}
+
+	err := u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			actual := DeserializeOutputs(v)
+			for _, outIdx := range actual.sortedIndexes() {
+				out := actual.entry(outIdx)
+				wantOuts := expected[txID]
+				if _, ok := wantOuts.Outputs[outIdx]; !ok {
+					mismatches = append(mismatches,
+						UTXOMismatch{UTXOExtra, txID, outIdx, height(txID), nil, out})
+					continue
+				}
+				// 成熟の判定に使う高さとコインベースかどうかも比較する
+				want := wantOuts.entry(outIdx)
+				if want.Value != out.Value || !bytes.Equal(want.ScriptPubKey, out.ScriptPubKey) ||
+					want.Height != out.Height || want.Coinbase != out.Coinbase {
+					mismatches = append(mismatches,
+						UTXOMismatch{UTXOMismatched, txID, outIdx, height(txID), want, out})
+				}
+			}
+			// 比較済みの出力を取り除き、残りを保存漏れとする
+			if outs, ok := expected[txID]; ok {
+				for outIdx := range actual.Outputs {
+					delete(outs.Outputs, outIdx)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var missingIDs []string
+	for txID := range expected {
+		missingIDs = append(missingIDs, txID)
+	}
+	sort.Strings(missingIDs)
+	for _, txID := range missingIDs {
+		outs := expected[txID]
+		for _, outIdx := range outs.sortedIndexes() {
+			mismatches = append(mismatches,
+				UTXOMismatch{UTXOMissing, txID, outIdx, height(txID), outs.entry(outIdx), nil})
+		}
+	}
+	return mismatches
+}
+
+// 出力のインデックスを昇順に並べて返す
+func (outs TXOutputs) sortedIndexes() []int {
+	var indexes []int
+	for outIdx := range outs.Outputs {
+		indexes = append(indexes, outIdx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// ハッシュ値算出用の出力の表現
+// トランザクションID + インデックス + 高さ + コインベースか（1バイト） + 金額 + ScriptPubKey
+func serializeUTXO(txID []byte, outIdx int, out TXOutput, height int, coinbase bool) []byte {
+	flag := byte(0)
+	if coinbase {
+		flag = 1
+	}
+	return bytes.Join([][]byte{
+		txID,
+		IntToHex(int64(outIdx)),
+		IntToHex(int64(height)),
+		{flag},
+		IntToHex(int64(out.Value)),
+		out.ScriptPubKey,
+	}, []byte{})
+}
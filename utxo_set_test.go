@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// 参照先がUTXOセットにない入力を含むブロックは反映せずエラーを返すか
+func TestUTXOSetUpdateMissingInput(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), dbFile), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	funding := TXOutputs{map[int]TXOutput{0: {5, []byte{1}}}, 1, false}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte{9}, funding.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase := &Transaction{[]byte{20}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{{10, []byte{3}}}, 0}
+	tests := []struct {
+		name string
+		vin  TXInput
+	}{
+		{"unknown transaction", TXInput{[]byte{8}, 0, nil, sequenceFinal}},
+		{"unknown output", TXInput{[]byte{9}, 1, nil, sequenceFinal}},
+	}
+	for _, test := range tests {
+		spend := &Transaction{[]byte{21}, []TXInput{{[]byte{9}, 0, nil, sequenceFinal}, test.vin}, []TXOutput{{5, []byte{4}}}, 0}
+		block := &Block{
+			BlockHeader:  BlockHeader{Hash: []byte{2}, Height: 2},
+			Transactions: []*Transaction{coinbase, spend},
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			_, err := UTXOSet{&Blockchain{nil, db}}.update(tx, block)
+			return err
+		})
+		if !errors.Is(err, ErrMissingInput) {
+			t.Errorf("%s: update() = %v, want ErrMissingInput", test.name, err)
+		}
+		// 途中まで反映した変更は取り消される
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(utxoBucket))
+			if !bytes.Equal(b.Get([]byte{9}), funding.Serialize()) || b.Get(coinbase.ID) != nil {
+				t.Errorf("%s: UTXO set was modified by a failed update", test.name)
+			}
+			return nil
+		})
+	}
+}
+
+// 保存された出力の高さやコインベースかどうかが異なる場合も、不一致として検出しハッシュ値が変わるか
+func TestUTXOSetVerifyHeightAndCoinbase(t *testing.T) {
+	bc, _ := newTestChain(t)
+	utxoSet := UTXOSet{bc}
+	if mismatches := utxoSet.Verify(); len(mismatches) != 0 {
+		t.Fatalf("Verify() = %v, want no mismatches", mismatches)
+	}
+	before := utxoSet.Info().Hash
+
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txID := genesis.Transactions[0].ID
+	stored, _ := utxoSet.FindOutputs(txID)
+	tests := []struct {
+		name   string
+		modify func(*TXOutputs)
+	}{
+		{"height", func(outs *TXOutputs) { outs.Height++ }},
+		{"coinbase", func(outs *TXOutputs) { outs.Coinbase = false }},
+	}
+	for _, test := range tests {
+		outs := DeserializeOutputs(stored.Serialize())
+		test.modify(&outs)
+		err := bc.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(utxoBucket)).Put(txID, outs.Serialize())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mismatches := utxoSet.Verify()
+		if len(mismatches) != 1 || mismatches[0].Kind != UTXOMismatched {
+			t.Errorf("%s: Verify() = %v, want one mismatched output", test.name, mismatches)
+		}
+		if bytes.Equal(utxoSet.Info().Hash, before) {
+			t.Errorf("%s: Info().Hash did not change", test.name)
+		}
+	}
+}
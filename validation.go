@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ブロックの検証で発生するエラーの種類
+var (
+	ErrBadProofOfWork    = errors.New("PoWが正しくありません")
+	ErrBadDifficulty     = errors.New("採掘難易度が正しくありません")
+	ErrUnknownParent     = errors.New("前のブロックが見つかりません")
+	ErrInvalidParent     = errors.New("前のブロックが不正です")
+	ErrBadMerkleRoot     = errors.New("トランザクションのハッシュが一致しません")
+	ErrBadTimestamp      = errors.New("タイムスタンプが正しくありません")
+	ErrBadHeight         = errors.New("ブロックの高さが正しくありません")
+	ErrBadTxID           = errors.New("トランザクションIDが内容と一致しません")
+	ErrNoTransactions    = errors.New("トランザクションがありません")
+	ErrBadCoinbase       = errors.New("コインベースが正しくありません")
+	ErrCoinbaseOverpay   = errors.New("コインベースの金額が報酬と手数料の合計を超えています")
+	ErrBadTransaction    = errors.New("トランザクションの形式が正しくありません")
+	ErrMissingInput      = errors.New("入力が参照する出力が存在しないか使用済みです")
+	ErrDoubleSpend       = errors.New("同じ出力を二重に使用しています")
+	ErrDuplicateTx       = errors.New("未使用の出力が残っているトランザクションと同じIDです")
+	ErrImmatureCoinbase  = errors.New("未成熟のコインベースの出力を使用しています")
+	ErrLockTime          = errors.New("ロックタイムに達していないトランザクションです")
+	ErrSequenceLock      = errors.New("相対ロックタイムに達していない出力を使用しています")
+	ErrInsufficientInput = errors.New("出力の合計が入力の合計を超えています")
+	ErrBadSignature      = errors.New("署名が正しくありません")
+)
+
+// 未来のタイムスタンプとして許容する時間（秒）
+const maxFutureBlockTime = 2 * 60 * 60
+
+// タイムスタンプの下限を求めるのに使う直前のブロック数
+const medianTimeSpan = 11
+
+// ブロックの検証エラー
+// Errは上記のエラーの種類、Detailは原因となった箇所などの説明
+type BlockValidationError struct {
+	Err    error
+	Detail string
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("不正なブロック: %v", e.Err)
+	}
+	return fmt.Sprintf("不正なブロック: %v (%s)", e.Err, e.Detail)
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Err
+}
+
+// 検証エラーの生成
+func invalidBlock(err error, format string, args ...interface{}) error {
+	return &BlockValidationError{err, fmt.Sprintf(format, args...)}
+}
+
+// ブロックを受け入れる前の検証
+// 現在の最終ブロックに続くブロックとして、ヘッダー、
+// トランザクションのハッシュ、各トランザクションを検証する
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	median, err := bc.validateHeader(&block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	if err := checkMerkleRoot(block); err != nil {
+		return err
+	}
+	_, err = bc.validateTransactions(block.Transactions, block.Height, median)
+	return err
+}
+
+// ヘッダーの検証
+// PoW、前のブロックとのつながり、高さ、採掘難易度、タイムスタンプを検証し、
+// 直前のブロックのタイムスタンプの中央値を返す
+// 前のブロックはヘッダーのみを受信したものでもよい
+func (bc *Blockchain) validateHeader(header *BlockHeader) (int64, error) {
+	// PoWとハッシュ値
+	if err := checkProofOfWork(header); err != nil {
+		return 0, err
+	}
+
+	// 前のブロックが存在するか
+	ancestors, err := bc.ancestors(header.PrevBlockHash, medianTimeSpan)
+	if err != nil {
+		return 0, err
+	}
+	if len(ancestors) == 0 {
+		return 0, invalidBlock(ErrUnknownParent, "前のブロック %x", header.PrevBlockHash)
+	}
+
+	// 高さは前のブロックの次であること
+	if expected := ancestors[0].Height + 1; header.Height != expected {
+		return 0, invalidBlock(ErrBadHeight, "%d (期待値 %d)", header.Height, expected)
+	}
+
+	// 採掘難易度が再調整の規則に従っているか
+	if expected := bc.nextBits(header.PrevBlockHash); header.Bits != expected {
+		return 0, invalidBlock(ErrBadDifficulty, "%08x (期待値 %08x)", header.Bits, expected)
+	}
+
+	// タイムスタンプは直近のブロックの中央値より前でなく、かつ未来すぎないこと
+	// 1秒間に複数のブロックを採掘できるため、中央値と同じ値は許容する
+	median := medianTime(ancestors)
+	if header.Timestamp < median {
+		return 0, invalidBlock(ErrBadTimestamp,
+			"%d は直近%dブロックの中央値 %d より前", header.Timestamp, len(ancestors), median)
+	}
+	if limit := time.Now().Unix() + maxFutureBlockTime; header.Timestamp > limit {
+		return 0, invalidBlock(ErrBadTimestamp, "%d は未来すぎます", header.Timestamp)
+	}
+	return median, nil
+}
+
+// 他のノードから受け取った初期ブロックの検証
+func (bc *Blockchain) validateGenesisBlock(block *Block) error {
+	if err := validateGenesisHeader(&block.BlockHeader); err != nil {
+		return err
+	}
+	if err := checkMerkleRoot(block); err != nil {
+		return err
+	}
+	_, err := bc.validateTransactions(block.Transactions, 0, 0)
+	return err
+}
+
+// 初期ブロックのヘッダーの検証
+func validateGenesisHeader(header *BlockHeader) error {
+	if len(header.PrevBlockHash) != 0 || header.Height != 0 {
+		return invalidBlock(ErrUnknownParent, "初期ブロック以外のブロック %x", header.Hash)
+	}
+	if header.Bits != initialBits {
+		return invalidBlock(ErrBadDifficulty, "%08x (期待値 %08x)", header.Bits, initialBits)
+	}
+	return checkProofOfWork(header)
+}
+
+// ハッシュ値がヘッダーの内容と一致し、PoWの条件を満たしているか
+func checkProofOfWork(header *BlockHeader) error {
+	pow := NewProofOfWork(header)
+	hash := sha256.Sum256(pow.prepareData(header.Nonce))
+	if !bytes.Equal(hash[:], header.Hash) {
+		return invalidBlock(ErrBadProofOfWork, "ブロック %x のハッシュ値がヘッダーと一致しません", header.Hash)
+	}
+	if pow.target.Sign() <= 0 || pow.target.Cmp(powLimit) > 0 || !pow.Validate() {
+		return invalidBlock(ErrBadProofOfWork, "ブロック %x", header.Hash)
+	}
+	return nil
+}
+
+// ヘッダーのマークルルートがトランザクションと一致するか
+func checkMerkleRoot(block *Block) error {
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return invalidBlock(ErrBadMerkleRoot, "ブロック %x", block.Hash)
+	}
+	return nil
+}
+
+// hashのブロックから前のブロックを遡ってn個のヘッダーを集める
+func (bc *Blockchain) ancestors(hash []byte, n int) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		for len(headers) < n && len(hash) > 0 {
+			encoded := b.Get(hash)
+			if encoded == nil {
+				break
+			}
+			header := DeserializeHeader(encoded)
+			headers = append(headers, header)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	return headers, err
+}
+
+// ブロックに含めるトランザクションの検証
+// 先頭のみがコインベースであること、二重使用がないこと、
+// ロックタイムを過ぎていること、入力の合計が出力の合計以上であること、署名が正しいこと、
+// コインベースが高さheightの報酬と手数料の合計を超えないことを確認する
+// 時刻によるロックタイムは直前のブロックのタイムスタンプの中央値medianTimePastと比べる
+// 検証に成功した場合はコインベース以外のトランザクションの手数料の合計を返す
+func (bc *Blockchain) validateTransactions(transactions []*Transaction, height int, medianTimePast int64) (int, error) {
+	if len(transactions) == 0 {
+		return 0, invalidBlock(ErrNoTransactions, "")
+	}
+	if !transactions[0].IsCoinbase() {
+		return 0, invalidBlock(ErrBadCoinbase, "先頭のトランザクションがコインベースではありません")
+	}
+
+	UTXOSet := UTXOSet{bc}
+	spent := make(map[string]bool)          // このブロックで使用済みの出力
+	created := make(map[string]Transaction) // このブロックで作られたトランザクション
+	fees := 0
+
+	for i, tx := range transactions {
+		txID := hex.EncodeToString(tx.ID)
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return 0, invalidBlock(ErrBadTxID, "トランザクション %s", txID)
+		}
+		// 同じIDのトランザクションの出力が残っていると、UTXOセットで上書きされてしまう
+		if _, ok := created[txID]; ok {
+			return 0, invalidBlock(ErrDuplicateTx, "トランザクション %s", txID)
+		}
+		if _, ok := UTXOSet.FindOutputs(tx.ID); ok {
+			return 0, invalidBlock(ErrDuplicateTx, "トランザクション %s", txID)
+		}
+		if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+			return 0, invalidBlock(ErrBadTransaction, "トランザクション %s に入力または出力がありません", txID)
+		}
+		dataOutputs := 0
+		for _, out := range tx.Vout {
+			// 使用できない出力は1つまで、かつ上限以下のデータ出力であること
+			if out.IsUnspendable() {
+				if ClassifyScript(out.ScriptPubKey) != ScriptNullData {
+					return 0, invalidBlock(ErrBadTransaction,
+						"トランザクション %s のデータ出力が%dバイトを超えています", txID, maxDataCarrierSize)
+				}
+				dataOutputs++
+			}
+		}
+		if dataOutputs > 1 {
+			return 0, invalidBlock(ErrBadTransaction, "トランザクション %s にデータ出力が複数あります", txID)
+		}
+
+		if tx.IsCoinbase() {
+			if i != 0 {
+				return 0, invalidBlock(ErrBadCoinbase, "コインベースが%d番目にあります", i)
+			}
+			// コインベースの出力は最後に報酬と手数料の合計と比べる
+			created[txID] = *tx
+			continue
+		}
+		outputValue := 0
+		for _, out := range tx.Vout {
+			if !MoneyRange(out.Value) {
+				return 0, invalidBlock(ErrBadTransaction, "トランザクション %s の出力 %d が範囲外です", txID, out.Value)
+			}
+			outputValue += out.Value
+			if !MoneyRange(outputValue) {
+				return 0, invalidBlock(ErrBadTransaction, "トランザクション %s の出力の合計が範囲外です", txID)
+			}
+		}
+		if !tx.IsFinal(height, medianTimePast) {
+			return 0, invalidBlock(ErrLockTime, "トランザクション %s (ロックタイム %d)", txID, tx.LockTime)
+		}
+
+		// 入力が参照する出力を、このブロック内またはUTXOセットから探す
+		inputValue := 0
+		var prevOuts []TXOutput // 各入力が使用する出力（署名の検証に使う）
+		for _, vin := range tx.Vin {
+			prevID := hex.EncodeToString(vin.Txid)
+			outpoint := fmt.Sprintf("%s:%d", prevID, vin.Vout)
+			if spent[outpoint] {
+				return 0, invalidBlock(ErrDoubleSpend, "%s", outpoint)
+			}
+			spent[outpoint] = true
+
+			var out TXOutput
+			confirmed := height // 参照先の出力が承認されたブロックの高さ
+			if prevTx, ok := created[prevID]; ok {
+				if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+					return 0, invalidBlock(ErrMissingInput, "%s", outpoint)
+				}
+				if prevTx.IsCoinbase() && chainParams.CoinbaseMaturity > 0 {
+					return 0, invalidBlock(ErrImmatureCoinbase, "%s", outpoint)
+				}
+				out = prevTx.Vout[vin.Vout]
+			} else {
+				outs, ok := UTXOSet.FindOutputs(vin.Txid)
+				utxo, unspent := outs.Outputs[vin.Vout]
+				if !ok || !unspent {
+					return 0, invalidBlock(ErrMissingInput, "%s", outpoint)
+				}
+				if !outs.IsMature(height) {
+					return 0, invalidBlock(ErrImmatureCoinbase,
+						"%s (高さ %d のコインベース)", outpoint, outs.Height)
+				}
+				out = utxo
+				confirmed = outs.Height
+			}
+			if blocks := vin.RelativeLockBlocks(); height < confirmed+blocks {
+				return 0, invalidBlock(ErrSequenceLock,
+					"%s (高さ %d から %d ブロック)", outpoint, confirmed, blocks)
+			}
+			inputValue += out.Value
+			if !MoneyRange(out.Value) || !MoneyRange(inputValue) {
+				return 0, invalidBlock(ErrBadTransaction, "トランザクション %s の入力の合計が範囲外です", txID)
+			}
+			prevOuts = append(prevOuts, out)
+		}
+
+		if inputValue < outputValue {
+			return 0, invalidBlock(ErrInsufficientInput,
+				"トランザクション %s 入力 %d < 出力 %d", txID, inputValue, outputValue)
+		}
+		fees += inputValue - outputValue
+		if !MoneyRange(fees) {
+			return 0, invalidBlock(ErrBadTransaction, "手数料の合計が範囲外です")
+		}
+
+		if err := tx.VerifyScripts(prevOuts); err != nil {
+			return 0, invalidBlock(ErrBadSignature, "トランザクション %s %v", txID, err)
+		}
+		created[txID] = *tx
+	}
+
+	// コインベースは報酬と手数料の合計までしか受け取れない
+	// 加算がオーバーフローしないよう、残りの上限と比べながら合計する
+	subsidy := GetBlockSubsidy(height)
+	limit := subsidy + fees
+	reward := 0
+	for _, out := range transactions[0].Vout {
+		if out.Value < 0 {
+			return 0, invalidBlock(ErrBadTransaction, "コインベースに負の出力があります")
+		}
+		if out.Value > limit-reward {
+			return 0, invalidBlock(ErrCoinbaseOverpay, "%d を超えています (報酬 %d + 手数料 %d)", limit, subsidy, fees)
+		}
+		reward += out.Value
+	}
+	return fees, nil
+}
+
+// ブロックのタイムスタンプの中央値
+func medianTime(headers []*BlockHeader) int64 {
+	var timestamps []int64
+	for _, header := range headers {
+		timestamps = append(timestamps, header.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// 一時ディレクトリに初期ブロックのみのブロックチェーンを作成する
+// 初期ブロックの報酬はwalletのアドレスに支払う
+func newTestChain(t *testing.T) (*Blockchain, *Wallet) {
+	t.Helper()
+	chdirTemp(t)
+	wallet := NewWallet()
+	bc := CreateBlockchain(string(wallet.GetAddress()))
+	t.Cleanup(func() { bc.db.Close() })
+	return bc, wallet
+}
+
+// prevの後に続くブロックを採掘する（prevがnilの場合は最終ブロックの後）
+// modifyがnilでなければ、ヘッダーを書き換えてから採掘する
+func newTestBlock(t *testing.T, bc *Blockchain, prev *Block, txs []*Transaction, modify func(*Block)) *Block {
+	t.Helper()
+	if prev == nil {
+		var err error
+		if prev, err = bc.GetBlock(bc.tip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block := &Block{
+		BlockHeader:  BlockHeader{time.Now().Unix(), prev.Hash, nil, nil, 0, bc.nextBits(prev.Hash), prev.Height + 1},
+		Transactions: txs,
+	}
+	block.MerkleRoot = block.HashTransactions()
+	if modify != nil {
+		modify(block)
+	}
+	block.Nonce, block.Hash = NewProofOfWork(&block.BlockHeader).Run()
+	return block
+}
+
+// walletへの報酬とtxsを含むブロックを最終ブロックの後にn個採掘して追加する
+// 追加したブロックを返す
+func addTestBlocks(t *testing.T, bc *Blockchain, wallet *Wallet, n int, txs ...*Transaction) []*Block {
+	t.Helper()
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", bc.GetBestHeight()+1, 0)
+		block := newTestBlock(t, bc, nil, append([]*Transaction{coinbase}, txs...), nil)
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		txs = nil
+	}
+	return blocks
+}
+
+// prevの出力voutをwalletに送り直す署名済みのトランザクション
+// modifyがnilでなければ、署名する前にトランザクションを書き換える
+func newTestSpend(t *testing.T, wallet *Wallet, prev *Transaction, vout, value int, modify func(*Transaction)) *Transaction {
+	t.Helper()
+	tx := &Transaction{nil, []TXInput{{prev.ID, vout, nil, sequenceFinal}},
+		[]TXOutput{*NewTXOutput(value, string(wallet.GetAddress()))}, 0}
+	if modify != nil {
+		modify(tx)
+	}
+	if err := tx.Sign(wallet.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev}); err != nil {
+		t.Fatal(err)
+	}
+	tx.SetID()
+	return tx
+}
+
+// ブロックの検証で、規則ごとに対応するエラーを返すか
+func TestValidateBlock(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 高さ0のコインベースは使用でき、最後のブロックのコインベースは未成熟
+	// 高さ1のコインベースは最後のブロックで使用済み
+	blocks := addTestBlocks(t, bc, wallet, chainParams.CoinbaseMaturity+1)
+	spent := blocks[0].Transactions[0]
+	blocks = append(blocks, addTestBlocks(t, bc, wallet, 1, newTestSpend(t, wallet, spent, 0, 1, nil))...)
+	height := bc.GetBestHeight() + 1
+	mature := genesis.Transactions[0]
+	immature := blocks[len(blocks)-1].Transactions[0]
+	value := mature.Vout[0].Value
+	coinbase := NewCoinbaseTX(address, "", height, 0)
+
+	spend := func(modify func(*Transaction)) *Transaction {
+		return newTestSpend(t, wallet, mature, 0, value, modify)
+	}
+	unknown := &Transaction{[]byte{1}, []TXInput{{[]byte{}, -1, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(value, address)}, 0}
+	badID := spend(nil)
+	badID.ID[0] ^= 1
+	badSignature := spend(nil)
+	badSignature.Vout[0].Value--
+	badSignature.SetID()
+	duplicate := spend(nil)
+	// 出力の合計がオーバーフローして負になるコインベース
+	overflow := NewCoinbaseTX(address, "", height, 0)
+	overflow.Vout = []TXOutput{*NewTXOutput(math.MaxInt64, address), *NewTXOutput(math.MaxInt64, address)}
+	overflow.SetID()
+
+	tests := []struct {
+		name   string
+		txs    []*Transaction
+		modify func(*Block) // 採掘前にヘッダーを書き換える
+		tamper func(*Block) // 採掘後に書き換える
+		err    error
+	}{
+		{"valid", []*Transaction{coinbase, spend(nil)}, nil, nil, nil},
+		{"proof of work", []*Transaction{coinbase}, nil, func(b *Block) { b.Nonce++ }, ErrBadProofOfWork},
+		{"bits", []*Transaction{coinbase}, func(b *Block) { b.Bits = BigToCompact(powLimit) }, nil, ErrBadDifficulty},
+		{"height", []*Transaction{coinbase}, func(b *Block) { b.Height++ }, nil, ErrBadHeight},
+		{"merkle root", []*Transaction{coinbase}, nil,
+			func(b *Block) { b.Transactions = []*Transaction{NewCoinbaseTX(address, "", height, 0)} }, ErrBadMerkleRoot},
+		{"timestamp before median", []*Transaction{coinbase},
+			func(b *Block) { b.Timestamp = genesis.Timestamp - 1 }, nil, ErrBadTimestamp},
+		{"timestamp in the future", []*Transaction{coinbase},
+			func(b *Block) { b.Timestamp = time.Now().Unix() + maxFutureBlockTime + 60 }, nil, ErrBadTimestamp},
+		{"no coinbase", []*Transaction{spend(nil)}, nil, nil, ErrBadCoinbase},
+		{"second coinbase", []*Transaction{coinbase, NewCoinbaseTX(address, "", height, 0)}, nil, nil, ErrBadCoinbase},
+		{"coinbase overpay", []*Transaction{NewCoinbaseTX(address, "", height, 1)}, nil, nil, ErrCoinbaseOverpay},
+		{"coinbase overpay by overflow", []*Transaction{overflow}, nil, nil, ErrCoinbaseOverpay},
+		{"duplicate of unspent transaction", []*Transaction{mature}, nil, nil, ErrDuplicateTx},
+		{"duplicate in block", []*Transaction{coinbase, duplicate, duplicate}, nil, nil, ErrDuplicateTx},
+		{"double spend", []*Transaction{coinbase, spend(nil), newTestSpend(t, wallet, mature, 0, value-1, nil)},
+			nil, nil, ErrDoubleSpend},
+		{"missing input", []*Transaction{coinbase, newTestSpend(t, wallet, unknown, 0, value, nil)}, nil, nil, ErrMissingInput},
+		{"spent output", []*Transaction{coinbase, newTestSpend(t, wallet, spent, 0, 1, nil)}, nil, nil, ErrMissingInput},
+		{"insufficient input", []*Transaction{coinbase, newTestSpend(t, wallet, mature, 0, value+1, nil)},
+			nil, nil, ErrInsufficientInput},
+		{"output above max supply", []*Transaction{coinbase, spend(func(tx *Transaction) { tx.Vout[0].Value = MaxSupply() + 1 })},
+			nil, nil, ErrBadTransaction},
+		{"output overflow", []*Transaction{coinbase, spend(func(tx *Transaction) {
+			tx.Vout = []TXOutput{*NewTXOutput(math.MaxInt64, address), *NewTXOutput(2, address)}
+		})}, nil, nil, ErrBadTransaction},
+		{"transaction id", []*Transaction{coinbase, badID}, nil, nil, ErrBadTxID},
+		{"signature", []*Transaction{coinbase, badSignature}, nil, nil, ErrBadSignature},
+		{"immature coinbase", []*Transaction{coinbase, newTestSpend(t, wallet, immature, 0, 1, nil)},
+			nil, nil, ErrImmatureCoinbase},
+		{"coinbase of the same block", []*Transaction{coinbase, newTestSpend(t, wallet, coinbase, 0, 1, nil)},
+			nil, nil, ErrImmatureCoinbase},
+		{"lock time", []*Transaction{coinbase, spend(func(tx *Transaction) { tx.SetLockTime(uint32(height)) })},
+			nil, nil, ErrLockTime},
+		{"sequence lock", []*Transaction{coinbase, spend(func(tx *Transaction) { tx.Vin[0].Sequence = uint32(height + 1) })},
+			nil, nil, ErrSequenceLock},
+	}
+	for _, test := range tests {
+		block := newTestBlock(t, bc, nil, test.txs, test.modify)
+		if test.tamper != nil {
+			test.tamper(block)
+		}
+		err := bc.ValidateBlock(block)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: ValidateBlock() = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		var validationErr *BlockValidationError
+		if err != nil && !errors.As(err, &validationErr) {
+			t.Errorf("%s: ValidateBlock() = %T, want *BlockValidationError", test.name, err)
+		}
+	}
+}
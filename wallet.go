@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"math/big"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+const version = byte(0x00)           // アドレスのバージョン
+const scriptHashVersion = byte(0x05) // P2SHアドレスのバージョン
+const addressChecksumLen = 4         // チェックサムのバイト数
+const pubKeyHashLen = 20             // 公開鍵ハッシュ（RIPEMD160）のバイト数
+
+// ウォレット（秘密鍵と公開鍵の組）
+type Wallet struct {
+	PrivateKey ecdsa.PrivateKey // 秘密鍵
+	PublicKey  []byte           // 公開鍵（X座標とY座標を連結したもの）
+}
+
+// 新しいウォレットの生成
+func NewWallet() *Wallet {
+	private, public := newKeyPair()
+	wallet := Wallet{private, public}
+	return &wallet
+}
+
+// 秘密鍵（32バイト）からウォレットを復元
+func NewWalletFromPrivateKey(key []byte) (*Wallet, error) {
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(key)
+	// 秘密鍵は1以上、曲線の位数未満でなければならない
+	if len(key) != 32 || d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("秘密鍵が正しくありません")
+	}
+	private := ecdsa.PrivateKey{}
+	private.PublicKey.Curve = curve
+	private.D = d
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(key)
+	wallet := Wallet{private, pubKeyBytes(&private.PublicKey)}
+	return &wallet, nil
+}
+
+// ウォレットのアドレスを取得
+// バージョン + 公開鍵ハッシュ + チェックサム をBase58でエンコード
+func (w Wallet) GetAddress() []byte {
+	pubKeyHash := HashPubKey(w.PublicKey)
+	return encodeAddress(version, pubKeyHash)
+}
+
+// バージョンとハッシュ値からアドレスを生成
+func encodeAddress(addressVersion byte, hash []byte) []byte {
+	versionedPayload := append([]byte{addressVersion}, hash...)
+	checksum := checksum(versionedPayload)
+
+	fullPayload := append(versionedPayload, checksum...)
+	address := Base58Encode(fullPayload)
+	return address
+}
+
+// 秘密鍵を32バイトの固定長バイト配列として取得
+func (w Wallet) PrivateKeyBytes() []byte {
+	// 先頭が0の場合に短くならないよう32バイトに揃える
+	return w.PrivateKey.D.FillBytes(make([]byte, 32))
+}
+
+// 公開鍵のハッシュ化（SHA256の後にRIPEMD160）
+func HashPubKey(pubKey []byte) []byte {
+	publicSHA256 := sha256.Sum256(pubKey)
+
+	RIPEMD160Hasher := ripemd160.New()
+	_, err := RIPEMD160Hasher.Write(publicSHA256[:])
+	if err != nil {
+		log.Panic(err)
+	}
+	publicRIPEMD160 := RIPEMD160Hasher.Sum(nil)
+	return publicRIPEMD160
+}
+
+// アドレスの検証
+// バージョン（P2PKHまたはP2SH）、20バイトのハッシュ、チェックサムが正しいかを確認
+func ValidateAddress(address string) bool {
+	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) != 1+pubKeyHashLen+addressChecksumLen {
+		return false
+	}
+	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
+	addressVersion := pubKeyHash[0]
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
+	targetChecksum := checksum(append([]byte{addressVersion}, pubKeyHash...))
+
+	return (addressVersion == version || addressVersion == scriptHashVersion) &&
+		bytes.Equal(actualChecksum, targetChecksum)
+}
+
+// アドレスから公開鍵ハッシュ（P2SHの場合はスクリプトハッシュ）を取り出す
+// 長さが正しくない場合はnilを返す（アドレスの検証はValidateAddressで行う）
+func AddressToPubKeyHash(address []byte) []byte {
+	pubKeyHash := Base58Decode(address)
+	if len(pubKeyHash) != 1+pubKeyHashLen+addressChecksumLen {
+		return nil
+	}
+	return pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
+}
+
+// チェックサムの算出（SHA256を2回行った結果の先頭4バイト）
+func checksum(payload []byte) []byte {
+	firstSHA := sha256.Sum256(payload)
+	secondSHA := sha256.Sum256(firstSHA[:])
+	return secondSHA[:addressChecksumLen]
+}
+
+// 楕円曲線P-256による鍵ペアの生成
+func newKeyPair() (ecdsa.PrivateKey, []byte) {
+	curve := elliptic.P256()
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	return *private, pubKeyBytes(&private.PublicKey)
+}
+
+// 公開鍵をX座標、Y座標それぞれ32バイトの固定長で連結
+func pubKeyBytes(pub *ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, 64)
+	pub.X.FillBytes(pubKey[:32])
+	pub.Y.FillBytes(pubKey[32:])
+	return pubKey
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ロック解除中の復号鍵を保持するプロセスのソケット（wallet.datと同じ場所）
+// 鍵はファイルに書き出さず、walletpassphraseが起動したプロセスのメモリにのみ置く
+const walletUnlockSocket = "wallet.sock"
+
+// walletpassphraseが内部で起動するコマンド
+const walletAgentCommand = "walletagent"
+
+// 鍵を保持するプロセスへの要求
+const (
+	walletAgentGetKey = "key"  // 復号鍵を受け取る
+	walletAgentLock   = "lock" // 鍵を破棄して終了させる
+)
+
+// 要求の送受信の期限
+const walletAgentTimeout = time.Second
+
+// 鍵を保持するプロセスの応答
+type walletAgentReply struct {
+	Key []byte // 復号鍵（lockの場合は空）
+}
+
+// 復号鍵をメモリ上に保持し、ソケットで要求されたら渡す
+// timeoutを過ぎるかlockを要求されると、鍵を消去して終了する
+// readyはソケットの準備ができたときに呼ばれる
+func runWalletAgent(key []byte, timeout time.Duration, ready func()) error {
+	// 前のプロセスが異常終了して残したソケットを削除する
+	if _, err := requestWalletAgent(walletAgentGetKey); err == nil {
+		return errors.New("ロック解除中のプロセスがすでに実行されています")
+	}
+	if err := os.Remove(walletUnlockSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 他のユーザーが鍵を受け取れないよう、所有者のみ接続可能な状態でソケットを作る
+	// 作成後に権限を変えると、変えるまでの間に接続されるおそれがある
+	oldMask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", walletUnlockSocket)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	ready()
+
+	// 期限が来たらソケットを閉じ、Acceptを終わらせる
+	timer := time.AfterFunc(timeout, func() { ln.Close() })
+	defer timer.Stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		if serveWalletAgent(conn, ln, key) {
+			break
+		}
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	return nil
+}
+
+// 要求に応答し、lockを要求された場合はtrueを返す
+func serveWalletAgent(conn net.Conn, ln net.Listener, key []byte) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(walletAgentTimeout))
+	var command string
+	if err := gob.NewDecoder(conn).Decode(&command); err != nil {
+		return false
+	}
+	var reply walletAgentReply
+	switch command {
+	case walletAgentGetKey:
+		reply.Key = key
+	case walletAgentLock:
+		// 応答する前にソケットを削除し、次に起動するプロセスのソケットを消さないようにする
+		ln.Close()
+	default:
+		return false
+	}
+	gob.NewEncoder(conn).Encode(reply)
+	return command == walletAgentLock
+}
+
+// ロック解除中のプロセスに要求を送り、応答の鍵を返す
+func requestWalletAgent(command string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", walletUnlockSocket, walletAgentTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(walletAgentTimeout))
+	if err := gob.NewEncoder(conn).Encode(command); err != nil {
+		return nil, err
+	}
+	var reply walletAgentReply
+	if err := gob.NewDecoder(conn).Decode(&reply); err != nil {
+		return nil, err
+	}
+	return reply.Key, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Base58のエンコード・デコードが元に戻るか
+func TestBase58(t *testing.T) {
+	data := []byte{0x00, 0x00, 0x01, 0x02, 0xff}
+	encoded := Base58Encode(data)
+	decoded := Base58Decode(encoded)
+	if !bytes.Equal(data, decoded) {
+		t.Errorf("Base58Decode(%s) = %x, want %x", encoded, decoded, data)
+	}
+}
+
+// 生成したアドレスが検証を通り、改ざんしたアドレスが弾かれるか
+func TestValidateAddress(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	if !ValidateAddress(address) {
+		t.Fatalf("ValidateAddress(%s) = false", address)
+	}
+	tampered := []byte(address)
+	if tampered[5] == '2' {
+		tampered[5] = '3'
+	} else {
+		tampered[5] = '2'
+	}
+	if ValidateAddress(string(tampered)) {
+		t.Errorf("ValidateAddress(%s) = true", tampered)
+	}
+	if ValidateAddress("Ivan") {
+		t.Error("ValidateAddress(Ivan) = true")
+	}
+	// バージョンとチェックサムが正しくても、ハッシュが20バイトでないアドレスは弾く
+	for _, n := range []int{0, 19, 21} {
+		payload := append([]byte{version}, make([]byte, n)...)
+		short := string(Base58Encode(append(payload, checksum(payload)...)))
+		if ValidateAddress(short) {
+			t.Errorf("ValidateAddress() with a %d-byte hash = true", n)
+		}
+		if hash := AddressToPubKeyHash([]byte(short)); hash != nil {
+			t.Errorf("AddressToPubKeyHash() with a %d-byte hash = %x, want nil", n, hash)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ウォレットを保存するファイル（blockchain.dbと同じ場所）
+const walletFile = "wallet.dat"
+
+// パスフレーズから鍵を導出するscryptのパラメータ
+const scryptN = 32768
+const scryptR = 8
+const scryptP = 1
+const walletKeyLen = 32 // AES-256
+
+// シードを暗号化する際に追加データとして認証する名前
+const hdSeedLabel = "hdseed"
+
+// パスフレーズの確認用に暗号化する既知のデータ
+var walletCheckData = []byte("my_blockchain wallet")
+
+// ウォレットが暗号化されていてロック中の場合のエラー
+var ErrWalletLocked = errors.New("ウォレットはロックされています")
+
+// 複数のウォレットをアドレスをキーにして管理
+type Wallets struct {
+	Wallets map[string]*Wallet // 復号済みのウォレット
+
+	encrypted  bool              // 秘密鍵が暗号化されているか
+	salt       []byte            // 鍵導出に用いるソルト
+	check      []byte            // パスフレーズ確認用の暗号文
+	cipherKeys map[string][]byte // 暗号化された秘密鍵（nonce + 暗号文）
+	key        []byte            // 復号鍵（ロック解除中のみ保持）
+
+	hdSeed     []byte            // HDウォレットのシード（復号済み）
+	cipherSeed []byte            // 暗号化されたシード
+	hdNext     [2]uint32         // 外部・内部チェーンの次のインデックス
+	hdPaths    map[string]string // HDウォレットのアドレスの導出パス
+
+	scripts map[string][]byte // P2SHアドレスのredeemスクリプト
+}
+
+// ウォレットファイルの保存形式
+type walletFileData struct {
+	Encrypted bool
+	Salt      []byte
+	Check     []byte            // パスフレーズ確認用の暗号文
+	Keys      map[string][]byte // 秘密鍵（暗号化時はnonce + 暗号文）
+	HDSeed    []byte            // HDウォレットのシード（暗号化時はnonce + 暗号文）
+	HDNext    []uint32          // 外部・内部チェーンの次のインデックス
+	HDPaths   map[string]string // アドレスの導出パス
+	Scripts   map[string][]byte // P2SHアドレスのredeemスクリプト
+}
+
+// ウォレットファイルから読み込んだWalletsを生成
+// ファイルが存在しない場合は空のWalletsを返す
+func NewWallets() (*Wallets, error) {
+	wallets := Wallets{}
+	wallets.Wallets = make(map[string]*Wallet)
+	wallets.cipherKeys = make(map[string][]byte)
+	wallets.hdPaths = make(map[string]string)
+	wallets.scripts = make(map[string][]byte)
+	err := wallets.LoadFromFile()
+	if err != nil {
+		return &wallets, err
+	}
+	// walletpassphraseでロック解除されている場合はそのまま復号する
+	if wallets.encrypted {
+		if key := loadUnlockKey(); key != nil {
+			err = wallets.unlockWithKey(key)
+		}
+	}
+	return &wallets, err
+}
+
+// 新しいウォレットを生成して追加し、そのアドレスを返す
+func (ws *Wallets) CreateWallet() string {
+	return ws.AddWallet(NewWallet())
+}
+
+// ウォレットを追加し、そのアドレスを返す
+func (ws *Wallets) AddWallet(wallet *Wallet) string {
+	address := string(wallet.GetAddress())
+	ws.Wallets[address] = wallet
+	return address
+}
+
+// 管理している全てのアドレスを返す
+func (ws *Wallets) GetAddresses() []string {
+	var addresses []string
+	for address := range ws.Wallets {
+		addresses = append(addresses, address)
+	}
+	// ロック中で復号していないアドレスも含める
+	for address := range ws.cipherKeys {
+		if _, ok := ws.Wallets[address]; !ok {
+			addresses = append(addresses, address)
+		}
+	}
+	// 表示順が毎回変わらないように並べ替える
+	sort.Strings(addresses)
+	return addresses
+}
+
+// アドレスがウォレットで管理されているか
+func (ws Wallets) HasAddress(address string) bool {
+	_, ok := ws.Wallets[address]
+	_, encrypted := ws.cipherKeys[address]
+	return ok || encrypted
+}
+
+// アドレスに対応するウォレットを返す
+func (ws Wallets) GetWallet(address string) (*Wallet, error) {
+	if !ws.HasAddress(address) {
+		return nil, fmt.Errorf("アドレス'%s'の鍵はウォレットにありません", address)
+	}
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return nil, ErrWalletLocked
+	}
+	return wallet, nil
+}
+
+// 秘密鍵が暗号化されているか
+func (ws Wallets) IsEncrypted() bool {
+	return ws.encrypted
+}
+
+// 暗号化されていて、かつロック中か
+func (ws Wallets) IsLocked() bool {
+	return ws.encrypted && ws.key == nil
+}
+
+// パスフレーズを設定し、以降の保存で秘密鍵を暗号化する
+func (ws *Wallets) Encrypt(passphrase string) error {
+	if ws.encrypted {
+		return errors.New("ウォレットはすでに暗号化されています")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := deriveWalletKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	ws.encrypted = true
+	ws.salt = salt
+	ws.key = key
+	ws.check = ws.seal(walletCheckData, "")
+	return nil
+}
+
+// パスフレーズで秘密鍵を復号する
+func (ws *Wallets) Unlock(passphrase string) error {
+	if !ws.encrypted {
+		return nil
+	}
+	key, err := deriveWalletKey(passphrase, ws.salt)
+	if err != nil {
+		return err
+	}
+	return ws.unlockWithKey(key)
+}
+
+// 導出済みの鍵で秘密鍵を復号する
+func (ws *Wallets) unlockWithKey(key []byte) error {
+	// 鍵が一つもない場合でも誤ったパスフレーズを受け付けないよう確認
+	if _, err := openWithKey(key, ws.check, ""); err != nil {
+		return errors.New("パスフレーズが正しくありません")
+	}
+	wallets := make(map[string]*Wallet)
+	for address, data := range ws.cipherKeys {
+		// アドレスを追加データとして認証し、鍵の入れ替えを防ぐ
+		plain, err := openWithKey(key, data, address)
+		if err != nil {
+			return errors.New("ウォレットファイルが壊れています")
+		}
+		wallet, err := NewWalletFromPrivateKey(plain)
+		if err != nil {
+			return err
+		}
+		wallets[address] = wallet
+	}
+	var seed []byte
+	if len(ws.cipherSeed) > 0 {
+		plain, err := openWithKey(key, ws.cipherSeed, hdSeedLabel)
+		if err != nil {
+			return errors.New("ウォレットファイルが壊れています")
+		}
+		seed = plain
+	}
+	for address, wallet := range wallets {
+		ws.Wallets[address] = wallet
+	}
+	ws.hdSeed = seed
+	ws.key = key
+	return nil
+}
+
+// 復号鍵と復号済みの秘密鍵をメモリから破棄する
+func (ws *Wallets) Lock() {
+	if !ws.encrypted {
+		return
+	}
+	ws.key = nil
+	ws.Wallets = make(map[string]*Wallet)
+	ws.hdSeed = nil
+}
+
+// 復号鍵をtimeout秒間保持するプロセスを起動し、他のコマンドから使えるようにする
+// 鍵はファイルに書き出さず、起動したプロセスに標準入力で渡す
+func (ws Wallets) SaveUnlock(timeout int) {
+	if ws.IsLocked() {
+		log.Panic(ErrWalletLocked)
+	}
+	// 以前のロック解除状態は破棄する
+	RemoveUnlock()
+	exe, err := os.Executable()
+	if err != nil {
+		log.Panic(err)
+	}
+	cmd := exec.Command(exe, walletAgentCommand, "-timeout", strconv.Itoa(timeout))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Panic(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Panic(err)
+	}
+	fmt.Fprintln(stdin, hex.EncodeToString(ws.key))
+	stdin.Close()
+	// ソケットの準備ができるまで待つ（失敗した場合は最後の行がエラー）
+	reader := bufio.NewReader(stdout)
+	var last string
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			last = line
+		}
+		if last == "ok" || err != nil {
+			break
+		}
+	}
+	if last != "ok" {
+		log.Panic("ERROR: ロック解除状態を保持できません: ", last)
+	}
+	if err := cmd.Process.Release(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// ロック解除中のプロセスを終了させ、復号鍵を破棄する
+func RemoveUnlock() {
+	// 実行中のプロセスがない場合は何もしない
+	requestWalletAgent(walletAgentLock)
+}
+
+// ロック解除中のプロセスがあれば復号鍵を返す
+func loadUnlockKey() []byte {
+	key, err := requestWalletAgent(walletAgentGetKey)
+	if err != nil || len(key) != walletKeyLen {
+		return nil
+	}
+	return key
+}
+
+// ウォレットファイルの読み込み
+func (ws *Wallets) LoadFromFile() error {
+	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+		return nil // まだ一つもウォレットがない
+	}
+	fileContent, err := ioutil.ReadFile(walletFile)
+	if err != nil {
+		return err
+	}
+
+	var data walletFileData
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&data)
+	if err != nil {
+		// 暗号化対応前の形式（アドレスと秘密鍵のmap）
+		data = walletFileData{}
+		decoder = gob.NewDecoder(bytes.NewReader(fileContent))
+		if decoder.Decode(&data.Keys) != nil {
+			return err
+		}
+	}
+
+	if len(data.HDNext) == 2 {
+		ws.hdNext = [2]uint32{data.HDNext[0], data.HDNext[1]}
+	}
+	for address, path := range data.HDPaths {
+		ws.hdPaths[address] = path
+	}
+	for address, script := range data.Scripts {
+		ws.scripts[address] = script
+	}
+
+	if data.Encrypted {
+		ws.encrypted = true
+		ws.cipherSeed = data.HDSeed
+		ws.salt = data.Salt
+		ws.check = data.Check
+		for address, cipherKey := range data.Keys {
+			ws.cipherKeys[address] = cipherKey
+		}
+		return nil
+	}
+	for address, key := range data.Keys {
+		wallet, err := NewWalletFromPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		ws.Wallets[address] = wallet
+	}
+	ws.hdSeed = data.HDSeed
+	return nil
+}
+
+// ウォレットファイルへの保存
+// 暗号化されている場合、秘密鍵はAES-GCMで暗号化して保存する
+func (ws Wallets) SaveToFile() {
+	data := walletFileData{
+		Encrypted: ws.encrypted,
+		Salt:      ws.salt,
+		Check:     ws.check,
+		Keys:      make(map[string][]byte),
+		HDSeed:    ws.hdSeed,
+		HDNext:    ws.hdNext[:],
+		HDPaths:   ws.hdPaths,
+		Scripts:   ws.scripts,
+	}
+	if ws.encrypted {
+		// ロック中のまま残っている鍵は暗号文をそのまま保存
+		for address, cipherKey := range ws.cipherKeys {
+			data.Keys[address] = cipherKey
+		}
+		data.HDSeed = ws.cipherSeed
+		if (len(ws.Wallets) > 0 || len(ws.hdSeed) > 0) && ws.key == nil {
+			log.Panic(ErrWalletLocked)
+		}
+		if len(ws.hdSeed) > 0 {
+			data.HDSeed = ws.seal(ws.hdSeed, hdSeedLabel)
+		}
+	}
+	for address, wallet := range ws.Wallets {
+		if ws.encrypted {
+			data.Keys[address] = ws.seal(wallet.PrivateKeyBytes(), address)
+		} else {
+			data.Keys[address] = wallet.PrivateKeyBytes()
+		}
+	}
+
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	// 秘密鍵を含むので所有者のみ読み書き可能にする
+	err = ioutil.WriteFile(walletFile, content.Bytes(), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// データをAES-GCMで暗号化し、nonce + 暗号文を返す
+// 追加データとしてアドレスを認証する
+func (ws Wallets) seal(plain []byte, address string) []byte {
+	gcm, err := newWalletCipher(ws.key)
+	if err != nil {
+		log.Panic(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Panic(err)
+	}
+	return gcm.Seal(nonce, nonce, plain, []byte(address))
+}
+
+// nonce + 暗号文を復号する
+func openWithKey(key, data []byte, address string) ([]byte, error) {
+	gcm, err := newWalletCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("暗号文が短すぎます")
+	}
+	return gcm.Open(nil, data[:nonceSize], data[nonceSize:], []byte(address))
+}
+
+// パスフレーズからscryptで暗号鍵を導出
+func deriveWalletKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, walletKeyLen)
+}
+
+// 暗号鍵からAES-GCMを生成
+func newWalletCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// 一時ディレクトリで実行し、終了時に元のディレクトリに戻す
+// ウォレットファイルなどはカレントディレクトリに作られる
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// 暗号化したウォレットを保存し、読み込み直したものを返す
+func newEncryptedWallets(t *testing.T, passphrase string) (*Wallets, *Wallet) {
+	t.Helper()
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, _ := ws.GetWallet(ws.CreateWallet())
+	if err := ws.Encrypt(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	ws.SaveToFile()
+	loaded, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded, wallet
+}
+
+// 暗号化、ロック解除、ロック
+func TestEncryptUnlockLock(t *testing.T) {
+	chdirTemp(t)
+	ws, wallet := newEncryptedWallets(t, "passphrase")
+	address := string(wallet.GetAddress())
+
+	// 秘密鍵は平文で保存されない
+	content, err := ioutil.ReadFile(walletFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, wallet.PrivateKeyBytes()) {
+		t.Error("wallet file contains the private key in the clear")
+	}
+
+	if !ws.IsEncrypted() || !ws.IsLocked() {
+		t.Fatalf("IsEncrypted() = %v, IsLocked() = %v, want encrypted and locked", ws.IsEncrypted(), ws.IsLocked())
+	}
+	if !ws.HasAddress(address) {
+		t.Errorf("HasAddress(%s) = false while locked", address)
+	}
+	if _, err := ws.GetWallet(address); err != ErrWalletLocked {
+		t.Errorf("GetWallet() while locked = %v, want ErrWalletLocked", err)
+	}
+	if err := ws.Encrypt("other"); err == nil {
+		t.Error("Encrypt() of an encrypted wallet succeeded")
+	}
+
+	if err := ws.Unlock("wrong"); err == nil || !ws.IsLocked() {
+		t.Errorf("Unlock() with a wrong passphrase = %v, locked %v", err, ws.IsLocked())
+	}
+	if err := ws.Unlock("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := ws.GetWallet(address)
+	if err != nil || !bytes.Equal(unlocked.PrivateKeyBytes(), wallet.PrivateKeyBytes()) {
+		t.Fatalf("GetWallet() after Unlock() = %v, %v", unlocked, err)
+	}
+
+	ws.Lock()
+	if !ws.IsLocked() || len(ws.Wallets) != 0 {
+		t.Errorf("Lock() left %d decrypted keys", len(ws.Wallets))
+	}
+}
+
+// 環境変数のパスフレーズでロックを解除する
+func TestUnlockWalletsFromEnv(t *testing.T) {
+	chdirTemp(t)
+	ws, _ := newEncryptedWallets(t, "passphrase")
+	defer os.Setenv(walletPassphraseEnv, os.Getenv(walletPassphraseEnv))
+	os.Setenv(walletPassphraseEnv, "passphrase")
+
+	cli := CLI{}
+	cli.unlockWallets(ws)
+	if ws.IsLocked() {
+		t.Error("unlockWallets() did not use the passphrase from the environment")
+	}
+}
+
+// ロック解除中のプロセスから鍵を受け取り、lockまたは期限切れで鍵が破棄されるか
+func TestWalletAgent(t *testing.T) {
+	chdirTemp(t)
+	ws, _ := newEncryptedWallets(t, "passphrase")
+	if err := ws.Unlock("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(timeout time.Duration) chan error {
+		ready := make(chan struct{})
+		done := make(chan error, 1)
+		key := append([]byte{}, ws.key...)
+		go func() { done <- runWalletAgent(key, timeout, func() { close(ready) }) }()
+		select {
+		case <-ready:
+		case err := <-done:
+			t.Fatalf("runWalletAgent() = %v", err)
+		}
+		return done
+	}
+
+	done := start(time.Minute)
+	// ソケットは作成した時点で所有者のみ接続可能
+	if info, err := os.Stat(walletUnlockSocket); err != nil {
+		t.Error(err)
+	} else if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket permissions = %v, want owner only", perm)
+	}
+	// 他のプロセスのNewWalletsはロック解除された状態で読み込める
+	loaded, err := NewWallets()
+	if err != nil || loaded.IsLocked() {
+		t.Fatalf("NewWallets() while unlocked = locked %v, %v", loaded.IsLocked(), err)
+	}
+	// 鍵の保持中は二重に起動できない
+	if err := runWalletAgent(ws.key, time.Minute, func() {}); err == nil {
+		t.Error("second runWalletAgent() succeeded")
+	}
+
+	RemoveUnlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if key := loadUnlockKey(); key != nil {
+		t.Error("loadUnlockKey() returned a key after RemoveUnlock()")
+	}
+	if _, err := os.Stat(walletUnlockSocket); !os.IsNotExist(err) {
+		t.Errorf("socket remains after RemoveUnlock(): %v", err)
+	}
+
+	done = start(50 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := NewWallets(); !loaded.IsLocked() {
+		t.Error("wallet is still unlocked after the timeout")
+	}
+}